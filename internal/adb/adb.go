@@ -0,0 +1,337 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package adb implements the adb container format apk-tools 3 uses for
+// packages and indexes.
+//
+// An adb file starts with a magic and a schema identifier, followed by
+// a sequence of blocks.  The ADB block holds a database of values: ints,
+// blobs, and objects and arrays of values, which are referenced by
+// offset.  The meaning of the fields of each object is defined by the
+// schema.  Signature blocks follow the ADB block, and a package has a
+// data block with the contents of each of its files after those.
+package adb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// Val is an encoded adb value.  Its upper four bits hold the type of the
+// value and the lower 28 bits either the value itself, for small ints,
+// or the offset of the value in the database.
+type Val uint32
+
+// Null is the value of unset fields.
+const Null Val = 0
+
+const (
+	typeInt    Val = 0x10000000
+	typeInt32  Val = 0x20000000
+	typeInt64  Val = 0x30000000
+	typeBlob8  Val = 0x80000000
+	typeBlob16 Val = 0x90000000
+	typeBlob32 Val = 0xa0000000
+	typeArray  Val = 0xd0000000
+	typeObject Val = 0xe0000000
+	typeMask   Val = 0xf0000000
+	valueMask  Val = 0x0fffffff
+)
+
+// hdrSize is the size of the header at the start of the database, which
+// holds its version and root value.
+const hdrSize = 8
+
+// Builder encodes values into a database.
+type Builder struct {
+	buf []byte
+	err error
+}
+
+// NewBuilder returns a builder for an empty database.
+func NewBuilder() *Builder {
+	return &Builder{buf: make([]byte, hdrSize)}
+}
+
+// alloc appends size bytes, aligned to align, and returns their offset.
+func (b *Builder) alloc(align, size int) int {
+	for len(b.buf)%align != 0 {
+		b.buf = append(b.buf, 0)
+	}
+
+	off := len(b.buf)
+	if off > int(valueMask) {
+		b.err = fmt.Errorf("database exceeds %d bytes", valueMask)
+	}
+	b.buf = append(b.buf, make([]byte, size)...)
+	return off
+}
+
+// Int encodes v, inline if it is small enough.
+func (b *Builder) Int(v uint64) Val {
+	switch {
+	case v <= uint64(valueMask):
+		return typeInt | Val(v)
+	case v <= math.MaxUint32:
+		off := b.alloc(4, 4)
+		binary.LittleEndian.PutUint32(b.buf[off:], uint32(v))
+		return typeInt32 | Val(off)
+	default:
+		off := b.alloc(8, 8)
+		binary.LittleEndian.PutUint64(b.buf[off:], v)
+		return typeInt64 | Val(off)
+	}
+}
+
+// Blob encodes data, using the smallest length prefix it fits in.  An
+// empty blob is encoded as Null.
+func (b *Builder) Blob(data []byte) Val {
+	var v Val
+	var off int
+
+	switch {
+	case len(data) == 0:
+		return Null
+	case len(data) <= math.MaxUint8:
+		off = b.alloc(1, 1+len(data))
+		b.buf[off] = uint8(len(data))
+		copy(b.buf[off+1:], data)
+		v = typeBlob8
+	case len(data) <= math.MaxUint16:
+		off = b.alloc(2, 2+len(data))
+		binary.LittleEndian.PutUint16(b.buf[off:], uint16(len(data)))
+		copy(b.buf[off+2:], data)
+		v = typeBlob16
+	default:
+		off = b.alloc(4, 4+len(data))
+		binary.LittleEndian.PutUint32(b.buf[off:], uint32(len(data)))
+		copy(b.buf[off+4:], data)
+		v = typeBlob32
+	}
+
+	return v | Val(off)
+}
+
+// String encodes s as a blob.
+func (b *Builder) String(s string) Val {
+	return b.Blob([]byte(s))
+}
+
+// Object encodes an object whose fields, starting from field 1, are
+// fields.  Trailing unset fields are left out, and an object without
+// any set field is encoded as Null.
+func (b *Builder) Object(fields ...Val) Val {
+	for len(fields) > 0 && fields[len(fields)-1] == Null {
+		fields = fields[:len(fields)-1]
+	}
+
+	return b.vector(typeObject, fields)
+}
+
+// Array encodes an array of items.  An empty array is encoded as Null.
+func (b *Builder) Array(items ...Val) Val {
+	return b.vector(typeArray, items)
+}
+
+// vector encodes an object or an array: the number of slots, including
+// the one holding that number, followed by the values.
+func (b *Builder) vector(typ Val, vals []Val) Val {
+	if len(vals) == 0 {
+		return Null
+	}
+
+	off := b.alloc(4, 4*(len(vals)+1))
+	binary.LittleEndian.PutUint32(b.buf[off:], uint32(len(vals)+1))
+	for i, v := range vals {
+		binary.LittleEndian.PutUint32(b.buf[off+4*(i+1):], uint32(v))
+	}
+
+	return typ | Val(off)
+}
+
+// Finish returns the database with root as its root value.
+func (b *Builder) Finish(root Val) ([]byte, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+
+	// The compatibility version, version and reserved fields are all
+	// zero.
+	binary.LittleEndian.PutUint32(b.buf[4:], uint32(root))
+	return b.buf, nil
+}
+
+// DB reads the values of a database.
+type DB struct {
+	data []byte
+}
+
+// NewDB returns a reader for the database held by the payload of an ADB
+// block.
+func NewDB(data []byte) (*DB, error) {
+	if len(data) < hdrSize {
+		return nil, fmt.Errorf("database is truncated")
+	}
+	if data[0] != 0 {
+		return nil, fmt.Errorf("unsupported database compatibility version %d", data[0])
+	}
+
+	return &DB{data: data}, nil
+}
+
+// Root returns the root value of the database.
+func (db *DB) Root() Val {
+	return Val(binary.LittleEndian.Uint32(db.data[4:]))
+}
+
+// deref returns the size bytes at the offset v holds.
+func (db *DB) deref(v Val, size int) ([]byte, error) {
+	off := int(v & valueMask)
+	if off < hdrSize || off+size > len(db.data) {
+		return nil, fmt.Errorf("value %#x is out of bounds", uint32(v))
+	}
+
+	return db.data[off : off+size], nil
+}
+
+// Int returns the int v holds.  Null is returned as 0.
+func (db *DB) Int(v Val) (uint64, error) {
+	switch v & typeMask {
+	case typeInt:
+		return uint64(v & valueMask), nil
+	case typeInt32:
+		data, err := db.deref(v, 4)
+		if err != nil {
+			return 0, err
+		}
+		return uint64(binary.LittleEndian.Uint32(data)), nil
+	case typeInt64:
+		data, err := db.deref(v, 8)
+		if err != nil {
+			return 0, err
+		}
+		return binary.LittleEndian.Uint64(data), nil
+	}
+
+	if v == Null {
+		return 0, nil
+	}
+	return 0, fmt.Errorf("value %#x is not an int", uint32(v))
+}
+
+// Blob returns the blob v holds.  The returned slice points into the
+// database.  Null is returned as an empty blob.
+func (db *DB) Blob(v Val) ([]byte, error) {
+	var prefix int
+	switch v & typeMask {
+	case typeBlob8:
+		prefix = 1
+	case typeBlob16:
+		prefix = 2
+	case typeBlob32:
+		prefix = 4
+	default:
+		if v == Null {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("value %#x is not a blob", uint32(v))
+	}
+
+	data, err := db.deref(v, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var size int
+	switch prefix {
+	case 1:
+		size = int(data[0])
+	case 2:
+		size = int(binary.LittleEndian.Uint16(data))
+	case 4:
+		size = int(binary.LittleEndian.Uint32(data))
+	}
+
+	data, err = db.deref(v, prefix+size)
+	if err != nil {
+		return nil, err
+	}
+
+	return data[prefix:], nil
+}
+
+// Object returns the fields of the object v holds, indexed from 1 as in
+// the schema, so that the first element is unused.  Fields which are
+// not present are not part of the returned slice; use Field to access
+// them.  Null is returned as an object without fields.
+func (db *DB) Object(v Val) ([]Val, error) {
+	if v == Null {
+		return nil, nil
+	}
+	if v&typeMask != typeObject {
+		return nil, fmt.Errorf("value %#x is not an object", uint32(v))
+	}
+
+	return db.vector(v)
+}
+
+// Array returns the items of the array v holds.  Null is returned as an
+// empty array.
+func (db *DB) Array(v Val) ([]Val, error) {
+	if v == Null {
+		return nil, nil
+	}
+	if v&typeMask != typeArray {
+		return nil, fmt.Errorf("value %#x is not an array", uint32(v))
+	}
+
+	vals, err := db.vector(v)
+	if err != nil || len(vals) == 0 {
+		return nil, err
+	}
+	return vals[1:], nil
+}
+
+func (db *DB) vector(v Val) ([]Val, error) {
+	data, err := db.deref(v, 4)
+	if err != nil {
+		return nil, err
+	}
+
+	n := int(binary.LittleEndian.Uint32(data))
+	if n == 0 {
+		return nil, nil
+	}
+
+	data, err = db.deref(v, 4*n)
+	if err != nil {
+		return nil, err
+	}
+
+	vals := make([]Val, n)
+	for i := 1; i < n; i++ {
+		vals[i] = Val(binary.LittleEndian.Uint32(data[4*i:]))
+	}
+	return vals, nil
+}
+
+// Field returns field i of an object returned by DB.Object, or Null if
+// the object does not have it.
+func Field(obj []Val, i int) Val {
+	if i < len(obj) {
+		return obj[i]
+	}
+	return Null
+}
@@ -0,0 +1,152 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package adb
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestValues(t *testing.T) {
+	ints := []uint64{0, 42, uint64(valueMask), uint64(valueMask) + 1, 1 << 40}
+	blobs := [][]byte{[]byte("hello"), bytes.Repeat([]byte("x"), 300), bytes.Repeat([]byte("y"), 70000)}
+
+	b := NewBuilder()
+	vals := []Val{}
+	for _, n := range ints {
+		vals = append(vals, b.Int(n))
+	}
+	for _, blob := range blobs {
+		vals = append(vals, b.Blob(blob))
+	}
+	data, err := b.Finish(b.Object(b.Array(vals...), Null, b.Object()))
+	require.NoError(t, err)
+
+	db, err := NewDB(data)
+	require.NoError(t, err)
+
+	root, err := db.Object(db.Root())
+	require.NoError(t, err)
+	require.Len(t, root, 2)
+	require.Equal(t, Null, Field(root, 2))
+	require.Equal(t, Null, Field(root, 3))
+
+	items, err := db.Array(Field(root, 1))
+	require.NoError(t, err)
+	require.Len(t, items, len(ints)+len(blobs))
+
+	for i, n := range ints {
+		got, err := db.Int(items[i])
+		require.NoError(t, err)
+		require.Equal(t, n, got)
+	}
+	for i, blob := range blobs {
+		got, err := db.Blob(items[len(ints)+i])
+		require.NoError(t, err)
+		require.Equal(t, blob, got)
+	}
+
+	_, err = db.Blob(items[0])
+	require.Error(t, err)
+}
+
+func TestParseDependency(t *testing.T) {
+	tests := []struct {
+		dep      string
+		expected Dependency
+	}{
+		{"so:libc.so.6", Dependency{Name: "so:libc.so.6"}},
+		{"cmd:hello=1.0-r0", Dependency{Name: "cmd:hello", Version: "1.0-r0", Match: MatchEqual}},
+		{"busybox>=1.35", Dependency{Name: "busybox", Version: "1.35", Match: MatchGreater | MatchEqual}},
+		{"!evil<2", Dependency{Name: "evil", Version: "2", Match: MatchConflict | MatchLess}},
+		{"!evil", Dependency{Name: "evil", Match: MatchConflict}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.dep, func(t *testing.T) {
+			dep := ParseDependency(test.dep)
+			require.Equal(t, test.expected, dep)
+			require.Equal(t, test.dep, dep.String())
+		})
+	}
+}
+
+func TestPackageRoundTrip(t *testing.T) {
+	contents := map[string][]byte{
+		"usr/bin/hello":       []byte("#!/bin/sh\necho hello\n"),
+		"usr/share/hello/txt": bytes.Repeat([]byte("hello"), 1000),
+	}
+	entry := func(name, path string) Entry {
+		digest := sha256.Sum256(contents[path])
+		return Entry{Name: name, ACL: ACL{Mode: 0755, User: "root", Group: "root"}, Size: uint64(len(contents[path])), Hash: digest[:]}
+	}
+	dirACL := ACL{Mode: 0755, User: "root", Group: "root"}
+
+	pkg := &Package{
+		Info: PackageInfo{
+			Name:          "hello",
+			Version:       "1.0-r0",
+			Arch:          "x86_64",
+			License:       "Apache-2.0",
+			BuildTime:     1234,
+			InstalledSize: 5000,
+			Depends:       []Dependency{ParseDependency("so:libc.so.6"), ParseDependency("busybox>=1.35")},
+			Provides:      []Dependency{ParseDependency("cmd:hello=1.0-r0")},
+		},
+		Paths: []Dir{
+			{Name: "usr", ACL: dirACL},
+			{Name: "usr/bin", ACL: dirACL, Files: []Entry{
+				entry("hello", "usr/bin/hello"),
+				{Name: "hi", ACL: ACL{Mode: 0777, User: "root", Group: "root"}, Target: SymlinkTarget("hello")},
+			}},
+			{Name: "usr/share/hello", ACL: dirACL, Files: []Entry{entry("txt", "usr/share/hello/txt")}},
+		},
+		Scripts:  Scripts{PostInstall: "#!/bin/sh\ntrue\n"},
+		Triggers: []string{"/usr/share/hello"},
+	}
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	require.NoError(t, WritePackage(&buf, pkg, func(path string) (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(contents[path])), nil
+	}, key))
+	require.Len(t, pkg.Info.UniqueID, sha256.Size)
+
+	pf, err := ReadPackage(bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+	require.Equal(t, pkg, pf.Package)
+	require.Equal(t, contents, pf.Data)
+
+	target, ok := pf.Package.Paths[1].Files[1].Symlink()
+	require.True(t, ok)
+	require.Equal(t, "hello", target)
+
+	require.NoError(t, pf.Verify(&key.PublicKey))
+	require.ErrorIs(t, pf.Verify(&other.PublicKey), ErrUnsigned)
+
+	// Tampering with the metadata invalidates the signature.
+	pf.Blocks[0].Data[len(pf.Blocks[0].Data)-1] ^= 0xff
+	require.Error(t, pf.Verify(&key.PublicKey))
+}
@@ -0,0 +1,241 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package adb
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	magic           = "ADB."
+	magicCompressed = "ADBd"
+
+	// SchemaPackage identifies a package, "pckg".
+	SchemaPackage uint32 = 0x676b6370
+
+	// SchemaIndex identifies an index, "indx".
+	SchemaIndex uint32 = 0x78646e69
+)
+
+// BlockType is the type of a block.
+type BlockType uint32
+
+const (
+	BlockADB  BlockType = 0
+	BlockSig  BlockType = 1
+	BlockData BlockType = 2
+
+	// blockExt marks a block whose size does not fit in 30 bits, which
+	// has an extended header.
+	blockExt BlockType = 3
+
+	blockAlignment = 8
+	maxShortBlock  = 0x3fffffff
+)
+
+// Block is a block of an adb file.
+type Block struct {
+	Type BlockType
+	Data []byte
+}
+
+// Writer writes the blocks of an adb file.
+type Writer struct {
+	w  io.Writer
+	zw *flate.Writer
+}
+
+// NewWriter writes the header of an adb file with the given schema to w
+// and returns a writer for its blocks.  If compress is set, the file is
+// compressed with deflate, as apk does by default.  The writer must be
+// closed to flush the compressed stream.
+func NewWriter(w io.Writer, schema uint32, compress bool) (*Writer, error) {
+	aw := &Writer{w: w}
+
+	if compress {
+		if _, err := io.WriteString(w, magicCompressed); err != nil {
+			return nil, err
+		}
+
+		zw, err := flate.NewWriter(w, flate.DefaultCompression)
+		if err != nil {
+			return nil, err
+		}
+		aw.w = zw
+		aw.zw = zw
+	}
+
+	hdr := make([]byte, 8)
+	copy(hdr, magic)
+	binary.LittleEndian.PutUint32(hdr[4:], schema)
+	if _, err := aw.w.Write(hdr); err != nil {
+		return nil, err
+	}
+
+	return aw, nil
+}
+
+// WriteBlock writes a block holding data.
+func (aw *Writer) WriteBlock(typ BlockType, data []byte) error {
+	return aw.WriteBlockFrom(typ, uint64(len(data)), bytes.NewReader(data))
+}
+
+// WriteBlockFrom writes a block holding the size bytes read from r.
+func (aw *Writer) WriteBlockFrom(typ BlockType, size uint64, r io.Reader) error {
+	var hdr []byte
+	var raw uint64
+
+	if size <= maxShortBlock-4 {
+		raw = 4 + size
+		hdr = make([]byte, 4)
+		binary.LittleEndian.PutUint32(hdr, uint32(typ)<<30|uint32(raw))
+	} else {
+		raw = 16 + size
+		hdr = make([]byte, 16)
+		binary.LittleEndian.PutUint32(hdr, uint32(blockExt)<<30|uint32(typ))
+		binary.LittleEndian.PutUint64(hdr[8:], raw)
+	}
+
+	if _, err := aw.w.Write(hdr); err != nil {
+		return err
+	}
+
+	n, err := io.CopyN(aw.w, r, int64(size))
+	if err != nil {
+		return fmt.Errorf("copied %d of %d bytes: %w", n, size, err)
+	}
+
+	padding := make([]byte, (blockAlignment-raw%blockAlignment)%blockAlignment)
+	_, err = aw.w.Write(padding)
+	return err
+}
+
+// Close flushes the compressed stream, if any.  It does not close the
+// underlying writer.
+func (aw *Writer) Close() error {
+	if aw.zw != nil {
+		return aw.zw.Close()
+	}
+	return nil
+}
+
+// IsFile returns whether header, the first bytes of a file, are those of
+// an adb file, compressed or not.
+func IsFile(header []byte) bool {
+	return bytes.HasPrefix(header, []byte(magic)) || bytes.HasPrefix(header, []byte(magicCompressed))
+}
+
+// File is a decoded adb file.
+type File struct {
+	Schema uint32
+	Blocks []Block
+}
+
+// ReadFile reads a whole adb file, compressed or not, from r.
+func ReadFile(r io.Reader) (*File, error) {
+	br := bufio.NewReader(r)
+
+	m, err := br.Peek(len(magic))
+	if err != nil {
+		return nil, fmt.Errorf("unable to read header: %w", err)
+	}
+
+	var rd io.Reader = br
+	if string(m) == magicCompressed {
+		if _, err := br.Discard(len(magicCompressed)); err != nil {
+			return nil, err
+		}
+		rd = flate.NewReader(br)
+	}
+
+	hdr := make([]byte, 8)
+	if _, err := io.ReadFull(rd, hdr); err != nil {
+		return nil, fmt.Errorf("unable to read header: %w", err)
+	}
+	if string(hdr[:4]) != magic {
+		return nil, fmt.Errorf("not an adb file")
+	}
+
+	f := &File{Schema: binary.LittleEndian.Uint32(hdr[4:])}
+	for {
+		b, err := readBlock(rd)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unable to read block %d: %w", len(f.Blocks), err)
+		}
+		f.Blocks = append(f.Blocks, *b)
+	}
+
+	return f, nil
+}
+
+// readBlock reads the next block, or returns io.EOF at the end of the
+// file.
+func readBlock(r io.Reader) (*Block, error) {
+	hdr := make([]byte, 4)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, err
+	}
+
+	typeSize := binary.LittleEndian.Uint32(hdr)
+	typ := BlockType(typeSize >> 30)
+	raw := uint64(typeSize & maxShortBlock)
+	hdrLen := uint64(4)
+
+	if typ == blockExt {
+		ext := make([]byte, 12)
+		if _, err := io.ReadFull(r, ext); err != nil {
+			return nil, io.ErrUnexpectedEOF
+		}
+		typ = BlockType(typeSize & maxShortBlock)
+		raw = binary.LittleEndian.Uint64(ext[4:])
+		hdrLen = 16
+	}
+
+	if raw < hdrLen {
+		return nil, fmt.Errorf("invalid block size %d", raw)
+	}
+
+	var data bytes.Buffer
+	if _, err := io.CopyN(&data, r, int64(raw-hdrLen)); err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	// The last block is not necessarily padded.
+	padding := (blockAlignment - raw%blockAlignment) % blockAlignment
+	if _, err := io.CopyN(io.Discard, r, int64(padding)); err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+
+	return &Block{Type: typ, Data: data.Bytes()}, nil
+}
+
+// DB returns the database held by the ADB block, which must be the
+// first block of the file.
+func (f *File) DB() (*DB, error) {
+	if len(f.Blocks) == 0 || f.Blocks[0].Type != BlockADB {
+		return nil, fmt.Errorf("file does not start with an ADB block")
+	}
+
+	return NewDB(f.Blocks[0].Data)
+}
@@ -0,0 +1,644 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package adb
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+)
+
+// Field indexes of the package schema.
+const (
+	pkgInfo             = 1
+	pkgPaths            = 2
+	pkgScripts          = 3
+	pkgTriggers         = 4
+	pkgReplacesPriority = 5
+
+	piName             = 1
+	piVersion          = 2
+	piUniqueID         = 3
+	piDescription      = 4
+	piArch             = 5
+	piLicense          = 6
+	piOrigin           = 7
+	piMaintainer       = 8
+	piURL              = 9
+	piRepoCommit       = 10
+	piBuildTime        = 11
+	piInstalledSize    = 12
+	piFileSize         = 13
+	piProviderPriority = 14
+	piDepends          = 15
+	piProvides         = 16
+	piReplaces         = 17
+	piInstallIf        = 18
+
+	depName    = 1
+	depVersion = 2
+	depMatch   = 3
+
+	dirName  = 1
+	dirACL   = 2
+	dirFiles = 3
+
+	fileName   = 1
+	fileACL    = 2
+	fileSize   = 3
+	fileMTime  = 4
+	fileHashes = 5
+	fileTarget = 6
+
+	aclMode  = 1
+	aclUser  = 2
+	aclGroup = 3
+
+	scriptTrigger       = 1
+	scriptPreInstall    = 2
+	scriptPostInstall   = 3
+	scriptPreDeinstall  = 4
+	scriptPostDeinstall = 5
+	scriptPreUpgrade    = 6
+	scriptPostUpgrade   = 7
+)
+
+// Version match flags of a dependency.
+const (
+	MatchEqual    = 1
+	MatchLess     = 2
+	MatchGreater  = 4
+	MatchFuzzy    = 8
+	MatchConflict = 16
+)
+
+// symlinkMode is S_IFLNK, which prefixes the target of symlinks.
+const symlinkMode = 0120000
+
+// Dependency is a dependency, or a provided name, of a package.
+type Dependency struct {
+	Name    string
+	Version string
+	Match   uint64
+}
+
+var dependencyOps = []struct {
+	op    string
+	match uint64
+}{
+	{">=", MatchGreater | MatchEqual},
+	{"<=", MatchLess | MatchEqual},
+	{"~", MatchFuzzy | MatchEqual},
+	{"=", MatchEqual},
+	{">", MatchGreater},
+	{"<", MatchLess},
+}
+
+// ParseDependency parses a dependency in the form apk uses in .PKGINFO,
+// such as so:libc.so.6, busybox>=1.35 or !conflicting.
+func ParseDependency(s string) Dependency {
+	dep := Dependency{Name: s}
+
+	if strings.HasPrefix(s, "!") {
+		dep.Match = MatchConflict
+		s = s[1:]
+		dep.Name = s
+	}
+
+	if i := strings.IndexAny(s, "<>=~"); i > 0 {
+		for _, op := range dependencyOps {
+			if strings.HasPrefix(s[i:], op.op) {
+				dep.Name = s[:i]
+				dep.Version = s[i+len(op.op):]
+				dep.Match |= op.match
+				break
+			}
+		}
+	}
+
+	return dep
+}
+
+// String returns the dependency in the form ParseDependency accepts.
+func (dep Dependency) String() string {
+	s := dep.Name
+	if dep.Match&MatchConflict != 0 {
+		s = "!" + s
+	}
+
+	if dep.Version != "" {
+		for _, op := range dependencyOps {
+			if dep.Match&^MatchConflict == op.match {
+				return s + op.op + dep.Version
+			}
+		}
+	}
+
+	return s
+}
+
+// PackageInfo is the metadata of a package.
+type PackageInfo struct {
+	Name          string
+	Version       string
+	UniqueID      []byte
+	Description   string
+	Arch          string
+	License       string
+	Origin        string
+	Maintainer    string
+	URL           string
+	RepoCommit    string
+	BuildTime     uint64
+	InstalledSize uint64
+	Depends       []Dependency
+	Provides      []Dependency
+	Replaces      []Dependency
+	InstallIf     []Dependency
+}
+
+// ACL holds the permissions and ownership of a file or directory.
+type ACL struct {
+	Mode  uint64
+	User  string
+	Group string
+}
+
+// Entry is a file of a package.
+type Entry struct {
+	Name  string
+	ACL   ACL
+	Size  uint64
+	MTime uint64
+
+	// Hash is the SHA256 digest of the contents of a regular file.
+	Hash []byte
+
+	// Target holds the file type and the target of special files, such
+	// as symlinks, and is empty for regular files.
+	Target []byte
+}
+
+// SymlinkTarget returns the Target of a symlink to target.
+func SymlinkTarget(target string) []byte {
+	data := make([]byte, 2, 2+len(target))
+	binary.LittleEndian.PutUint16(data, symlinkMode)
+	return append(data, target...)
+}
+
+// Symlink returns the target of the file if it is a symlink.
+func (f *Entry) Symlink() (string, bool) {
+	if len(f.Target) < 2 || binary.LittleEndian.Uint16(f.Target) != symlinkMode {
+		return "", false
+	}
+	return string(f.Target[2:]), true
+}
+
+// hasData returns whether the contents of the file are stored in a data
+// block.
+func (f *Entry) hasData() bool {
+	return len(f.Target) == 0 && f.Size > 0
+}
+
+// Dir is a directory of a package, and the files it holds.  The root
+// directory is named "".
+type Dir struct {
+	Name  string
+	ACL   ACL
+	Files []Entry
+}
+
+// Scripts holds the scriptlets of a package.
+type Scripts struct {
+	Trigger       string
+	PreInstall    string
+	PostInstall   string
+	PreDeinstall  string
+	PostDeinstall string
+	PreUpgrade    string
+	PostUpgrade   string
+}
+
+// Package is the metadata stored in the ADB block of a package.  Paths
+// must be sorted by name, as must the files of each directory.
+type Package struct {
+	Info     PackageInfo
+	Paths    []Dir
+	Scripts  Scripts
+	Triggers []string
+}
+
+func encodeDependencies(b *Builder, deps []Dependency) Val {
+	vals := make([]Val, 0, len(deps))
+	for _, dep := range deps {
+		// An exact match is implied by the version, so it is not
+		// recorded.
+		match := Null
+		if dep.Match != 0 && (dep.Match != MatchEqual || dep.Version == "") {
+			match = b.Int(dep.Match)
+		}
+		vals = append(vals, b.Object(b.String(dep.Name), b.String(dep.Version), match))
+	}
+
+	return b.Array(vals...)
+}
+
+func encodeACL(b *Builder, acl ACL) Val {
+	return b.Object(b.Int(acl.Mode), b.String(acl.User), b.String(acl.Group))
+}
+
+func (pkg *Package) encode(b *Builder) Val {
+	info := pkg.Info
+	pi := b.Object(
+		b.String(info.Name),
+		b.String(info.Version),
+		b.Blob(info.UniqueID),
+		b.String(info.Description),
+		b.String(info.Arch),
+		b.String(info.License),
+		b.String(info.Origin),
+		b.String(info.Maintainer),
+		b.String(info.URL),
+		b.String(info.RepoCommit),
+		b.Int(info.BuildTime),
+		b.Int(info.InstalledSize),
+		Null,
+		Null,
+		encodeDependencies(b, info.Depends),
+		encodeDependencies(b, info.Provides),
+		encodeDependencies(b, info.Replaces),
+		encodeDependencies(b, info.InstallIf),
+	)
+
+	dirs := make([]Val, 0, len(pkg.Paths))
+	for _, dir := range pkg.Paths {
+		files := make([]Val, 0, len(dir.Files))
+		for _, f := range dir.Files {
+			files = append(files, b.Object(
+				b.String(f.Name),
+				encodeACL(b, f.ACL),
+				b.Int(f.Size),
+				b.Int(f.MTime),
+				b.Blob(f.Hash),
+				b.Blob(f.Target),
+			))
+		}
+
+		dirs = append(dirs, b.Object(b.String(dir.Name), encodeACL(b, dir.ACL), b.Array(files...)))
+	}
+
+	s := pkg.Scripts
+	scripts := b.Object(
+		b.String(s.Trigger),
+		b.String(s.PreInstall),
+		b.String(s.PostInstall),
+		b.String(s.PreDeinstall),
+		b.String(s.PostDeinstall),
+		b.String(s.PreUpgrade),
+		b.String(s.PostUpgrade),
+	)
+
+	triggers := make([]Val, 0, len(pkg.Triggers))
+	for _, t := range pkg.Triggers {
+		triggers = append(triggers, b.String(t))
+	}
+
+	return b.Object(pi, b.Array(dirs...), scripts, b.Array(triggers...))
+}
+
+// WritePackage writes pkg to w as a compressed adb package, with a
+// signature made with each of signers.  The contents of the regular
+// files of pkg, whose size and hash must be set, are read from the
+// readers open returns for their paths.  The unique identifier of the
+// package is computed from its metadata and recorded in pkg.
+func WritePackage(w io.Writer, pkg *Package, open func(path string) (io.ReadCloser, error), signers ...crypto.Signer) error {
+	// The unique identifier is the SHA256 digest of the database with
+	// the identifier zeroed.
+	encoded := *pkg
+	encoded.Info.UniqueID = make([]byte, sha256.Size)
+
+	b := NewBuilder()
+	db, err := b.Finish(encoded.encode(b))
+	if err != nil {
+		return fmt.Errorf("unable to encode package metadata: %w", err)
+	}
+
+	uid, err := uniqueID(db)
+	if err != nil {
+		return err
+	}
+	digest := sha256.Sum256(db)
+	copy(uid, digest[:])
+	pkg.Info.UniqueID = append([]byte{}, uid...)
+
+	aw, err := NewWriter(w, SchemaPackage, true)
+	if err != nil {
+		return err
+	}
+
+	if err := aw.WriteBlock(BlockADB, db); err != nil {
+		return fmt.Errorf("unable to write ADB block: %w", err)
+	}
+
+	for _, signer := range signers {
+		sig, err := Signature(SchemaPackage, db, signer)
+		if err != nil {
+			return fmt.Errorf("unable to sign package: %w", err)
+		}
+		if err := aw.WriteBlock(BlockSig, sig); err != nil {
+			return fmt.Errorf("unable to write signature block: %w", err)
+		}
+	}
+
+	for i, dir := range pkg.Paths {
+		for j, f := range dir.Files {
+			if !f.hasData() {
+				continue
+			}
+
+			if err := writeDataBlock(aw, i+1, j+1, f.Size, path.Join(dir.Name, f.Name), open); err != nil {
+				return err
+			}
+		}
+	}
+
+	return aw.Close()
+}
+
+// uniqueID returns the unique identifier blob of an encoded package, so
+// that it can be filled in place.
+func uniqueID(data []byte) ([]byte, error) {
+	db, err := NewDB(data)
+	if err != nil {
+		return nil, err
+	}
+
+	root, err := db.Object(db.Root())
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := db.Object(Field(root, pkgInfo))
+	if err != nil {
+		return nil, err
+	}
+
+	return db.Blob(Field(info, piUniqueID))
+}
+
+// writeDataBlock writes the data block holding the contents of file
+// fileIdx of directory pathIdx, both starting from 1.
+func writeDataBlock(aw *Writer, pathIdx, fileIdx int, size uint64, name string, open func(string) (io.ReadCloser, error)) error {
+	r, err := open(name)
+	if err != nil {
+		return fmt.Errorf("unable to open %s: %w", name, err)
+	}
+	defer r.Close()
+
+	hdr := make([]byte, 8)
+	binary.LittleEndian.PutUint32(hdr, uint32(pathIdx))
+	binary.LittleEndian.PutUint32(hdr[4:], uint32(fileIdx))
+
+	if err := aw.WriteBlockFrom(BlockData, uint64(len(hdr))+size, io.MultiReader(bytes.NewReader(hdr), r)); err != nil {
+		return fmt.Errorf("unable to write data block of %s: %w", name, err)
+	}
+
+	return nil
+}
+
+// decoder decodes values, keeping the first error.
+type decoder struct {
+	db  *DB
+	err error
+}
+
+func (d *decoder) object(v Val) []Val {
+	if d.err != nil {
+		return nil
+	}
+	obj, err := d.db.Object(v)
+	d.err = err
+	return obj
+}
+
+func (d *decoder) array(v Val) []Val {
+	if d.err != nil {
+		return nil
+	}
+	items, err := d.db.Array(v)
+	d.err = err
+	return items
+}
+
+func (d *decoder) blob(v Val) []byte {
+	if d.err != nil {
+		return nil
+	}
+	data, err := d.db.Blob(v)
+	d.err = err
+	if len(data) == 0 {
+		return nil
+	}
+	return append([]byte{}, data...)
+}
+
+func (d *decoder) str(v Val) string {
+	return string(d.blob(v))
+}
+
+func (d *decoder) int(v Val) uint64 {
+	if d.err != nil {
+		return 0
+	}
+	n, err := d.db.Int(v)
+	d.err = err
+	return n
+}
+
+func (d *decoder) dependencies(v Val) []Dependency {
+	var deps []Dependency
+	for _, item := range d.array(v) {
+		obj := d.object(item)
+		dep := Dependency{
+			Name:    d.str(Field(obj, depName)),
+			Version: d.str(Field(obj, depVersion)),
+			Match:   d.int(Field(obj, depMatch)),
+		}
+		if dep.Version != "" && dep.Match == 0 {
+			dep.Match = MatchEqual
+		}
+		deps = append(deps, dep)
+	}
+
+	return deps
+}
+
+func (d *decoder) acl(v Val) ACL {
+	obj := d.object(v)
+	return ACL{
+		Mode:  d.int(Field(obj, aclMode)),
+		User:  d.str(Field(obj, aclUser)),
+		Group: d.str(Field(obj, aclGroup)),
+	}
+}
+
+// DecodePackage decodes the package metadata held by db.
+func DecodePackage(db *DB) (*Package, error) {
+	d := &decoder{db: db}
+	root := d.object(db.Root())
+
+	pi := d.object(Field(root, pkgInfo))
+	pkg := &Package{
+		Info: PackageInfo{
+			Name:          d.str(Field(pi, piName)),
+			Version:       d.str(Field(pi, piVersion)),
+			UniqueID:      d.blob(Field(pi, piUniqueID)),
+			Description:   d.str(Field(pi, piDescription)),
+			Arch:          d.str(Field(pi, piArch)),
+			License:       d.str(Field(pi, piLicense)),
+			Origin:        d.str(Field(pi, piOrigin)),
+			Maintainer:    d.str(Field(pi, piMaintainer)),
+			URL:           d.str(Field(pi, piURL)),
+			RepoCommit:    d.str(Field(pi, piRepoCommit)),
+			BuildTime:     d.int(Field(pi, piBuildTime)),
+			InstalledSize: d.int(Field(pi, piInstalledSize)),
+			Depends:       d.dependencies(Field(pi, piDepends)),
+			Provides:      d.dependencies(Field(pi, piProvides)),
+			Replaces:      d.dependencies(Field(pi, piReplaces)),
+			InstallIf:     d.dependencies(Field(pi, piInstallIf)),
+		},
+	}
+
+	for _, dv := range d.array(Field(root, pkgPaths)) {
+		obj := d.object(dv)
+		dir := Dir{
+			Name: d.str(Field(obj, dirName)),
+			ACL:  d.acl(Field(obj, dirACL)),
+		}
+
+		for _, fv := range d.array(Field(obj, dirFiles)) {
+			fobj := d.object(fv)
+			dir.Files = append(dir.Files, Entry{
+				Name:   d.str(Field(fobj, fileName)),
+				ACL:    d.acl(Field(fobj, fileACL)),
+				Size:   d.int(Field(fobj, fileSize)),
+				MTime:  d.int(Field(fobj, fileMTime)),
+				Hash:   d.blob(Field(fobj, fileHashes)),
+				Target: d.blob(Field(fobj, fileTarget)),
+			})
+		}
+
+		pkg.Paths = append(pkg.Paths, dir)
+	}
+
+	scripts := d.object(Field(root, pkgScripts))
+	pkg.Scripts = Scripts{
+		Trigger:       d.str(Field(scripts, scriptTrigger)),
+		PreInstall:    d.str(Field(scripts, scriptPreInstall)),
+		PostInstall:   d.str(Field(scripts, scriptPostInstall)),
+		PreDeinstall:  d.str(Field(scripts, scriptPreDeinstall)),
+		PostDeinstall: d.str(Field(scripts, scriptPostDeinstall)),
+		PreUpgrade:    d.str(Field(scripts, scriptPreUpgrade)),
+		PostUpgrade:   d.str(Field(scripts, scriptPostUpgrade)),
+	}
+
+	for _, tv := range d.array(Field(root, pkgTriggers)) {
+		pkg.Triggers = append(pkg.Triggers, d.str(tv))
+	}
+
+	if d.err != nil {
+		return nil, fmt.Errorf("unable to decode package metadata: %w", d.err)
+	}
+
+	return pkg, nil
+}
+
+// PackageFile is a package read by ReadPackage.
+type PackageFile struct {
+	*File
+	Package *Package
+
+	// Data holds the contents of the regular files of the package, by
+	// path.
+	Data map[string][]byte
+}
+
+// ReadPackage reads a package from r and checks the contents of each of
+// its regular files against the size and hash recorded in its metadata.
+// Signatures are not verified; use Verify for that.
+func ReadPackage(r io.Reader) (*PackageFile, error) {
+	f, err := ReadFile(r)
+	if err != nil {
+		return nil, err
+	}
+	if f.Schema != SchemaPackage {
+		return nil, fmt.Errorf("file is not a package, its schema is %#x", f.Schema)
+	}
+
+	db, err := f.DB()
+	if err != nil {
+		return nil, err
+	}
+
+	pkg, err := DecodePackage(db)
+	if err != nil {
+		return nil, err
+	}
+
+	pf := &PackageFile{File: f, Package: pkg, Data: map[string][]byte{}}
+	for _, b := range f.Blocks {
+		if b.Type != BlockData {
+			continue
+		}
+		if len(b.Data) < 8 {
+			return nil, fmt.Errorf("data block is truncated")
+		}
+
+		pathIdx := int(binary.LittleEndian.Uint32(b.Data))
+		fileIdx := int(binary.LittleEndian.Uint32(b.Data[4:]))
+		if pathIdx < 1 || pathIdx > len(pkg.Paths) || fileIdx < 1 || fileIdx > len(pkg.Paths[pathIdx-1].Files) {
+			return nil, fmt.Errorf("data block refers to unknown file %d/%d", pathIdx, fileIdx)
+		}
+
+		dir := pkg.Paths[pathIdx-1]
+		pf.Data[path.Join(dir.Name, dir.Files[fileIdx-1].Name)] = b.Data[8:]
+	}
+
+	for _, dir := range pkg.Paths {
+		for _, file := range dir.Files {
+			if !file.hasData() {
+				continue
+			}
+
+			name := path.Join(dir.Name, file.Name)
+			data, ok := pf.Data[name]
+			if !ok {
+				return nil, fmt.Errorf("%s has no data block", name)
+			}
+
+			digest := sha256.Sum256(data)
+			if uint64(len(data)) != file.Size || !bytes.Equal(digest[:], file.Hash) {
+				return nil, fmt.Errorf("contents of %s do not match its size or hash", name)
+			}
+		}
+	}
+
+	return pf, nil
+}
@@ -0,0 +1,132 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package adb
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// ErrUnsigned is returned by Verify when a file has no signature made
+// with the given key.
+var ErrUnsigned = errors.New("file is not signed with the key")
+
+const (
+	signVersion = 0
+
+	// hashSHA512 is the apk identifier of the SHA512 digest.
+	hashSHA512 = 4
+
+	keyIDSize = 16
+
+	// sigHdrSize is the size of a version 0 signature header: the
+	// version, the digest algorithm and the key identifier.
+	sigHdrSize = 2 + keyIDSize
+)
+
+// KeyID returns the identifier of pub recorded in signatures: the first
+// 16 bytes of the SHA512 digest of its PKIX form.
+func KeyID(pub crypto.PublicKey) ([]byte, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil, fmt.Errorf("marshal PKIX public key: %w", err)
+	}
+
+	digest := sha512.Sum512(der)
+	return digest[:keyIDSize], nil
+}
+
+// signedDigest returns the digest a signature with the header sigHdr is
+// made over: the SHA512 digest of the schema, the header and the SHA512
+// digest of the database.
+func signedDigest(schema uint32, sigHdr, db []byte) []byte {
+	dbDigest := sha512.Sum512(db)
+
+	h := sha512.New()
+	binary.Write(h, binary.LittleEndian, schema) // nolint:errcheck
+	h.Write(sigHdr)
+	h.Write(dbDigest[:])
+	return h.Sum(nil)
+}
+
+// Signature returns the payload of a signature block over db, made with
+// signer.
+func Signature(schema uint32, db []byte, signer crypto.Signer) ([]byte, error) {
+	id, err := KeyID(signer.Public())
+	if err != nil {
+		return nil, err
+	}
+
+	hdr := append([]byte{signVersion, hashSHA512}, id...)
+	sig, err := signer.Sign(rand.Reader, signedDigest(schema, hdr, db), crypto.SHA512)
+	if err != nil {
+		return nil, fmt.Errorf("signing: %w", err)
+	}
+
+	return append(hdr, sig...), nil
+}
+
+// Verify checks that f has a valid signature made with pub.
+func (f *File) Verify(pub crypto.PublicKey) error {
+	if len(f.Blocks) == 0 || f.Blocks[0].Type != BlockADB {
+		return fmt.Errorf("file does not start with an ADB block")
+	}
+
+	id, err := KeyID(pub)
+	if err != nil {
+		return err
+	}
+
+	for _, b := range f.Blocks[1:] {
+		if b.Type != BlockSig {
+			continue
+		}
+
+		if len(b.Data) < sigHdrSize || b.Data[0] != signVersion || !bytes.Equal(b.Data[2:sigHdrSize], id) {
+			continue
+		}
+		if b.Data[1] != hashSHA512 {
+			return fmt.Errorf("unsupported signature digest %d", b.Data[1])
+		}
+
+		digest := signedDigest(f.Schema, b.Data[:sigHdrSize], f.Blocks[0].Data)
+		sig := b.Data[sigHdrSize:]
+
+		switch k := pub.(type) {
+		case *rsa.PublicKey:
+			if err := rsa.VerifyPKCS1v15(k, crypto.SHA512, digest, sig); err != nil {
+				return fmt.Errorf("verify PKCS1v15 signature: %w", err)
+			}
+		case *ecdsa.PublicKey:
+			if !ecdsa.VerifyASN1(k, digest, sig) {
+				return fmt.Errorf("verify ECDSA signature: invalid signature")
+			}
+		default:
+			return fmt.Errorf("unsupported public key type %T", pub)
+		}
+
+		return nil
+	}
+
+	return ErrUnsigned
+}
@@ -0,0 +1,120 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sign
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1" // nolint:gosec
+	"fmt"
+	"path/filepath"
+
+	"chainguard.dev/apko/pkg/tarball"
+	"github.com/psanford/memfs"
+)
+
+// RSASignatureName returns the name of the signature entry created for
+// signatures made with keyFile.
+func RSASignatureName(keyFile string) string {
+	return fmt.Sprintf(".SIGN.RSA.%s.pub", filepath.Base(keyFile))
+}
+
+// Signature is an entry of the signature section of an archive.
+type Signature struct {
+	Name string
+	Data []byte
+}
+
+// SignIndex signs an APKINDEX.tar.gz archive with the RSA key in keyFile
+// and returns the signed archive, which is the signature section
+// followed by the unmodified index data.
+func SignIndex(indexData []byte, keyFile, passphrase string) ([]byte, error) {
+	sig, err := IndexSignature(indexData, keyFile, passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	sigData, err := SignatureSection([]Signature{sig})
+	if err != nil {
+		return nil, err
+	}
+
+	return append(sigData, indexData...), nil
+}
+
+// IndexSignature returns the signature of unsigned index data made with
+// the RSA key in keyFile.
+func IndexSignature(indexData []byte, keyFile, passphrase string) (Signature, error) {
+	digest := sha1.Sum(indexData) // nolint:gosec
+
+	sigData, err := RSASignSHA1Digest(digest[:], keyFile, passphrase)
+	if err != nil {
+		return Signature{}, fmt.Errorf("unable to sign index: %w", err)
+	}
+
+	return Signature{Name: RSASignatureName(keyFile), Data: sigData}, nil
+}
+
+// SignatureSection returns a signature section holding sigs, which is
+// an unterminated gzip compressed tarball.
+func SignatureSection(sigs []Signature) ([]byte, error) {
+	sigFS := memfs.New()
+	for _, sig := range sigs {
+		if err := sigFS.WriteFile(sig.Name, sig.Data, 0644); err != nil {
+			return nil, fmt.Errorf("unable to append signature: %w", err)
+		}
+	}
+
+	multitarctx, err := tarball.NewContext(
+		tarball.WithOverrideUIDGID(0, 0),
+		tarball.WithOverrideUname("root"),
+		tarball.WithOverrideGname("root"),
+		tarball.WithSkipClose(true),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("unable to build tarball context: %w", err)
+	}
+
+	var section bytes.Buffer
+	if err := multitarctx.WriteArchive(&section, sigFS); err != nil {
+		return nil, fmt.Errorf("unable to write signature tarball: %w", err)
+	}
+
+	return section.Bytes(), nil
+}
+
+// SplitSignatures returns the signatures of an archive, in the order
+// they appear in its signature section, and the data which follows the
+// signature section.  An archive without a signature section has no
+// signatures and is returned whole.
+func SplitSignatures(data []byte) ([]Signature, []byte, error) {
+	sr := &sectionReader{r: bufio.NewReader(bytes.NewReader(data))}
+
+	first, err := sr.readSection()
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to read archive: %w", err)
+	}
+
+	if !first.isSignature() {
+		return nil, data, nil
+	}
+
+	sigs := make([]Signature, 0, len(first.names))
+	for _, name := range first.names {
+		sigs = append(sigs, Signature{Name: name, Data: first.files[name]})
+	}
+
+	return sigs, data[sr.offset:], nil
+}
@@ -0,0 +1,61 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sign
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSplitSignatures(t *testing.T) {
+	dir := t.TempDir()
+	oldKey := testKey(t, dir, "old.rsa")
+	newKey := testKey(t, dir, "new.rsa")
+
+	indexData := testTarGz(t, true, map[string]string{
+		"DESCRIPTION": "test",
+		"APKINDEX":    "P:hello\nV:1.0-r0\n",
+	})
+
+	sigs, data, err := SplitSignatures(indexData)
+	require.NoError(t, err)
+	require.Empty(t, sigs)
+	require.Equal(t, indexData, data)
+
+	signed, err := SignIndex(indexData, oldKey, "")
+	require.NoError(t, err)
+
+	sigs, data, err = SplitSignatures(signed)
+	require.NoError(t, err)
+	require.Equal(t, indexData, data)
+	require.Len(t, sigs, 1)
+	require.Equal(t, ".SIGN.RSA.old.rsa.pub", sigs[0].Name)
+
+	// An index with both signatures verifies with either key.
+	sig, err := IndexSignature(data, newKey, "")
+	require.NoError(t, err)
+
+	section, err := SignatureSection(append(sigs, sig))
+	require.NoError(t, err)
+	both := append(section, data...)
+
+	for _, key := range []string{oldKey, newKey} {
+		v, err := Verify(bytes.NewReader(both), []string{key + ".pub"}, nil)
+		require.NoError(t, err)
+		require.Equal(t, key+".pub", v.Key)
+	}
+}
@@ -0,0 +1,306 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sign
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// CertificateSignatureName is the name of the signature entry made by
+// KeylessSigner.
+const CertificateSignatureName = ".SIGN.X509.pem"
+
+// CertificateAuthority issues certificates for ephemeral keys.
+type CertificateAuthority interface {
+	// IssueCertificate returns the certificate chain of the public key
+	// of key, starting with the certificate issued for it.  key is
+	// used to prove its possession.
+	IssueCertificate(key crypto.Signer) ([]*x509.Certificate, error)
+}
+
+// KeylessSigner signs with an ephemeral ECDSA key, certified by a
+// certificate authority.  The signature entry holds the signature and
+// the certificate chain, so that no key has to be distributed to verify
+// it.  The key and its certificate are created on first use, and used
+// for every following signature.
+type KeylessSigner struct {
+	CA CertificateAuthority
+
+	once  sync.Once
+	key   *ecdsa.PrivateKey
+	chain []*x509.Certificate
+	err   error
+}
+
+// NewKeylessSigner returns a signer certified by ca.
+func NewKeylessSigner(ca CertificateAuthority) *KeylessSigner {
+	return &KeylessSigner{CA: ca}
+}
+
+func (s *KeylessSigner) SignatureName() string {
+	return CertificateSignatureName
+}
+
+func (s *KeylessSigner) Hash() crypto.Hash {
+	return crypto.SHA256
+}
+
+func (s *KeylessSigner) Sign(digest []byte) ([]byte, error) {
+	s.once.Do(func() {
+		s.key, s.err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if s.err != nil {
+			return
+		}
+		s.chain, s.err = s.CA.IssueCertificate(s.key)
+	})
+	if s.err != nil {
+		return nil, fmt.Errorf("unable to obtain signing certificate: %w", s.err)
+	}
+
+	sig, err := ecdsa.SignASN1(rand.Reader, s.key, digest)
+	if err != nil {
+		return nil, fmt.Errorf("signing: %w", err)
+	}
+
+	var buf bytes.Buffer
+	if err := pem.Encode(&buf, &pem.Block{Type: "SIGNATURE", Bytes: sig}); err != nil {
+		return nil, err
+	}
+	for _, cert := range s.chain {
+		if err := pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}); err != nil {
+			return nil, err
+		}
+	}
+
+	return buf.Bytes(), nil
+}
+
+// VerifyCertificateSignature verifies the contents of a signature entry
+// made by KeylessSigner over digest, whose certificate chain must lead to
+// one of roots, and returns the certificate of the signing key.  As the
+// certificates are short lived, the chain is verified at the time the
+// signing certificate was issued.
+func VerifyCertificateSignature(digest, data []byte, roots *x509.CertPool) (*x509.Certificate, error) {
+	var sig []byte
+	var certs []*x509.Certificate
+
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+
+		switch block.Type {
+		case "SIGNATURE":
+			sig = block.Bytes
+		case "CERTIFICATE":
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("parse certificate: %w", err)
+			}
+			certs = append(certs, cert)
+		}
+	}
+
+	if sig == nil || len(certs) == 0 {
+		return nil, fmt.Errorf("signature entry lacks a signature or a certificate")
+	}
+
+	leaf := certs[0]
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	if _, err := leaf.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		CurrentTime:   leaf.NotBefore,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+	}); err != nil {
+		return nil, fmt.Errorf("verify certificate chain: %w", err)
+	}
+
+	pub, ok := leaf.PublicKey.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("certificate key is not an ECDSA key")
+	}
+
+	if !ecdsa.VerifyASN1(pub, digest, sig) {
+		return nil, fmt.Errorf("verify ECDSA signature: invalid signature")
+	}
+
+	return leaf, nil
+}
+
+// FulcioCA issues certificates with the signingCert API of Fulcio, for
+// the identity of an OIDC identity token.
+type FulcioCA struct {
+	URL           string
+	IdentityToken string
+	Client        *http.Client
+}
+
+type fulcioRequest struct {
+	Credentials struct {
+		OIDCIdentityToken string `json:"oidcIdentityToken"`
+	} `json:"credentials"`
+	PublicKeyRequest struct {
+		PublicKey struct {
+			Algorithm string `json:"algorithm"`
+			Content   string `json:"content"`
+		} `json:"publicKey"`
+		ProofOfPossession []byte `json:"proofOfPossession"`
+	} `json:"publicKeyRequest"`
+}
+
+type fulcioChain struct {
+	Chain struct {
+		Certificates []string `json:"certificates"`
+	} `json:"chain"`
+}
+
+type fulcioResponse struct {
+	SignedCertificateEmbeddedSct *fulcioChain `json:"signedCertificateEmbeddedSct"`
+	SignedCertificateDetachedSct *fulcioChain `json:"signedCertificateDetachedSct"`
+}
+
+func (ca *FulcioCA) IssueCertificate(key crypto.Signer) ([]*x509.Certificate, error) {
+	subject, err := tokenSubject(ca.IdentityToken)
+	if err != nil {
+		return nil, err
+	}
+
+	// The possession of the key is proven by signing the subject of the
+	// identity token.
+	digest := sha256.Sum256([]byte(subject))
+	proof, err := key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		return nil, fmt.Errorf("signing proof of possession: %w", err)
+	}
+
+	pub, err := EncodePublicKey(key.Public())
+	if err != nil {
+		return nil, err
+	}
+
+	var req fulcioRequest
+	req.Credentials.OIDCIdentityToken = ca.IdentityToken
+	req.PublicKeyRequest.PublicKey.Algorithm = "ECDSA"
+	req.PublicKeyRequest.PublicKey.Content = string(pub)
+	req.PublicKeyRequest.ProofOfPossession = proof
+
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	httpReq, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(ca.URL, "/")+"/api/v2/signingCert", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("Authorization", "Bearer "+ca.IdentityToken)
+
+	client := ca.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	resp, err := client.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("requesting certificate: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("requesting certificate: %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	var certResp fulcioResponse
+	if err := json.NewDecoder(resp.Body).Decode(&certResp); err != nil {
+		return nil, fmt.Errorf("decoding certificate response: %w", err)
+	}
+
+	chain := certResp.SignedCertificateEmbeddedSct
+	if chain == nil {
+		chain = certResp.SignedCertificateDetachedSct
+	}
+	if chain == nil || len(chain.Chain.Certificates) == 0 {
+		return nil, fmt.Errorf("certificate response holds no certificate")
+	}
+
+	certs := []*x509.Certificate{}
+	for _, data := range chain.Chain.Certificates {
+		block, _ := pem.Decode([]byte(data))
+		if block == nil {
+			return nil, errNoPemBlock
+		}
+
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("parse certificate: %w", err)
+		}
+		certs = append(certs, cert)
+	}
+
+	return certs, nil
+}
+
+// tokenSubject returns the identity an OIDC identity token is issued
+// for: its email claim if it has one, its subject otherwise.
+func tokenSubject(token string) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", fmt.Errorf("identity token is not a JWT")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", fmt.Errorf("decoding identity token: %w", err)
+	}
+
+	var claims struct {
+		Subject string `json:"sub"`
+		Email   string `json:"email"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return "", fmt.Errorf("decoding identity token: %w", err)
+	}
+
+	if claims.Email != "" {
+		return claims.Email, nil
+	}
+	if claims.Subject == "" {
+		return "", fmt.Errorf("identity token has no subject")
+	}
+	return claims.Subject, nil
+}
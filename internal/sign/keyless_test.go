@@ -0,0 +1,138 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sign
+
+import (
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"chainguard.dev/melange/internal/sign/signtest"
+	"github.com/stretchr/testify/require"
+)
+
+// testCA serves the signingCert API of Fulcio, issuing a certificate for
+// the identity of any token it is given.
+type testCA struct {
+	*signtest.CA
+	requests int
+}
+
+func newTestCA(t *testing.T) *testCA {
+	return &testCA{CA: signtest.NewCA(t)}
+}
+
+func (ca *testCA) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/api/v2/signingCert" {
+		http.NotFound(w, r)
+		return
+	}
+	ca.requests++
+
+	var req fulcioRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	subject, err := tokenSubject(req.Credentials.OIDCIdentityToken)
+	if err != nil || r.Header.Get("Authorization") != "Bearer "+req.Credentials.OIDCIdentityToken {
+		http.Error(w, "invalid identity token", http.StatusUnauthorized)
+		return
+	}
+
+	block, _ := pem.Decode([]byte(req.PublicKeyRequest.PublicKey.Content))
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	digest := sha256.Sum256([]byte(subject))
+	if !ecdsa.VerifyASN1(pub.(*ecdsa.PublicKey), digest[:], req.PublicKeyRequest.ProofOfPossession) {
+		http.Error(w, "invalid proof of possession", http.StatusBadRequest)
+		return
+	}
+
+	chain, err := ca.Certify(pub, subject)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var resp fulcioResponse
+	resp.SignedCertificateEmbeddedSct = &fulcioChain{}
+	for _, cert := range chain {
+		resp.SignedCertificateEmbeddedSct.Chain.Certificates = append(resp.SignedCertificateEmbeddedSct.Chain.Certificates,
+			string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})))
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(resp) // nolint:errcheck
+}
+
+func testToken(claims string) string {
+	enc := base64.RawURLEncoding
+	return enc.EncodeToString([]byte(`{"alg":"none"}`)) + "." + enc.EncodeToString([]byte(claims)) + "."
+}
+
+func TestKeylessSigner(t *testing.T) {
+	ca := newTestCA(t)
+	srv := httptest.NewServer(ca)
+	defer srv.Close()
+
+	signer := NewKeylessSigner(&FulcioCA{URL: srv.URL, IdentityToken: testToken(`{"sub":"1234","email":"builder@example.com"}`)})
+	require.Equal(t, CertificateSignatureName, signer.SignatureName())
+
+	digest := sha256.Sum256([]byte("control"))
+	sig, err := signer.Sign(digest[:])
+	require.NoError(t, err)
+
+	cert, err := VerifyCertificateSignature(digest[:], sig, ca.Roots())
+	require.NoError(t, err)
+	require.Equal(t, []string{"builder@example.com"}, cert.EmailAddresses)
+
+	// The certificate is reused for following signatures.
+	other := sha256.Sum256([]byte("other control"))
+	sig, err = signer.Sign(other[:])
+	require.NoError(t, err)
+	require.Equal(t, 1, ca.requests)
+
+	_, err = VerifyCertificateSignature(digest[:], sig, ca.Roots())
+	require.ErrorContains(t, err, "invalid signature")
+
+	_, err = VerifyCertificateSignature(other[:], sig, newTestCA(t).Roots())
+	require.ErrorContains(t, err, "verify certificate chain")
+}
+
+func TestKeylessSignerRejected(t *testing.T) {
+	srv := httptest.NewServer(newTestCA(t))
+	defer srv.Close()
+
+	signer := NewKeylessSigner(&FulcioCA{URL: srv.URL, IdentityToken: testToken(`{}`)})
+	digest := sha256.Sum256([]byte("control"))
+	_, err := signer.Sign(digest[:])
+	require.ErrorContains(t, err, "identity token has no subject")
+
+	signer = NewKeylessSigner(&FulcioCA{URL: srv.URL + "/nowhere", IdentityToken: testToken(`{"sub":"1234"}`)})
+	_, err = signer.Sign(digest[:])
+	require.ErrorContains(t, err, "404 Not Found")
+}
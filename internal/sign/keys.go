@@ -0,0 +1,89 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sign
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+)
+
+// EncodePrivateKey returns the PEM encoding of key, encrypted with
+// passphrase unless it is empty.  RSA keys are encoded as PKCS#1, which
+// is what RSASignSHA1Digest expects, ECDSA keys as SEC 1 and Ed25519
+// keys as PKCS#8.
+func EncodePrivateKey(key crypto.Signer, passphrase string) ([]byte, error) {
+	var block *pem.Block
+
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		block = &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(k)}
+	case *ecdsa.PrivateKey:
+		der, err := x509.MarshalECPrivateKey(k)
+		if err != nil {
+			return nil, fmt.Errorf("marshal EC private key: %w", err)
+		}
+		block = &pem.Block{Type: "EC PRIVATE KEY", Bytes: der}
+	case ed25519.PrivateKey:
+		der, err := x509.MarshalPKCS8PrivateKey(k)
+		if err != nil {
+			return nil, fmt.Errorf("marshal PKCS8 private key: %w", err)
+		}
+		block = &pem.Block{Type: "PRIVATE KEY", Bytes: der}
+	default:
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+
+	if passphrase != "" {
+		// This is the encryption RSASignSHA1Digest, as well as
+		// openssl, knows how to decrypt.
+		encrypted, err := x509.EncryptPEMBlock(rand.Reader, block.Type, block.Bytes, []byte(passphrase), x509.PEMCipherAES256) //nolint:staticcheck
+		if err != nil {
+			return nil, fmt.Errorf("encrypt private key PEM block: %w", err)
+		}
+		block = encrypted
+	}
+
+	return pem.EncodeToMemory(block), nil
+}
+
+// EncodePublicKey returns the PEM encoding of the PKIX form of pub.
+func EncodePublicKey(pub crypto.PublicKey) ([]byte, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil, fmt.Errorf("marshal PKIX public key: %w", err)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), nil
+}
+
+// Fingerprint returns the SHA256 digest of the PKIX form of pub, in the
+// form sha256:<hex>.
+func Fingerprint(pub crypto.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return "", fmt.Errorf("marshal PKIX public key: %w", err)
+	}
+
+	digest := sha256.Sum256(der)
+	return "sha256:" + hex.EncodeToString(digest[:]), nil
+}
@@ -0,0 +1,54 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sign
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1" // nolint:gosec
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncryptedPrivateKey(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "test.rsa")
+
+	data, err := EncodePrivateKey(key, "secret")
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(keyFile, data, 0600))
+
+	pubData, err := EncodePublicKey(&key.PublicKey)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(keyFile+".pub", pubData, 0644))
+
+	digest := sha1.Sum([]byte("hello")) // nolint:gosec
+
+	_, err = RSASignSHA1Digest(digest[:], keyFile, "")
+	require.ErrorIs(t, err, errNoPassphrase)
+
+	_, err = RSASignSHA1Digest(digest[:], keyFile, "wrong")
+	require.Error(t, err)
+
+	sig, err := RSASignSHA1Digest(digest[:], keyFile, "secret")
+	require.NoError(t, err)
+	require.NoError(t, RSAVerifySHA1Digest(digest[:], sig, keyFile+".pub"))
+}
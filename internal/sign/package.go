@@ -0,0 +1,86 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sign
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1" // nolint:gosec
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ErrAlreadySigned is returned by SignPackage when the package is already
+// signed and its signatures should not be replaced.
+var ErrAlreadySigned = errors.New("package is already signed")
+
+// SignPackage reads a built package from r and writes it to w signed
+// with the RSA key in keyFile.  The signature is made over the SHA1
+// digest of the raw control section, as for packages signed while they
+// are built.  Existing signatures are only replaced if replace is set.
+func SignPackage(r io.Reader, w io.Writer, keyFile, passphrase string, replace bool) error {
+	sr := &sectionReader{r: bufio.NewReader(r)}
+	if err := sr.checkFormat(); err != nil {
+		return err
+	}
+
+	var control bytes.Buffer
+	sr.tee = &control
+	first, err := sr.readSection()
+	if err != nil {
+		return fmt.Errorf("unable to read package: %w", err)
+	}
+
+	if first.isSignature() {
+		if !replace {
+			return ErrAlreadySigned
+		}
+
+		control.Reset()
+		first, err = sr.readSection()
+		if err != nil {
+			return fmt.Errorf("unable to read control section: %w", err)
+		}
+	}
+	sr.tee = nil
+
+	if _, ok := first.files[".PKGINFO"]; !ok {
+		return fmt.Errorf("control section has no .PKGINFO, not a package")
+	}
+
+	digest := sha1.Sum(control.Bytes()) // nolint:gosec
+	sigData, err := RSASignSHA1Digest(digest[:], keyFile, passphrase)
+	if err != nil {
+		return fmt.Errorf("unable to generate signature: %w", err)
+	}
+
+	section, err := SignatureSection([]Signature{{Name: RSASignatureName(keyFile), Data: sigData}})
+	if err != nil {
+		return err
+	}
+
+	for _, part := range [][]byte{section, control.Bytes()} {
+		if _, err := w.Write(part); err != nil {
+			return err
+		}
+	}
+
+	if _, err := io.Copy(w, sr); err != nil {
+		return fmt.Errorf("unable to copy data section: %w", err)
+	}
+
+	return nil
+}
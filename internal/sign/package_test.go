@@ -0,0 +1,55 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sign
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSignPackage(t *testing.T) {
+	dir := t.TempDir()
+	oldKey := testKey(t, dir, "old.rsa")
+	newKey := testKey(t, dir, "new.rsa")
+	data := testTarGz(t, true, map[string]string{"usr/bin/hello": "hello"})
+
+	var signed bytes.Buffer
+	require.NoError(t, SignPackage(bytes.NewReader(testPackage(t, "", data)), &signed, oldKey, "", false))
+
+	v, err := Verify(bytes.NewReader(signed.Bytes()), []string{oldKey + ".pub"}, nil)
+	require.NoError(t, err)
+	require.Equal(t, KindPackage, v.Kind)
+
+	err = SignPackage(bytes.NewReader(signed.Bytes()), &bytes.Buffer{}, newKey, "", false)
+	require.ErrorIs(t, err, ErrAlreadySigned)
+
+	var resigned bytes.Buffer
+	require.NoError(t, SignPackage(bytes.NewReader(signed.Bytes()), &resigned, newKey, "", true))
+
+	_, err = Verify(bytes.NewReader(resigned.Bytes()), []string{newKey + ".pub"}, nil)
+	require.NoError(t, err)
+
+	_, err = Verify(bytes.NewReader(resigned.Bytes()), []string{oldKey + ".pub"}, nil)
+	require.ErrorIs(t, err, ErrUntrusted)
+}
+
+func TestSignPackageV3(t *testing.T) {
+	keyFile := testKey(t, t.TempDir(), "melange.rsa")
+
+	err := SignPackage(bytes.NewReader(testAdbFile(t)), &bytes.Buffer{}, keyFile, "", false)
+	require.ErrorIs(t, err, ErrApkV3)
+}
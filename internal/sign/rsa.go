@@ -28,6 +28,22 @@ func RSASignSHA1Digest(sha1Digest []byte, keyFile, passphrase string) ([]byte, e
 		return nil, errDigestNotSH1
 	}
 
+	priv, err := LoadPrivateKey(keyFile, passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	signature, err := priv.Sign(rand.Reader, sha1Digest, crypto.SHA1)
+	if err != nil {
+		return nil, fmt.Errorf("signing: %w", err)
+	}
+
+	return signature, nil
+}
+
+// LoadPrivateKey reads the PKCS#1 RSA private key in the PEM format from
+// keyFile, decrypting it with passphrase if it is encrypted.
+func LoadPrivateKey(keyFile, passphrase string) (*rsa.PrivateKey, error) {
 	keyFileContent, err := os.ReadFile(keyFile)
 	if err != nil {
 		return nil, fmt.Errorf("reading key file: %w", err)
@@ -59,12 +75,7 @@ func RSASignSHA1Digest(sha1Digest []byte, keyFile, passphrase string) ([]byte, e
 		return nil, fmt.Errorf("parse PKCS1 private key: %w", err)
 	}
 
-	signature, err := priv.Sign(rand.Reader, sha1Digest, crypto.SHA1)
-	if err != nil {
-		return nil, fmt.Errorf("signing: %w", err)
-	}
-
-	return signature, nil
+	return priv, nil
 }
 
 // RSAVerifySHA1Digest is exported for use in tests and verifies a signature over the
@@ -0,0 +1,65 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sign
+
+import (
+	"crypto"
+)
+
+// Signer signs the control section of packages.
+type Signer interface {
+	// SignatureName returns the name of the signature entry in the
+	// signature section.
+	SignatureName() string
+
+	// Hash returns the hash function the digest of the control section
+	// passed to Sign is computed with.
+	Hash() crypto.Hash
+
+	// Sign returns the contents of the signature entry for digest.
+	Sign(digest []byte) ([]byte, error)
+}
+
+// PrivateKeySigner is a Signer whose private key can be used directly,
+// which formats other than the signature section require.
+type PrivateKeySigner interface {
+	Signer
+
+	PrivateKey() (crypto.Signer, error)
+}
+
+// KeySigner signs with an RSA key file, as apk expects.
+type KeySigner struct {
+	KeyFile    string
+	Passphrase string
+}
+
+func (s *KeySigner) SignatureName() string {
+	return RSASignatureName(s.KeyFile)
+}
+
+func (s *KeySigner) Hash() crypto.Hash {
+	return crypto.SHA1
+}
+
+func (s *KeySigner) Sign(digest []byte) ([]byte, error) {
+	return RSASignSHA1Digest(digest, s.KeyFile, s.Passphrase)
+}
+
+// PrivateKey returns the key, for formats which are signed with it
+// directly.
+func (s *KeySigner) PrivateKey() (crypto.Signer, error) {
+	return LoadPrivateKey(s.KeyFile, s.Passphrase)
+}
@@ -0,0 +1,110 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package signtest provides a certificate authority for testing keyless
+// signing.
+package signtest
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// CA is a local stand-in for Fulcio, which issues short lived code
+// signing certificates for an email identity.  It implements
+// sign.CertificateAuthority, issuing certificates for Email.
+type CA struct {
+	Key  *ecdsa.PrivateKey
+	Cert *x509.Certificate
+
+	// Email is the identity certificates are issued for by
+	// IssueCertificate.
+	Email string
+
+	mu     sync.Mutex
+	serial int64
+}
+
+// NewCA returns a certificate authority with a new self-signed root,
+// which issues certificates for builder@example.com.
+func NewCA(t testing.TB) *CA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	return &CA{Key: key, Cert: cert, Email: "builder@example.com", serial: 1}
+}
+
+// Roots returns a pool holding the root of the certificate authority.
+func (ca *CA) Roots() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Cert)
+	return pool
+}
+
+// Certify returns the certificate chain of a certificate issued for pub
+// and the identity email, starting with that certificate.
+func (ca *CA) Certify(pub crypto.PublicKey, email string) ([]*x509.Certificate, error) {
+	ca.mu.Lock()
+	ca.serial++
+	serial := ca.serial
+	ca.mu.Unlock()
+
+	tmpl := &x509.Certificate{
+		SerialNumber:   big.NewInt(serial),
+		NotBefore:      time.Now().Add(-time.Minute),
+		NotAfter:       time.Now().Add(10 * time.Minute),
+		EmailAddresses: []string{email},
+		KeyUsage:       x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.Cert, pub, ca.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	return []*x509.Certificate{cert, ca.Cert}, nil
+}
+
+func (ca *CA) IssueCertificate(key crypto.Signer) ([]*x509.Certificate, error) {
+	return ca.Certify(key.Public(), ca.Email)
+}
@@ -0,0 +1,295 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sign
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"crypto/sha1" // nolint:gosec
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"chainguard.dev/melange/internal/adb"
+)
+
+var (
+	// ErrUnsigned is returned when an archive has no signature.
+	ErrUnsigned = errors.New("archive is not signed")
+
+	// ErrUntrusted is returned when none of the signatures of an
+	// archive were made with a trusted key.
+	ErrUntrusted = errors.New("archive is not signed with a trusted key")
+
+	// ErrApkV3 is returned for archives in the adb based format of
+	// apk-tools 3, which are signed when they are built and cannot be
+	// signed or verified here.
+	ErrApkV3 = errors.New("apk v3 archives are not supported")
+)
+
+// ArchiveKind is the kind of a verified archive.
+type ArchiveKind string
+
+const (
+	KindPackage ArchiveKind = "package"
+	KindIndex   ArchiveKind = "index"
+)
+
+// Verification describes a verified archive.
+type Verification struct {
+	Kind ArchiveKind
+
+	// Key is the path of the trusted key the archive was signed with.
+	Key string
+
+	// Certificate is the certificate of the signing key, when the
+	// archive was signed keylessly.
+	Certificate *x509.Certificate
+}
+
+// sectionReader reads the concatenated gzip streams an archive is made
+// of.  It implements io.ByteReader, so that gzip reads exactly up to the
+// end of each stream, and copies everything it reads to tee, if set,
+// which makes it possible to hash or capture the raw bytes of each
+// section.
+type sectionReader struct {
+	r      *bufio.Reader
+	tee    io.Writer
+	offset int64
+}
+
+func (sr *sectionReader) Read(p []byte) (int, error) {
+	n, err := sr.r.Read(p)
+	if sr.tee != nil {
+		sr.tee.Write(p[:n])
+	}
+	sr.offset += int64(n)
+	return n, err
+}
+
+func (sr *sectionReader) ReadByte() (byte, error) {
+	b, err := sr.r.ReadByte()
+	if err == nil {
+		if sr.tee != nil {
+			sr.tee.Write([]byte{b})
+		}
+		sr.offset++
+	}
+	return b, err
+}
+
+// checkFormat returns ErrApkV3 if the archive is an adb file rather than
+// concatenated gzip streams.
+func (sr *sectionReader) checkFormat() error {
+	header, err := sr.r.Peek(4)
+	if err == nil && adb.IsFile(header) {
+		return ErrApkV3
+	}
+
+	return nil
+}
+
+// section holds the files of a signature or control section.
+type section struct {
+	names []string
+	files map[string][]byte
+}
+
+// isSignature returns whether the section holds signatures.
+func (s *section) isSignature() bool {
+	for _, name := range s.names {
+		if !strings.HasPrefix(name, ".SIGN.") {
+			return false
+		}
+	}
+
+	return len(s.names) > 0
+}
+
+// readSection reads the next gzip stream, which must hold a tarball of
+// small files, such as the signature or control section, and returns
+// its files.
+func (sr *sectionReader) readSection() (*section, error) {
+	zr, err := gzip.NewReader(sr)
+	if err != nil {
+		return nil, err
+	}
+	zr.Multistream(false)
+
+	s := &section{files: map[string][]byte{}}
+	tr := tar.NewReader(zr)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+		s.names = append(s.names, hdr.Name)
+		s.files[hdr.Name] = data
+	}
+
+	// The signature and control sections are not terminated, so make
+	// sure the whole stream, including its trailer, has been consumed.
+	if _, err := io.Copy(io.Discard, zr); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Verify checks the signature of a package or an APKINDEX.tar.gz
+// archive against the trusted public keys, which are matched with the
+// signatures by name as apk does.  Keyless signatures are checked
+// against roots, the certificate authorities trusted to certify signing
+// keys, and are rejected if roots is nil.  For a package, the datahash
+// recorded in its .PKGINFO is checked against the data section too.
+func Verify(r io.Reader, trustedKeys []string, roots *x509.CertPool) (*Verification, error) {
+	sr := &sectionReader{r: bufio.NewReader(r)}
+	if err := sr.checkFormat(); err != nil {
+		return nil, err
+	}
+
+	signatures, err := sr.readSection()
+	if err != nil {
+		return nil, fmt.Errorf("unable to read signature section: %w", err)
+	}
+
+	if !signatures.isSignature() {
+		return nil, ErrUnsigned
+	}
+
+	// The signature covers everything following the signature section,
+	// which for a package is only its control section.  RSA signatures
+	// are made over its SHA-1 digest, keyless signatures over its
+	// SHA-256 digest.
+	h := sha1.New() // nolint:gosec
+	h256 := sha256.New()
+	sr.tee = io.MultiWriter(h, h256)
+	control, err := sr.readSection()
+	if err != nil {
+		return nil, fmt.Errorf("unable to read control section: %w", err)
+	}
+
+	v := &Verification{Kind: KindIndex}
+	var digest, digest256 []byte
+
+	pkginfo, isPackage := control.files[".PKGINFO"]
+	if isPackage {
+		v.Kind = KindPackage
+		digest, digest256 = h.Sum(nil), h256.Sum(nil)
+
+		dh := sha256.New()
+		sr.tee = dh
+		if _, err := io.Copy(io.Discard, sr); err != nil {
+			return nil, fmt.Errorf("unable to read data section: %w", err)
+		}
+
+		expected := pkginfoValue(pkginfo, "datahash")
+		actual := hex.EncodeToString(dh.Sum(nil))
+		if expected != actual {
+			return nil, fmt.Errorf("datahash mismatch: .PKGINFO records %q, data section is %s", expected, actual)
+		}
+	} else {
+		if _, ok := control.files["APKINDEX"]; !ok {
+			return nil, fmt.Errorf("archive is neither a package nor an index")
+		}
+
+		if _, err := io.Copy(io.Discard, sr); err != nil {
+			return nil, fmt.Errorf("unable to read index: %w", err)
+		}
+		digest, digest256 = h.Sum(nil), h256.Sum(nil)
+	}
+
+	if err := verifySignatures(v, signatures, digest, digest256, trustedKeys, roots); err != nil {
+		return nil, err
+	}
+
+	return v, nil
+}
+
+// verifySignatures records in v the trusted key or the certificate one
+// of the signatures was made with.
+func verifySignatures(v *Verification, signatures *section, digest, digest256 []byte, trustedKeys []string, roots *x509.CertPool) error {
+	errs := []string{}
+	for _, name := range signatures.names {
+		if name == CertificateSignatureName {
+			if roots == nil {
+				errs = append(errs, fmt.Sprintf("%s: no trusted roots for keyless signatures", name))
+				continue
+			}
+
+			cert, err := VerifyCertificateSignature(digest256, signatures.files[name], roots)
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %v", name, err))
+				continue
+			}
+
+			v.Certificate = cert
+			return nil
+		}
+
+		if !strings.HasPrefix(name, ".SIGN.RSA.") {
+			errs = append(errs, fmt.Sprintf("%s: unsupported signature type", name))
+			continue
+		}
+
+		keyName := strings.TrimPrefix(name, ".SIGN.RSA.")
+		for _, key := range trustedKeys {
+			if filepath.Base(key) != keyName {
+				continue
+			}
+
+			if err := RSAVerifySHA1Digest(digest, signatures.files[name], key); err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %v", name, err))
+				continue
+			}
+
+			v.Key = key
+			return nil
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("%w: %s", ErrUntrusted, strings.Join(errs, "; "))
+	}
+
+	return fmt.Errorf("%w: signed with %s", ErrUntrusted, strings.Join(signatures.names, ", "))
+}
+
+// pkginfoValue returns the value of the first key = value line of a
+// .PKGINFO file with the given key.
+func pkginfoValue(pkginfo []byte, key string) string {
+	for _, line := range strings.Split(string(pkginfo), "\n") {
+		k, v, ok := strings.Cut(line, "=")
+		if ok && strings.TrimSpace(k) == key {
+			return strings.TrimSpace(v)
+		}
+	}
+
+	return ""
+}
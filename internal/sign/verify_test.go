@@ -0,0 +1,217 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sign
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1" // nolint:gosec
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"chainguard.dev/melange/internal/adb"
+	"github.com/stretchr/testify/require"
+)
+
+// testTarGz returns a gzip compressed tarball of files, terminated only
+// if terminate is set, as the sections of an apk are.
+func testTarGz(t *testing.T, terminate bool, files map[string]string) []byte {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(zw)
+
+	for name, contents := range files {
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(contents))}))
+		_, err := tw.Write([]byte(contents))
+		require.NoError(t, err)
+	}
+
+	if terminate {
+		require.NoError(t, tw.Close())
+	} else {
+		require.NoError(t, tw.Flush())
+	}
+	require.NoError(t, zw.Close())
+
+	return buf.Bytes()
+}
+
+// testKey writes an RSA keypair into dir and returns the path of the
+// private key.
+func testKey(t *testing.T, dir, name string) string {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	keyFile := filepath.Join(dir, name)
+	data, err := EncodePrivateKey(key, "")
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(keyFile, data, 0600))
+
+	pubData, err := EncodePublicKey(&key.PublicKey)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(keyFile+".pub", pubData, 0644))
+
+	return keyFile
+}
+
+// testPackage returns a package with the given data section, signed
+// with keyFile unless it is empty.
+func testPackage(t *testing.T, keyFile string, data []byte) []byte {
+	datahash := sha256.Sum256(data)
+	control := testTarGz(t, false, map[string]string{
+		".PKGINFO": fmt.Sprintf("pkgname = hello\npkgver = 1.0-r0\ndatahash = %s\n", hex.EncodeToString(datahash[:])),
+	})
+
+	pkg := []byte{}
+	if keyFile != "" {
+		digest := sha1.Sum(control) // nolint:gosec
+		sig, err := RSASignSHA1Digest(digest[:], keyFile, "")
+		require.NoError(t, err)
+
+		pkg = append(pkg, testTarGz(t, false, map[string]string{RSASignatureName(keyFile): string(sig)})...)
+	}
+
+	pkg = append(pkg, control...)
+	return append(pkg, data...)
+}
+
+// testAdbFile returns an empty adb package, as packages in the v3
+// format are.
+func testAdbFile(t *testing.T) []byte {
+	var buf bytes.Buffer
+	aw, err := adb.NewWriter(&buf, adb.SchemaPackage, true)
+	require.NoError(t, err)
+	require.NoError(t, aw.Close())
+
+	return buf.Bytes()
+}
+
+func TestVerify(t *testing.T) {
+	dir := t.TempDir()
+	trusted := testKey(t, dir, "trusted.rsa")
+	untrusted := testKey(t, dir, "untrusted.rsa")
+	data := testTarGz(t, true, map[string]string{"usr/bin/hello": "hello"})
+
+	pkg := testPackage(t, trusted, data)
+	tamperedPkg := append(append([]byte{}, pkg[:len(pkg)-len(data)]...), testTarGz(t, true, map[string]string{"usr/bin/hello": "evil"})...)
+
+	indexData := testTarGz(t, true, map[string]string{
+		"DESCRIPTION": "test",
+		"APKINDEX":    "P:hello\nV:1.0-r0\n",
+	})
+	index, err := SignIndex(indexData, trusted, "")
+	require.NoError(t, err)
+
+	tamperedIndex := append(append([]byte{}, index[:len(index)-len(indexData)]...), testTarGz(t, true, map[string]string{
+		"DESCRIPTION": "test",
+		"APKINDEX":    "P:evil\nV:1.0-r0\n",
+	})...)
+
+	tests := []struct {
+		description string
+		archive     []byte
+		kind        ArchiveKind
+		err         string
+		is          error
+	}{{
+		description: "signed package",
+		archive:     pkg,
+		kind:        KindPackage,
+	}, {
+		description: "package signed with an untrusted key",
+		archive:     testPackage(t, untrusted, data),
+		is:          ErrUntrusted,
+	}, {
+		description: "unsigned package",
+		archive:     testPackage(t, "", data),
+		is:          ErrUnsigned,
+	}, {
+		description: "package with tampered data",
+		archive:     tamperedPkg,
+		err:         "datahash mismatch",
+	}, {
+		description: "apk v3 package",
+		archive:     testAdbFile(t),
+		is:          ErrApkV3,
+	}, {
+		description: "signed index",
+		archive:     index,
+		kind:        KindIndex,
+	}, {
+		description: "tampered index",
+		archive:     tamperedIndex,
+		err:         "verify PKCS1v15 signature",
+	}}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			v, err := Verify(bytes.NewReader(test.archive), []string{trusted + ".pub"}, nil)
+			if test.is != nil {
+				require.ErrorIs(t, err, test.is)
+				return
+			}
+			if test.err != "" {
+				require.ErrorContains(t, err, test.err)
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, test.kind, v.Kind)
+			require.Equal(t, trusted+".pub", v.Key)
+		})
+	}
+}
+
+func TestVerifyKeyless(t *testing.T) {
+	ca := newTestCA(t)
+	srv := httptest.NewServer(ca)
+	defer srv.Close()
+
+	data := testTarGz(t, true, map[string]string{"usr/bin/hello": "hello"})
+	datahash := sha256.Sum256(data)
+	control := testTarGz(t, false, map[string]string{
+		".PKGINFO": fmt.Sprintf("pkgname = hello\npkgver = 1.0-r0\ndatahash = %s\n", hex.EncodeToString(datahash[:])),
+	})
+
+	signer := NewKeylessSigner(&FulcioCA{URL: srv.URL, IdentityToken: testToken(`{"sub":"1234","email":"builder@example.com"}`)})
+	digest := sha256.Sum256(control)
+	sig, err := signer.Sign(digest[:])
+	require.NoError(t, err)
+
+	pkg := testTarGz(t, false, map[string]string{CertificateSignatureName: string(sig)})
+	pkg = append(append(pkg, control...), data...)
+
+	v, err := Verify(bytes.NewReader(pkg), nil, ca.Roots())
+	require.NoError(t, err)
+	require.Equal(t, KindPackage, v.Kind)
+	require.Empty(t, v.Key)
+	require.Equal(t, []string{"builder@example.com"}, v.Certificate.EmailAddresses)
+
+	_, err = Verify(bytes.NewReader(pkg), nil, nil)
+	require.ErrorIs(t, err, ErrUntrusted)
+	require.ErrorContains(t, err, "no trusted roots")
+
+	_, err = Verify(bytes.NewReader(pkg), nil, newTestCA(t).Roots())
+	require.ErrorIs(t, err, ErrUntrusted)
+	require.ErrorContains(t, err, "verify certificate chain")
+}
@@ -0,0 +1,285 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package spdx
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Expression is a parsed SPDX license expression.
+type Expression interface {
+	// String returns the normalized form of the expression.
+	String() string
+}
+
+// License is a license, with an optional exception.
+type License struct {
+	// ID is the canonical identifier of the license, or a LicenseRef.
+	ID        string
+	OrLater   bool
+	Exception string
+}
+
+func (l *License) String() string {
+	s := l.ID
+	if l.OrLater {
+		s += "+"
+	}
+	if l.Exception != "" {
+		s += " WITH " + l.Exception
+	}
+	return s
+}
+
+// Compound is a conjunction or disjunction of expressions.
+type Compound struct {
+	// Op is either AND or OR.
+	Op   string
+	Args []Expression
+}
+
+func (c *Compound) String() string {
+	args := make([]string, 0, len(c.Args))
+	for _, arg := range c.Args {
+		// AND takes precedence over OR, so only a disjunction within
+		// a conjunction needs parentheses.
+		if sub, ok := arg.(*Compound); ok && sub.Op == "OR" && c.Op == "AND" {
+			args = append(args, "("+sub.String()+")")
+			continue
+		}
+		args = append(args, arg.String())
+	}
+	return strings.Join(args, " "+c.Op+" ")
+}
+
+var (
+	tokenRe = regexp.MustCompile(`\s*(\(|\)|[^\s()]+)`)
+	refRe   = regexp.MustCompile(`^(DocumentRef-[A-Za-z0-9.-]+:)?LicenseRef-[A-Za-z0-9.-]+$`)
+	addRe   = regexp.MustCompile(`^(DocumentRef-[A-Za-z0-9.-]+:)?AdditionRef-[A-Za-z0-9.-]+$`)
+)
+
+// ErrEmpty is returned when parsing an empty expression.
+var ErrEmpty = errors.New("empty license expression")
+
+type parser struct {
+	tokens []string
+	pos    int
+}
+
+func (p *parser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *parser) next() string {
+	tok := p.peek()
+	p.pos++
+	return tok
+}
+
+// operator returns the operator tok is, in upper case, or the empty
+// string.  Operators are either all upper or all lower case.
+func operator(tok string) string {
+	switch tok {
+	case "AND", "and":
+		return "AND"
+	case "OR", "or":
+		return "OR"
+	case "WITH", "with":
+		return "WITH"
+	}
+	return ""
+}
+
+// Parse parses an SPDX license expression, checking its license and
+// exception identifiers against the SPDX license list.
+func Parse(expr string) (Expression, error) {
+	if strings.TrimSpace(expr) == "" {
+		return nil, ErrEmpty
+	}
+
+	p := &parser{}
+	for _, m := range tokenRe.FindAllStringSubmatch(expr, -1) {
+		p.tokens = append(p.tokens, m[1])
+	}
+
+	e, err := p.parseCompound("OR")
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok != "" {
+		return nil, fmt.Errorf("unexpected %q in license expression", tok)
+	}
+
+	return e, nil
+}
+
+// Normalize returns the normalized form of an SPDX license expression:
+// identifiers in their canonical case, deprecated GNU identifiers
+// replaced by their -only and -or-later forms, upper case operators and
+// only the parentheses required by operator precedence.
+func Normalize(expr string) (string, error) {
+	e, err := Parse(expr)
+	if err != nil {
+		return "", err
+	}
+	return e.String(), nil
+}
+
+// parseCompound parses a sequence of expressions joined by op; the
+// operands of OR are conjunctions, which bind tighter.
+func (p *parser) parseCompound(op string) (Expression, error) {
+	parse := p.parseWith
+	if op == "OR" {
+		parse = func() (Expression, error) { return p.parseCompound("AND") }
+	}
+
+	first, err := parse()
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Compound{Op: op}
+	add := func(e Expression) {
+		if sub, ok := e.(*Compound); ok && sub.Op == op {
+			c.Args = append(c.Args, sub.Args...)
+			return
+		}
+		c.Args = append(c.Args, e)
+	}
+	add(first)
+
+	for operator(p.peek()) == op {
+		p.next()
+		e, err := parse()
+		if err != nil {
+			return nil, err
+		}
+		add(e)
+	}
+
+	if len(c.Args) == 1 {
+		return c.Args[0], nil
+	}
+	return c, nil
+}
+
+func (p *parser) parseWith() (Expression, error) {
+	tok := p.next()
+	switch {
+	case tok == "":
+		return nil, errors.New("unexpected end of license expression")
+	case tok == "(":
+		e, err := p.parseCompound("OR")
+		if err != nil {
+			return nil, err
+		}
+		if p.next() != ")" {
+			return nil, errors.New("missing closing parenthesis in license expression")
+		}
+		return e, nil
+	case tok == ")" || operator(tok) != "":
+		return nil, fmt.Errorf("unexpected %q in license expression", tok)
+	}
+
+	l, err := parseLicense(tok)
+	if err != nil {
+		return nil, err
+	}
+
+	if operator(p.peek()) == "WITH" {
+		p.next()
+		if l.Exception, err = parseException(p.next()); err != nil {
+			return nil, err
+		}
+	}
+
+	return l, nil
+}
+
+func parseLicense(tok string) (*License, error) {
+	if refRe.MatchString(tok) {
+		return &License{ID: tok}, nil
+	}
+
+	if id, ok := licenses.lookup(tok); ok {
+		return &License{ID: replaceDeprecated(id)}, nil
+	}
+
+	if base := strings.TrimSuffix(tok, "+"); base != tok && base != "" {
+		if id, ok := licenses.lookup(base); ok {
+			return &License{ID: id, OrLater: true}, nil
+		}
+	}
+
+	return nil, unknown("license", tok, licenses.suggest(tok))
+}
+
+func parseException(tok string) (string, error) {
+	if tok == "" || tok == "(" || tok == ")" || operator(tok) != "" {
+		return "", errors.New("missing license exception after WITH")
+	}
+
+	if addRe.MatchString(tok) {
+		return tok, nil
+	}
+
+	if id, ok := exceptions.lookup(tok); ok {
+		return id, nil
+	}
+
+	return "", unknown("license exception", tok, exceptions.suggest(tok))
+}
+
+// replaceDeprecated replaces the deprecated identifiers of GNU licenses,
+// such as GPL-2.0 and GPL-2.0+, by the explicit GPL-2.0-only and
+// GPL-2.0-or-later forms which superseded them.
+func replaceDeprecated(id string) string {
+	if !deprecated[id] {
+		return id
+	}
+
+	if base := strings.TrimSuffix(id, "+"); base != id {
+		if later, ok := licenses.lookup(base + "-or-later"); ok {
+			return later
+		}
+		return id
+	}
+
+	if only, ok := licenses.lookup(id + "-only"); ok {
+		return only
+	}
+	return id
+}
+
+func unknown(kind, id string, suggestions []string) error {
+	switch len(suggestions) {
+	case 0:
+		return fmt.Errorf("unknown %s identifier %q", kind, id)
+	case 1:
+		return fmt.Errorf("unknown %s identifier %q, did you mean %q?", kind, id, suggestions[0])
+	}
+
+	quoted := make([]string, 0, len(suggestions))
+	for _, s := range suggestions {
+		quoted = append(quoted, fmt.Sprintf("%q", s))
+	}
+	return fmt.Errorf("unknown %s identifier %q, did you mean one of %s?", kind, id, strings.Join(quoted, ", "))
+}
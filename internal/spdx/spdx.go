@@ -0,0 +1,171 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package spdx validates and normalizes SPDX license expressions against
+// an embedded copy of the SPDX license list.
+package spdx
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// The license and exception lists use the format of the json directory
+// of https://github.com/spdx/license-list-data, and can be refreshed
+// from there.
+var (
+	//go:embed licenses.json
+	licensesJSON []byte
+
+	//go:embed exceptions.json
+	exceptionsJSON []byte
+)
+
+type licenseList struct {
+	Version  string `json:"licenseListVersion"`
+	Licenses []struct {
+		ID         string `json:"licenseId"`
+		Deprecated bool   `json:"isDeprecatedLicenseId"`
+	} `json:"licenses"`
+}
+
+type exceptionList struct {
+	Exceptions []struct {
+		ID         string `json:"licenseExceptionId"`
+		Deprecated bool   `json:"isDeprecatedLicenseId"`
+	} `json:"exceptions"`
+}
+
+// identifiers maps the lowercase form of identifiers, which are case
+// insensitive, to their canonical form.
+type identifiers map[string]string
+
+// ListVersion is the version of the embedded SPDX license list.
+var ListVersion string
+
+var (
+	licenses   = identifiers{}
+	exceptions = identifiers{}
+	deprecated = map[string]bool{}
+)
+
+func init() {
+	var ll licenseList
+	if err := json.Unmarshal(licensesJSON, &ll); err != nil {
+		panic(fmt.Sprintf("invalid embedded license list: %v", err))
+	}
+	ListVersion = ll.Version
+	for _, l := range ll.Licenses {
+		licenses[strings.ToLower(l.ID)] = l.ID
+		deprecated[l.ID] = l.Deprecated
+	}
+
+	var el exceptionList
+	if err := json.Unmarshal(exceptionsJSON, &el); err != nil {
+		panic(fmt.Sprintf("invalid embedded exception list: %v", err))
+	}
+	for _, e := range el.Exceptions {
+		exceptions[strings.ToLower(e.ID)] = e.ID
+	}
+}
+
+func (ids identifiers) lookup(id string) (string, bool) {
+	canonical, ok := ids[strings.ToLower(id)]
+	return canonical, ok
+}
+
+// suggest returns the identifiers closest to id, ignoring case and
+// punctuation, for identifiers which are likely misspelled.
+func (ids identifiers) suggest(id string) []string {
+	query := squash(id)
+	limit := len(query) / 3
+	if limit < 2 {
+		limit = 2
+	}
+
+	type candidate struct {
+		id       string
+		distance int
+	}
+	candidates := []candidate{}
+	for _, canonical := range ids {
+		if deprecated[canonical] {
+			continue
+		}
+		if d := distance(query, squash(canonical)); d <= limit {
+			candidates = append(candidates, candidate{canonical, d})
+		}
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].distance != candidates[j].distance {
+			return candidates[i].distance < candidates[j].distance
+		}
+		return candidates[i].id < candidates[j].id
+	})
+
+	// only the closest candidates are worth suggesting
+	suggestions := []string{}
+	for i := 0; i < len(candidates) && i < 3 && candidates[i].distance == candidates[0].distance; i++ {
+		suggestions = append(suggestions, candidates[i].id)
+	}
+	return suggestions
+}
+
+// squash returns the lowercase form of s without punctuation.
+func squash(s string) string {
+	var sb strings.Builder
+	for _, r := range strings.ToLower(s) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			sb.WriteRune(r)
+		}
+	}
+	return sb.String()
+}
+
+// distance returns the Levenshtein distance between a and b.
+func distance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+
+	return prev[len(b)]
+}
+
+func min(values ...int) int {
+	m := values[0]
+	for _, v := range values[1:] {
+		if v < m {
+			m = v
+		}
+	}
+	return m
+}
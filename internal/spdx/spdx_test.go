@@ -0,0 +1,72 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package spdx
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNormalize(t *testing.T) {
+	for _, tt := range []struct {
+		expr string
+		want string
+	}{
+		{"MIT", "MIT"},
+		{"mit", "MIT"},
+		{"apache-2.0 or mit", "Apache-2.0 OR MIT"},
+		{"GPL-2.0", "GPL-2.0-only"},
+		{"GPL-2.0+", "GPL-2.0-or-later"},
+		{"LGPL-2.1+ AND BSD-3-Clause", "LGPL-2.1-or-later AND BSD-3-Clause"},
+		{"Apache-1.0+", "Apache-1.0+"},
+		{"GPL-2.0-only WITH classpath-exception-2.0", "GPL-2.0-only WITH Classpath-exception-2.0"},
+		{"((MIT))", "MIT"},
+		{"(MIT AND BSD-2-Clause) AND ISC", "MIT AND BSD-2-Clause AND ISC"},
+		{"MIT AND (Apache-2.0 OR ISC)", "MIT AND (Apache-2.0 OR ISC)"},
+		{"(MIT AND ISC) OR Apache-2.0", "MIT AND ISC OR Apache-2.0"},
+		{"LicenseRef-Proprietary OR MIT", "LicenseRef-Proprietary OR MIT"},
+		{"DocumentRef-spdx-tool-1.2:LicenseRef-MIT-Style-2", "DocumentRef-spdx-tool-1.2:LicenseRef-MIT-Style-2"},
+	} {
+		got, err := Normalize(tt.expr)
+		require.NoError(t, err, tt.expr)
+		require.Equal(t, tt.want, got, tt.expr)
+	}
+}
+
+func TestNormalizeInvalid(t *testing.T) {
+	for _, tt := range []struct {
+		expr string
+		err  string
+	}{
+		{"", "empty license expression"},
+		{"Apache2", `unknown license identifier "Apache2", did you mean "Apache-2.0"?`},
+		{"GPLv3+", `unknown license identifier "GPLv3+"`},
+		{"MIT AND", "unexpected end of license expression"},
+		{"MIT And ISC", `unexpected "And" in license expression`},
+		{"(MIT OR ISC", "missing closing parenthesis in license expression"},
+		{"MIT)", `unexpected ")" in license expression`},
+		{"GPL-2.0-only WITH", "missing license exception after WITH"},
+		{"GPL-2.0-only WITH Classpath-exception", `unknown license exception identifier "Classpath-exception", did you mean "Classpath-exception-2.0"?`},
+	} {
+		_, err := Normalize(tt.expr)
+		require.Error(t, err, tt.expr)
+		require.Contains(t, err.Error(), tt.err, tt.expr)
+	}
+}
+
+func TestListVersion(t *testing.T) {
+	require.NotEmpty(t, ListVersion)
+}
@@ -15,13 +15,22 @@
 package main
 
 import (
+	"context"
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
 
 	"chainguard.dev/melange/pkg/cli"
 )
 
 func main() {
-	if err := cli.New().Execute(); err != nil {
+	// Cancel the running command on SIGINT or SIGTERM, so builds can
+	// kill their pipelines cleanly.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err := cli.New().ExecuteContext(ctx); err != nil {
 		log.Fatalf("error during command execution: %v", err)
 	}
 }
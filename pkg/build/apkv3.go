@@ -0,0 +1,217 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"crypto"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+
+	apkofs "chainguard.dev/apko/pkg/fs"
+	"chainguard.dev/melange/internal/adb"
+	"chainguard.dev/melange/internal/sign"
+)
+
+// ApkFormats are the package formats which can be emitted: v2 is the
+// tarball based format of apk-tools 2, and v3 the adb based format of
+// apk-tools 3.
+var ApkFormats = []string{"v2", "v3"}
+
+// adbPackage returns the adb representation of the package, whose files
+// are those of fsys.
+func (pc *PackageContext) adbPackage(fsys apkofs.ReadLinkFS) (*adb.Package, error) {
+	pkg := &adb.Package{
+		Info: adb.PackageInfo{
+			Name:          pc.PackageName,
+			Version:       fmt.Sprintf("%s-r%d", pc.Origin.Version, pc.Origin.Epoch),
+			Description:   pc.Description,
+			Arch:          pc.Arch,
+			License:       pc.License,
+			Origin:        pc.Origin.Name,
+			BuildTime:     uint64(pc.Context.SourceDateEpoch.Unix()),
+			InstalledSize: uint64(pc.InstalledSize),
+		},
+		Scripts: adb.Scripts{
+			Trigger:       pc.Scriptlets.Trigger.Script,
+			PreInstall:    pc.Scriptlets.PreInstall,
+			PostInstall:   pc.Scriptlets.PostInstall,
+			PreDeinstall:  pc.Scriptlets.PreDeinstall,
+			PostDeinstall: pc.Scriptlets.PostDeinstall,
+			PreUpgrade:    pc.Scriptlets.PreUpgrade,
+			PostUpgrade:   pc.Scriptlets.PostUpgrade,
+		},
+		Triggers: pc.Scriptlets.Trigger.Paths,
+	}
+
+	for _, dep := range pc.Dependencies.Runtime {
+		pkg.Info.Depends = append(pkg.Info.Depends, adb.ParseDependency(dep))
+	}
+	for _, dep := range pc.Dependencies.Provides {
+		pkg.Info.Provides = append(pkg.Info.Provides, adb.ParseDependency(dep))
+	}
+
+	// Ownership is reset to root, as in the data section of v2 packages.
+	acl := func(mode fs.FileMode) adb.ACL {
+		return adb.ACL{Mode: unixPermissions(mode), User: "root", Group: "root"}
+	}
+	mtime := uint64(pc.Context.SourceDateEpoch.Unix())
+
+	dirs := map[string]*adb.Dir{}
+	if err := fs.WalkDir(fsys, ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		if d.IsDir() {
+			name := p
+			if name == "." {
+				name = ""
+			}
+			dirs[name] = &adb.Dir{Name: name, ACL: acl(fi.Mode())}
+			return nil
+		}
+
+		entry := adb.Entry{Name: path.Base(p), ACL: acl(fi.Mode()), MTime: mtime}
+		switch {
+		case fi.Mode()&fs.ModeSymlink != 0:
+			target, err := fsys.Readlink(p)
+			if err != nil {
+				return err
+			}
+			entry.Target = adb.SymlinkTarget(target)
+		case fi.Mode().IsRegular():
+			digest, err := fsDigest(fsys, p)
+			if err != nil {
+				return err
+			}
+			entry.Size = uint64(fi.Size())
+			entry.Hash = digest
+		default:
+			return fmt.Errorf("%s: unsupported file type %s", p, fi.Mode().Type())
+		}
+
+		dir := path.Dir(p)
+		if dir == "." {
+			dir = ""
+		}
+		dirs[dir].Files = append(dirs[dir].Files, entry)
+
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("unable to preprocess package data: %w", err)
+	}
+
+	for name, dir := range dirs {
+		// The root directory is only listed for the files it holds.
+		if name == "" && len(dir.Files) == 0 {
+			continue
+		}
+		pkg.Paths = append(pkg.Paths, *dir)
+	}
+	sort.Slice(pkg.Paths, func(i, j int) bool {
+		return pkg.Paths[i].Name < pkg.Paths[j].Name
+	})
+
+	return pkg, nil
+}
+
+// unixPermissions returns the permission bits of mode, including the
+// setuid, setgid and sticky bits, as they are encoded by chmod.
+func unixPermissions(mode fs.FileMode) uint64 {
+	perm := uint64(mode.Perm())
+	if mode&fs.ModeSetuid != 0 {
+		perm |= 04000
+	}
+	if mode&fs.ModeSetgid != 0 {
+		perm |= 02000
+	}
+	if mode&fs.ModeSticky != 0 {
+		perm |= 01000
+	}
+
+	return perm
+}
+
+// fsDigest returns the SHA256 digest of the contents of a file.
+func fsDigest(fsys fs.FS, name string) ([]byte, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+
+	return h.Sum(nil), nil
+}
+
+// emitAPKv3 writes the package in the adb based format of apk-tools 3,
+// signed with the signing key if one is configured.
+func (pc *PackageContext) emitAPKv3(fsys apkofs.ReadLinkFS) error {
+	pkg, err := pc.adbPackage(fsys)
+	if err != nil {
+		return err
+	}
+
+	signers := []crypto.Signer{}
+	if pc.wantSignature() {
+		ks, ok := pc.Context.signer().(sign.PrivateKeySigner)
+		if !ok {
+			return fmt.Errorf("v3 packages can only be signed with a signing key")
+		}
+
+		key, err := ks.PrivateKey()
+		if err != nil {
+			return fmt.Errorf("unable to load signing key: %w", err)
+		}
+		signers = append(signers, key)
+	}
+
+	if err := os.MkdirAll(pc.OutDir, 0755); err != nil {
+		return fmt.Errorf("unable to create output directory: %w", err)
+	}
+
+	outFile, err := os.Create(pc.Filename())
+	if err != nil {
+		return fmt.Errorf("unable to create apk file: %w", err)
+	}
+	defer outFile.Close()
+
+	open := func(name string) (io.ReadCloser, error) {
+		return fsys.Open(name)
+	}
+	if err := adb.WritePackage(outFile, pkg, open, signers...); err != nil {
+		return fmt.Errorf("unable to write apk file: %w", err)
+	}
+
+	pc.Logger.Printf("  unique-id: %s", hex.EncodeToString(pkg.Info.UniqueID))
+	pc.Logger.Printf("wrote %s", outFile.Name())
+
+	return nil
+}
@@ -0,0 +1,148 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"chainguard.dev/melange/internal/adb"
+	"chainguard.dev/melange/internal/sign"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEmitPackageV3(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	keyData, err := sign.EncodePrivateKey(key, "")
+	require.NoError(t, err)
+	keyFile := filepath.Join(t.TempDir(), "test.rsa")
+	require.NoError(t, os.WriteFile(keyFile, keyData, 0600))
+
+	ctx := &Context{
+		WorkspaceDir:    t.TempDir(),
+		OutDir:          t.TempDir(),
+		SigningKey:      keyFile,
+		SourceDateEpoch: time.Unix(1234, 0),
+		ApkFormat:       "v3",
+	}
+	pc := &PackageContext{
+		Context:      ctx,
+		Origin:       &Package{Name: "hello", Version: "1.0", Copyright: []Copyright{{License: "Apache-2.0"}}},
+		PackageName:  "hello",
+		OutDir:       ctx.OutDir,
+		Logger:       log.New(io.Discard, "", 0),
+		Dependencies: Dependencies{Runtime: []string{"busybox>=1.35"}},
+		Arch:         "x86_64",
+		Description:  "hello world",
+		Scriptlets:   Scriptlets{PostInstall: "#!/bin/sh\ntrue\n"},
+	}
+
+	script := "#!/bin/sh\necho hello\n"
+	bin := filepath.Join(pc.WorkspaceSubdir(), "usr", "bin")
+	require.NoError(t, os.MkdirAll(bin, 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(bin, "hello"), []byte(script), 0755))
+	require.NoError(t, os.Symlink("hello", filepath.Join(bin, "hi")))
+	require.NoError(t, os.WriteFile(filepath.Join(pc.WorkspaceSubdir(), "empty"), nil, 0644))
+
+	require.NoError(t, pc.EmitPackage())
+
+	f, err := os.Open(pc.Filename())
+	require.NoError(t, err)
+	defer f.Close()
+
+	pf, err := adb.ReadPackage(f)
+	require.NoError(t, err)
+	require.NoError(t, pf.Verify(&key.PublicKey))
+
+	info := pf.Package.Info
+	require.Equal(t, "hello", info.Name)
+	require.Equal(t, "1.0-r0", info.Version)
+	require.Equal(t, "hello world", info.Description)
+	require.Equal(t, "Apache-2.0", info.License)
+	require.Equal(t, uint64(1234), info.BuildTime)
+	require.Equal(t, uint64(pc.InstalledSize), info.InstalledSize)
+	require.Equal(t, []string{"busybox>=1.35", "cmd:sh"}, dependencyStrings(info.Depends))
+	require.Equal(t, []string{"cmd:hello=1.0-r0"}, dependencyStrings(info.Provides))
+	require.NotEmpty(t, info.UniqueID)
+	require.Equal(t, "#!/bin/sh\ntrue\n", pf.Package.Scripts.PostInstall)
+
+	paths := []string{}
+	for _, dir := range pf.Package.Paths {
+		paths = append(paths, dir.Name)
+	}
+	require.Equal(t, []string{"", "usr", "usr/bin"}, paths)
+
+	require.Equal(t, "empty", pf.Package.Paths[0].Files[0].Name)
+	files := pf.Package.Paths[2].Files
+	require.Len(t, files, 2)
+	require.Equal(t, uint64(0755), files[0].ACL.Mode)
+	target, ok := files[1].Symlink()
+	require.True(t, ok)
+	require.Equal(t, "hello", target)
+
+	require.Equal(t, map[string][]byte{"usr/bin/hello": []byte(script)}, pf.Data)
+}
+
+func dependencyStrings(deps []adb.Dependency) []string {
+	out := []string{}
+	for _, dep := range deps {
+		out = append(out, dep.String())
+	}
+	return out
+}
+
+func TestNewV3WithTests(t *testing.T) {
+	config := `package:
+  name: hello
+  version: 1.0
+pipeline:
+  - runs: make install
+`
+	test := `test:
+  pipeline:
+    - runs: hello
+`
+
+	for _, tt := range []struct {
+		description string
+		config      string
+		format      string
+		err         string
+	}{
+		{"v2 with tests", config + test, "v2", ""},
+		{"v3 without tests", config, "v3", ""},
+		{"v3 with tests", config + test, "v3", "tests are not supported with apk format v3"},
+	} {
+		t.Run(tt.description, func(t *testing.T) {
+			dir := t.TempDir()
+			configFile := filepath.Join(dir, "melange.yaml")
+			require.NoError(t, os.WriteFile(configFile, []byte(tt.config), 0644))
+
+			_, err := New(WithConfig(configFile), WithApkFormat(tt.format), WithWorkspaceDir(dir))
+			if tt.err != "" {
+				require.ErrorContains(t, err, tt.err)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
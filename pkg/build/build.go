@@ -16,6 +16,8 @@ package build
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -23,7 +25,6 @@ import (
 	"io/fs"
 	"log"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"runtime"
 	"strconv"
@@ -34,6 +35,8 @@ import (
 	apko_build "chainguard.dev/apko/pkg/build"
 	apko_types "chainguard.dev/apko/pkg/build/types"
 	apkofs "chainguard.dev/apko/pkg/fs"
+	"chainguard.dev/melange/internal/sign"
+	"chainguard.dev/melange/internal/spdx"
 	"github.com/zealic/xignore"
 	"gopkg.in/yaml.v3"
 )
@@ -53,9 +56,13 @@ type Scriptlets struct {
 }
 
 type PackageOption struct {
-	NoProvides bool `yaml:"no-provides"`
-	NoDepends  bool `yaml:"no-depends"`
-	NoCommands bool `yaml:"no-commands"`
+	NoProvides  bool `yaml:"no-provides"`
+	NoDepends   bool `yaml:"no-depends"`
+	NoCommands  bool `yaml:"no-commands"`
+	NoShebangs  bool `yaml:"no-shebangs"`
+	NoPkgConfig bool `yaml:"no-pkgconfig"`
+	NoPython    bool `yaml:"no-python"`
+	NoPerl      bool `yaml:"no-perl"`
 }
 
 type Package struct {
@@ -82,13 +89,16 @@ type Needs struct {
 
 type Pipeline struct {
 	Name     string
+	If       string
 	Uses     string
 	With     map[string]string
 	Runs     string
 	Pipeline []Pipeline
 	Inputs   map[string]Input
 	Needs    Needs
+	Timeout  time.Duration
 	logger   *log.Logger
+	builtin  *builtinPipeline
 }
 
 type Subpackage struct {
@@ -98,6 +108,7 @@ type Subpackage struct {
 	Options      PackageOption
 	Scriptlets   Scriptlets
 	Description  string
+	Test         Test
 }
 
 type Input struct {
@@ -111,6 +122,7 @@ type Configuration struct {
 	Environment apko_types.ImageConfiguration
 	Pipeline    []Pipeline
 	Subpackages []Subpackage
+	Test        Test
 }
 
 type Context struct {
@@ -134,7 +146,19 @@ type Context struct {
 	ExtraRepos        []string
 	DependencyLog     string
 	BinShOverlay      string
+	Runner            Runner
+	CacheDir          string
+	FetchMirrors      []string
+	ApkFormat         string
+	Signer            sign.Signer
+	EmbedSBOM         bool
+	StrictCopyright   bool
+	Jobs              int
+	CompressionLevel  int
+	ParallelGzip      bool
 	ignorePatterns    []*xignore.Pattern
+	record            buildRecord
+	dependencies      map[string]*DependencyReport
 }
 
 type Dependencies struct {
@@ -142,6 +166,49 @@ type Dependencies struct {
 	Provides []string
 }
 
+// ErrSkipThisArch is returned by New when the requested architecture is
+// not one of the package's target architectures.
+var ErrSkipThisArch = errors.New("package does not support this architecture")
+
+// TargetArchitectures returns the architectures the package can be built
+// for.  An empty target-architecture list, or one containing "all", means
+// every architecture.
+func (p Package) TargetArchitectures() []apko_types.Architecture {
+	if len(p.TargetArchitecture) == 0 {
+		return apko_types.AllArchs
+	}
+
+	for _, ta := range p.TargetArchitecture {
+		if ta == "all" {
+			return apko_types.AllArchs
+		}
+	}
+
+	return apko_types.ParseArchitectures(p.TargetArchitecture)
+}
+
+// ResolveArchitectures returns the requested architectures which the
+// package can be built for, or all of its target architectures if none
+// were requested.
+func (p Package) ResolveArchitectures(requested []apko_types.Architecture) []apko_types.Architecture {
+	targets := p.TargetArchitectures()
+	if len(requested) == 0 {
+		return targets
+	}
+
+	resolved := []apko_types.Architecture{}
+	for _, arch := range requested {
+		for _, target := range targets {
+			if arch == target {
+				resolved = append(resolved, arch)
+				break
+			}
+		}
+	}
+
+	return resolved
+}
+
 func New(opts ...Option) (*Context, error) {
 	ctx := Context{
 		WorkspaceIgnore: ".melangeignore",
@@ -150,6 +217,10 @@ func New(opts ...Option) (*Context, error) {
 		OutDir:          ".",
 		Logger:          log.New(log.Writer(), "melange: ", log.LstdFlags|log.Lmsgprefix),
 		Arch:            apko_types.ParseArchitecture(runtime.GOARCH),
+		Runner:          BubblewrapRunner(),
+		ApkFormat:       "v2",
+		Jobs:            runtime.NumCPU(),
+		ParallelGzip:    true,
 	}
 
 	for _, opt := range opts {
@@ -158,17 +229,12 @@ func New(opts ...Option) (*Context, error) {
 		}
 	}
 
-	// If no workspace directory is explicitly requested, create a
-	// temporary directory for it.  Otherwise, ensure we are in a
-	// subdir for this specific build context.
-	if ctx.WorkspaceDir != "" {
-		ctx.WorkspaceDir = filepath.Join(ctx.WorkspaceDir, ctx.Arch.ToAPK())
-	} else {
-		tmpdir, err := os.MkdirTemp("", "melange-workspace-*")
+	if ctx.CacheDir == "" {
+		cacheDir, err := os.UserCacheDir()
 		if err != nil {
-			return nil, fmt.Errorf("unable to create workspace dir: %w", err)
+			cacheDir = os.TempDir()
 		}
-		ctx.WorkspaceDir = tmpdir
+		ctx.CacheDir = filepath.Join(cacheDir, "melange")
 	}
 
 	// If no config file is explicitly requested for the build context
@@ -210,11 +276,35 @@ func New(opts ...Option) (*Context, error) {
 
 	ctx.Logger.SetPrefix(fmt.Sprintf("melange (%s/%s): ", ctx.Configuration.Package.Name, ctx.Arch.ToAPK()))
 
+	// Make sure the package can actually be built for this architecture.
+	if len(ctx.Configuration.Package.ResolveArchitectures([]apko_types.Architecture{ctx.Arch})) == 0 {
+		return nil, ErrSkipThisArch
+	}
+
 	// Make sure there is actually a pipeline to run.
 	if len(ctx.Configuration.Pipeline) == 0 {
 		return nil, fmt.Errorf("no pipeline has been configured, check your config for indentation errors")
 	}
 
+	// Tests install the emitted packages from a v2 repository, so they
+	// cannot be run on v3 packages.
+	if ctx.ApkFormat == "v3" && len(ctx.packageTests()) > 0 {
+		return nil, fmt.Errorf("tests are not supported with apk format v3, remove the test sections or use apk format v2")
+	}
+
+	// If no workspace directory is explicitly requested, create a
+	// temporary directory for it.  Otherwise, ensure we are in a
+	// subdir for this specific build context.
+	if ctx.WorkspaceDir != "" {
+		ctx.WorkspaceDir = filepath.Join(ctx.WorkspaceDir, ctx.Arch.ToAPK())
+	} else {
+		tmpdir, err := os.MkdirTemp("", "melange-workspace-*")
+		if err != nil {
+			return nil, fmt.Errorf("unable to create workspace dir: %w", err)
+		}
+		ctx.WorkspaceDir = tmpdir
+	}
+
 	return &ctx, nil
 }
 
@@ -298,6 +388,48 @@ func WithSigningKey(signingKey string) Option {
 	}
 }
 
+// WithSigningPassphrase sets the passphrase the signing key is encrypted
+// with.
+func WithSigningPassphrase(passphrase string) Option {
+	return func(ctx *Context) error {
+		ctx.SigningPassphrase = passphrase
+		return nil
+	}
+}
+
+// WithSigner sets the signer used to sign packages when no signing key is
+// configured.
+func WithSigner(signer sign.Signer) Option {
+	return func(ctx *Context) error {
+		ctx.Signer = signer
+		return nil
+	}
+}
+
+// WithKeylessSigning sets up keyless signing with certificates issued by
+// the Fulcio instance at fulcioURL for the identity of identityToken,
+// which is used when no signing key is configured.  Keyless signing is
+// not set up if identityToken is empty.
+func WithKeylessSigning(fulcioURL, identityToken string) Option {
+	return func(ctx *Context) error {
+		if identityToken != "" {
+			ctx.Signer = sign.NewKeylessSigner(&sign.FulcioCA{URL: fulcioURL, IdentityToken: identityToken})
+		}
+		return nil
+	}
+}
+
+// signer returns the signer packages are signed with: the signing key if
+// one is configured, or the configured signer otherwise, which may be
+// nil.
+func (ctx *Context) signer() sign.Signer {
+	if ctx.SigningKey != "" {
+		return &sign.KeySigner{KeyFile: ctx.SigningKey, Passphrase: ctx.SigningPassphrase}
+	}
+
+	return ctx.Signer
+}
+
 // WithUseProot sets whether or not proot should be used.
 func WithUseProot(useProot bool) Option {
 	return func(ctx *Context) error {
@@ -362,6 +494,111 @@ func WithBinShOverlay(binShOverlay string) Option {
 	}
 }
 
+// WithRunner sets the runner used to run the pipelines in the build
+// environment.
+func WithRunner(runner Runner) Option {
+	return func(ctx *Context) error {
+		ctx.Runner = runner
+		return nil
+	}
+}
+
+// WithCacheDir sets the directory used to cache fetched artifacts.
+func WithCacheDir(cacheDir string) Option {
+	return func(ctx *Context) error {
+		ctx.CacheDir = cacheDir
+		return nil
+	}
+}
+
+// WithFetchMirrors sets the URLs of mirrors which are tried, in order,
+// before the original location of a fetched artifact.
+func WithFetchMirrors(mirrors []string) Option {
+	return func(ctx *Context) error {
+		ctx.FetchMirrors = mirrors
+		return nil
+	}
+}
+
+// WithApkFormat sets the format of the emitted packages, which must be
+// one of ApkFormats.
+func WithApkFormat(format string) Option {
+	return func(ctx *Context) error {
+		for _, f := range ApkFormats {
+			if f == format {
+				ctx.ApkFormat = format
+				return nil
+			}
+		}
+
+		return fmt.Errorf("unsupported apk format %q, expected one of %s", format, strings.Join(ApkFormats, ", "))
+	}
+}
+
+// WithStrictCopyright sets whether packages shipping files covered by
+// no copyright entry fail to build.
+func WithStrictCopyright(strict bool) Option {
+	return func(ctx *Context) error {
+		ctx.StrictCopyright = strict
+		return nil
+	}
+}
+
+// WithEmbedSBOM sets whether the SBOM of each package is embedded in
+// the package itself, under /var/lib/db/sbom.
+func WithEmbedSBOM(embed bool) Option {
+	return func(ctx *Context) error {
+		ctx.EmbedSBOM = embed
+		return nil
+	}
+}
+
+// WithJobs sets the number of packages of the build which are scanned
+// and emitted at once.
+func WithJobs(jobs int) Option {
+	return func(ctx *Context) error {
+		if jobs < 1 {
+			return fmt.Errorf("invalid number of jobs %d, expected at least 1", jobs)
+		}
+
+		ctx.Jobs = jobs
+		return nil
+	}
+}
+
+// WithCompressionLevel sets the gzip level the data sections of the
+// packages are compressed at, from gzip.BestSpeed to
+// gzip.BestCompression, 0 selecting the default level.
+func WithCompressionLevel(level int) Option {
+	return func(ctx *Context) error {
+		if level < 0 || level > gzip.BestCompression {
+			return fmt.Errorf("invalid compression level %d, expected 0 to %d", level, gzip.BestCompression)
+		}
+
+		ctx.CompressionLevel = level
+		return nil
+	}
+}
+
+// WithParallelGzip sets whether the data sections of the packages are
+// compressed on all CPUs, in chunks compressed separately.
+func WithParallelGzip(parallel bool) Option {
+	return func(ctx *Context) error {
+		ctx.ParallelGzip = parallel
+		return nil
+	}
+}
+
+// jobs returns the number of packages processed at once, which defaults
+// to the number of CPUs.
+func (ctx *Context) jobs() int {
+	if ctx.Jobs < 1 {
+		return runtime.NumCPU()
+	}
+
+	return ctx.Jobs
+}
+
 // Load the configuration data from the build context configuration file.
 func (cfg *Configuration) Load(configFile, template string) error {
 	data, err := os.ReadFile(configFile)
@@ -377,6 +614,20 @@ func (cfg *Configuration) Load(configFile, template string) error {
 		return fmt.Errorf("unable to parse configuration file: %w", err)
 	}
 
+	// licenses end up in the index, so they are normalized for
+	// consumers evaluating them
+	for i, cp := range cfg.Package.Copyright {
+		if cp.License == "" {
+			continue
+		}
+
+		license, err := spdx.Normalize(cp.License)
+		if err != nil {
+			return fmt.Errorf("invalid license %q: %w", cp.License, err)
+		}
+		cfg.Package.Copyright[i].License = license
+	}
+
 	grp := apko_types.Group{
 		GroupName: "build",
 		GID:       1000,
@@ -441,6 +692,7 @@ func substitutionReplacements() map[string]string {
 		substitutionPackageEpoch:   "MELANGE_TEMP_REPLACEMENT_PACAKAGE_EPOCH",
 		substitutionTargetsDestdir: "MELANGE_TEMP_REPLACEMENT_DESTDIR",
 		substitutionSubPkgDir:      "MELANGE_TEMP_REPLACEMENT_SUBPKGDIR",
+		substitutionBuildArch:      "MELANGE_TEMP_REPLACEMENT_BUILD_ARCH",
 	}
 }
 
@@ -476,6 +728,12 @@ func (ctx *Context) BuildWorkspace(workspaceDir string) error {
 
 	ctx.Logger.Printf("successfully built workspace with apko")
 
+	pkgs, err := installedPackages(workspaceDir)
+	if err != nil {
+		ctx.Logger.Printf("warning: unable to list the packages of the build environment: %v", err)
+	}
+	ctx.record.packages = pkgs
+
 	return nil
 }
 
@@ -640,7 +898,7 @@ func (ctx *Context) PopulateWorkspace() error {
 	return nil
 }
 
-func (ctx *Context) BuildPackage() error {
+func (ctx *Context) BuildPackage(goctx context.Context) error {
 	ctx.Summarize()
 
 	pctx := PipelineContext{
@@ -665,6 +923,12 @@ func (ctx *Context) BuildPackage() error {
 		return fmt.Errorf("unable to build workspace: %w", err)
 	}
 
+	// apko cannot be interrupted, so check whether the build was
+	// canceled while the workspace was being built.
+	if err := goctx.Err(); err != nil {
+		return err
+	}
+
 	if err := ctx.OverlayBinSh(); err != nil {
 		return fmt.Errorf("unable to install overlay /bin/sh: %w", err)
 	}
@@ -673,10 +937,20 @@ func (ctx *Context) BuildPackage() error {
 		return fmt.Errorf("unable to populate workspace: %w", err)
 	}
 
+	cfg := ctx.RunnerConfig()
+	if err := ctx.Runner.Prepare(goctx, cfg); err != nil {
+		return fmt.Errorf("unable to prepare %s runner: %w", ctx.Runner.Name(), err)
+	}
+	defer func() {
+		if err := ctx.Runner.Teardown(cfg); err != nil {
+			ctx.Logger.Printf("warning: unable to tear down %s runner: %v", ctx.Runner.Name(), err)
+		}
+	}()
+
 	// run the main pipeline
 	ctx.Logger.Printf("running the main pipeline")
 	for _, p := range ctx.Configuration.Pipeline {
-		if err := p.Run(&pctx); err != nil {
+		if err := p.Run(goctx, &pctx); err != nil {
 			return fmt.Errorf("unable to run pipeline: %w", err)
 		}
 	}
@@ -687,54 +961,93 @@ func (ctx *Context) BuildPackage() error {
 		pctx.Subpackage = &sp
 
 		for _, p := range sp.Pipeline {
-			if err := p.Run(&pctx); err != nil {
+			if err := p.Run(goctx, &pctx); err != nil {
 				return fmt.Errorf("unable to run pipeline: %w", err)
 			}
 		}
 	}
 
-	// emit main package
-	pkg := pctx.Package
-	if err := pkg.Emit(&pctx); err != nil {
-		return fmt.Errorf("unable to emit package: %w", err)
+	if err := goctx.Err(); err != nil {
+		return err
 	}
 
-	// emit subpackages
+	pcs := []*PackageContext{pctx.Package.packageContext(&pctx)}
 	for _, sp := range ctx.Configuration.Subpackages {
-		if err := sp.Emit(&pctx); err != nil {
+		pcs = append(pcs, sp.packageContext(&pctx))
+	}
+
+	if err := ctx.emitPackages(pcs); err != nil {
+		return err
+	}
+
+	// run the tests against the emitted packages
+	if err := ctx.TestPackages(goctx); err != nil {
+		return fmt.Errorf("unable to test packages: %w", err)
+	}
+
+	return nil
+}
+
+// emitPackages emits the main package and the subpackages of the build,
+// then writes the dependency log.  The packages are emitted
+// concurrently, each of them being written the same whatever the order
+// they are emitted in.
+func (ctx *Context) emitPackages(pcs []*PackageContext) error {
+	// the dependencies of the main package and subpackages are generated
+	// together, so that they can be resolved against each other
+	if err := GenerateDependencies(pcs); err != nil {
+		return fmt.Errorf("unable to build final dependencies set: %w", err)
+	}
+
+	if err := forEachPackage(ctx.jobs(), pcs, func(_ int, pc *PackageContext) error {
+		if err := pc.EmitPackage(); err != nil {
 			return fmt.Errorf("unable to emit package: %w", err)
 		}
+		return nil
+	}); err != nil {
+		return err
 	}
 
-	return nil
+	return ctx.writeDependencyLog()
 }
 
 func (ctx *Context) Summarize() {
 	ctx.Logger.Printf("melange is building:")
 	ctx.Logger.Printf("  configuration file: %s", ctx.ConfigFile)
 	ctx.Logger.Printf("  workspace dir: %s", ctx.WorkspaceDir)
+	ctx.Logger.Printf("  signing: %s", ctx.signingSummary())
 }
 
-func (ctx *Context) PrivilegedWorkspaceCmd(args ...string) (*exec.Cmd, error) {
-	args = append([]string{"-S", ctx.GuestDir, "-i", "1000:1000", "-b", fmt.Sprintf("%s:/home/build", ctx.WorkspaceDir), "-w", "/home/build"}, args...)
-	cmd := exec.Command("proot", args...)
-
-	return cmd, nil
+// signingSummary describes how the packages are signed, so that an
+// unintended keyless or unsigned build is visible in the build log.
+func (ctx *Context) signingSummary() string {
+	switch s := ctx.signer().(type) {
+	case nil:
+		return "none, packages will not be signed"
+	case *sign.KeySigner:
+		return fmt.Sprintf("with key %s", s.KeyFile)
+	case *sign.KeylessSigner:
+		if ca, ok := s.CA.(*sign.FulcioCA); ok {
+			return fmt.Sprintf("keyless, with certificates issued by %s", ca.URL)
+		}
+		return "keyless"
+	default:
+		return fmt.Sprintf("with signer %s", s.SignatureName())
+	}
 }
 
-func (ctx *Context) WorkspaceCmd(args ...string) (*exec.Cmd, error) {
-	baseargs := []string{
-		"--bind", ctx.GuestDir, "/",
-		"--bind", ctx.WorkspaceDir, "/home/build",
-		"--bind", "/etc/resolv.conf", "/etc/resolv.conf",
-		"--unshare-pid",
-		"--dev", "/dev",
-		"--proc", "/proc",
-		"--chdir", "/home/build",
-		"--setenv", "SOURCE_DATE_EPOCH", fmt.Sprintf("%d", ctx.SourceDateEpoch.Unix()),
+// RunnerConfig returns the configuration of the guest used to run the
+// pipelines, with the workspace mounted at /home/build.
+func (ctx *Context) RunnerConfig() *RunnerConfig {
+	return &RunnerConfig{
+		GuestDir: ctx.GuestDir,
+		WorkDir:  "/home/build",
+		Mounts: []BindMount{
+			{Source: ctx.WorkspaceDir, Destination: "/home/build"},
+			{Source: "/etc/resolv.conf", Destination: "/etc/resolv.conf"},
+		},
+		Environment: map[string]string{
+			"SOURCE_DATE_EPOCH": fmt.Sprintf("%d", ctx.SourceDateEpoch.Unix()),
+		},
 	}
-	args = append(baseargs, args...)
-	cmd := exec.Command("bwrap", args...)
-
-	return cmd, nil
 }
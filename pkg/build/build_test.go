@@ -96,6 +96,9 @@ func TestLoadConfiguration(t *testing.T) {
 		Members:   []string{"build"},
 	}}
 
+	licensed := *expected
+	licensed.Package.Copyright = []Copyright{{License: "GPL-2.0-or-later OR MIT"}}
+
 	tests := []struct {
 		description string
 		contents    string
@@ -122,6 +125,14 @@ func TestLoadConfiguration(t *testing.T) {
 			contents:    templatized,
 			template:    `{"Hello": "world"}`,
 			shouldErr:   true,
+		}, {
+			description: "normalized license",
+			contents:    defaultTemplateYaml + "  copyright:\n    - license: gpl-2.0+ or mit\n",
+			expected:    &licensed,
+		}, {
+			description: "invalid license",
+			contents:    defaultTemplateYaml + "  copyright:\n    - license: GPLv2\n",
+			shouldErr:   true,
 		},
 	}
 
@@ -152,6 +163,7 @@ func TestLoadConfiguration(t *testing.T) {
 // TODO: priyawadhwa@, it would be better to use a single map so we don't risk losing substitutions
 func TestSubstitutionReplacementMap(t *testing.T) {
 	pipelineMap := substitutionMap(&PipelineContext{
+		Context:    &Context{},
 		Package:    &Package{Name: "package"},
 		Subpackage: &Subpackage{Name: "subpackage"},
 	})
@@ -164,3 +176,56 @@ func TestSubstitutionReplacementMap(t *testing.T) {
 		}
 	}
 }
+
+func TestResolveArchitectures(t *testing.T) {
+	x86_64 := apko_types.ParseArchitecture("x86_64")
+	aarch64 := apko_types.ParseArchitecture("aarch64")
+	s390x := apko_types.ParseArchitecture("s390x")
+
+	tests := []struct {
+		description string
+		targets     []string
+		requested   []apko_types.Architecture
+		expected    []apko_types.Architecture
+	}{
+		{
+			description: "no targets, nothing requested",
+			expected:    apko_types.AllArchs,
+		}, {
+			description: "all, nothing requested",
+			targets:     []string{"all"},
+			expected:    apko_types.AllArchs,
+		}, {
+			description: "all, some requested",
+			targets:     []string{"all"},
+			requested:   []apko_types.Architecture{x86_64, s390x},
+			expected:    []apko_types.Architecture{x86_64, s390x},
+		}, {
+			description: "some targets, nothing requested",
+			targets:     []string{"x86_64", "aarch64"},
+			expected:    []apko_types.Architecture{x86_64, aarch64},
+		}, {
+			description: "some targets, intersecting request",
+			targets:     []string{"x86_64", "aarch64"},
+			requested:   []apko_types.Architecture{aarch64, s390x},
+			expected:    []apko_types.Architecture{aarch64},
+		}, {
+			description: "some targets, disjoint request",
+			targets:     []string{"x86_64"},
+			requested:   []apko_types.Architecture{s390x},
+			expected:    []apko_types.Architecture{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			pkg := Package{TargetArchitecture: test.targets}
+			actual := pkg.ResolveArchitectures(test.requested)
+			if d := cmp.Diff(test.expected, actual, cmp.Comparer(func(a, b apko_types.Architecture) bool {
+				return a == b
+			})); d != "" {
+				t.Fatalf("actual didn't match expected: %s", d)
+			}
+		})
+	}
+}
@@ -0,0 +1,220 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"runtime"
+)
+
+// parallelGzipChunkSize is the size of the chunks of data compressed
+// concurrently.
+const parallelGzipChunkSize = 1 << 20
+
+// parallelGzipDictSize is the size of the deflate window, which each
+// chunk is compressed with the end of the previous chunk as dictionary
+// for.
+const parallelGzipDictSize = 32 << 10
+
+// gzipChunk is a chunk of data being compressed.
+type gzipChunk struct {
+	done chan struct{}
+	data []byte
+	err  error
+}
+
+// compress deflates data with dict as the preceding data.  Unless it is
+// the last chunk, the deflate stream is ended by a sync flush rather
+// than a final block, so that the next chunk continues it.
+func (c *gzipChunk) compress(data, dict []byte, level int, last bool) {
+	defer close(c.done)
+
+	var buf bytes.Buffer
+	fw, err := flate.NewWriterDict(&buf, level, dict)
+	if err != nil {
+		c.err = err
+		return
+	}
+
+	if _, err := fw.Write(data); err != nil {
+		c.err = err
+		return
+	}
+
+	if last {
+		err = fw.Close()
+	} else {
+		err = fw.Flush()
+	}
+	if err != nil {
+		c.err = err
+		return
+	}
+
+	c.data = buf.Bytes()
+}
+
+// parallelGzipWriter compresses the data written to it to a single gzip
+// member, deflating chunks of parallelGzipChunkSize bytes concurrently,
+// with up to parallel chunks compressed at once, as pigz does.  apk-tools
+// 2 ends a section of a package at the end of each gzip member, so the
+// data section cannot be split into several members.  The chunks do not
+// depend on how the data is written, so that the output is the same
+// whatever the number of CPUs.
+type parallelGzipWriter struct {
+	w        io.Writer
+	level    int
+	parallel int
+	buf      []byte
+	dict     []byte
+	inflight []*gzipChunk
+
+	wroteHeader bool
+	crc         uint32
+	size        uint32
+}
+
+func newParallelGzipWriter(w io.Writer, level, parallel int) *parallelGzipWriter {
+	if parallel < 1 {
+		parallel = 1
+	}
+
+	return &parallelGzipWriter{
+		w:        w,
+		level:    level,
+		parallel: parallel,
+		buf:      make([]byte, 0, parallelGzipChunkSize),
+	}
+}
+
+func (z *parallelGzipWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := copy(z.buf[len(z.buf):cap(z.buf)], p)
+		z.buf = z.buf[:len(z.buf)+n]
+		z.crc = crc32.Update(z.crc, crc32.IEEETable, p[:n])
+		z.size += uint32(n)
+		p = p[n:]
+		written += n
+
+		if len(z.buf) == cap(z.buf) {
+			if err := z.startChunk(false); err != nil {
+				return written, err
+			}
+		}
+	}
+
+	return written, nil
+}
+
+// startChunk starts compressing the buffered data, first writing out
+// the oldest chunk if as many as allowed are in flight.
+func (z *parallelGzipWriter) startChunk(last bool) error {
+	if len(z.inflight) == z.parallel {
+		if err := z.writeChunk(); err != nil {
+			return err
+		}
+	}
+
+	c := &gzipChunk{done: make(chan struct{})}
+	go c.compress(z.buf, z.dict, z.level, last)
+	z.inflight = append(z.inflight, c)
+
+	// the buffer is not reused, so the dictionary can refer to it
+	z.dict = z.buf
+	if len(z.dict) > parallelGzipDictSize {
+		z.dict = z.dict[len(z.dict)-parallelGzipDictSize:]
+	}
+	z.buf = make([]byte, 0, parallelGzipChunkSize)
+
+	return nil
+}
+
+// writeHeader writes the gzip header, without a name, comment or
+// modification time, as compress/gzip does.
+func (z *parallelGzipWriter) writeHeader() error {
+	header := [10]byte{0: 0x1f, 1: 0x8b, 2: 8, 9: 255}
+	switch z.level {
+	case gzip.BestCompression:
+		header[8] = 2
+	case gzip.BestSpeed:
+		header[8] = 4
+	}
+
+	z.wroteHeader = true
+	_, err := z.w.Write(header[:])
+	return err
+}
+
+// writeChunk waits for the oldest chunk in flight and writes it out.
+func (z *parallelGzipWriter) writeChunk() error {
+	c := z.inflight[0]
+	z.inflight = z.inflight[1:]
+
+	<-c.done
+	if c.err != nil {
+		return c.err
+	}
+
+	if !z.wroteHeader {
+		if err := z.writeHeader(); err != nil {
+			return err
+		}
+	}
+
+	_, err := z.w.Write(c.data)
+	return err
+}
+
+// Close compresses the remaining data, writes out every chunk and the
+// gzip trailer.  It does not close the underlying writer.
+func (z *parallelGzipWriter) Close() error {
+	if err := z.startChunk(true); err != nil {
+		return err
+	}
+
+	for len(z.inflight) > 0 {
+		if err := z.writeChunk(); err != nil {
+			return err
+		}
+	}
+
+	var trailer [8]byte
+	binary.LittleEndian.PutUint32(trailer[:4], z.crc)
+	binary.LittleEndian.PutUint32(trailer[4:], z.size)
+	_, err := z.w.Write(trailer[:])
+	return err
+}
+
+// newDataWriter returns a writer compressing the data section of a
+// package to w, at the compression level of the build and, if enabled,
+// on all the CPUs.
+func (ctx *Context) newDataWriter(w io.Writer) (io.WriteCloser, error) {
+	level := ctx.CompressionLevel
+	if level == 0 {
+		level = gzip.DefaultCompression
+	}
+
+	if ctx.ParallelGzip {
+		return newParallelGzipWriter(w, level, runtime.NumCPU()), nil
+	}
+
+	return gzip.NewWriterLevel(w, level)
+}
@@ -0,0 +1,188 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	apkofs "chainguard.dev/apko/pkg/fs"
+	"chainguard.dev/apko/pkg/tarball"
+	"github.com/stretchr/testify/require"
+)
+
+// testData returns n bytes of data, partly compressible.
+func testData(n int) []byte {
+	r := rand.New(rand.NewSource(1)) // nolint:gosec
+	data := make([]byte, n)
+	for i := range data {
+		if i%4 == 0 {
+			data[i] = byte(r.Intn(256))
+		} else {
+			data[i] = byte(i % 7)
+		}
+	}
+	return data
+}
+
+func TestParallelGzipWriter(t *testing.T) {
+	data := testData(3*parallelGzipChunkSize + 1234)
+
+	compress := func(parallel, writeSize int) []byte {
+		var buf bytes.Buffer
+		zw := newParallelGzipWriter(&buf, gzip.BestSpeed, parallel)
+		for p := data; len(p) > 0; {
+			n := writeSize
+			if n > len(p) {
+				n = len(p)
+			}
+			_, err := zw.Write(p[:n])
+			require.NoError(t, err)
+			p = p[n:]
+		}
+		require.NoError(t, zw.Close())
+		return buf.Bytes()
+	}
+
+	want := compress(1, 512)
+	for _, parallel := range []int{2, 8} {
+		for _, writeSize := range []int{1 << 15, 3 * parallelGzipChunkSize} {
+			require.True(t, bytes.Equal(want, compress(parallel, writeSize)), "%d CPUs, %d byte writes", parallel, writeSize)
+		}
+	}
+
+	// the chunks are compressed to a single member
+	requireSingleGzipMember(t, data, want)
+
+	// as is data which fits in a chunk, or nothing at all
+	for _, n := range []int{0, 1234, parallelGzipChunkSize} {
+		var buf bytes.Buffer
+		zw := newParallelGzipWriter(&buf, gzip.DefaultCompression, 2)
+		_, err := zw.Write(data[:n])
+		require.NoError(t, err)
+		require.NoError(t, zw.Close())
+		requireSingleGzipMember(t, data[:n], buf.Bytes())
+	}
+}
+
+// requireSingleGzipMember checks that compressed is a single gzip
+// member holding data, as apk-tools expects of the data section.
+func requireSingleGzipMember(t *testing.T, data, compressed []byte) {
+	r := bytes.NewReader(compressed)
+	zr, err := gzip.NewReader(r)
+	require.NoError(t, err)
+	zr.Multistream(false)
+
+	got, err := io.ReadAll(zr)
+	require.NoError(t, err)
+	require.True(t, bytes.Equal(data, got), "%d bytes read back, expected %d", len(got), len(data))
+	require.Zero(t, r.Len(), "data after the first gzip member")
+}
+
+// writeTestPackage fills the workspace of the package with a directory,
+// a large file, a hardlink to it and a symlink.
+func writeTestPackage(t *testing.T, pc *PackageContext) {
+	dir := filepath.Join(pc.WorkspaceSubdir(), "usr", "share", "hello")
+	require.NoError(t, os.MkdirAll(dir, 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "data"), testData(2*parallelGzipChunkSize), 0644))
+	require.NoError(t, os.Link(filepath.Join(dir, "data"), filepath.Join(dir, "data.link")))
+	require.NoError(t, os.Symlink("data", filepath.Join(dir, "data.symlink")))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "empty"), nil, 0600))
+}
+
+func TestEmitDataSectionMatchesTarball(t *testing.T) {
+	pc := &PackageContext{
+		Context:     &Context{WorkspaceDir: t.TempDir(), SourceDateEpoch: time.Unix(1234, 0), ParallelGzip: true},
+		PackageName: "hello",
+		Logger:      log.New(io.Discard, "", 0),
+	}
+	writeTestPackage(t, pc)
+	fsys := apkofs.DirFS(pc.WorkspaceSubdir())
+
+	// the data section holds the tarball apko writes
+	tarctx, err := tarball.NewContext(
+		tarball.WithSourceDateEpoch(pc.Context.SourceDateEpoch),
+		tarball.WithOverrideUIDGID(0, 0),
+		tarball.WithOverrideUname("root"),
+		tarball.WithOverrideGname("root"),
+		tarball.WithUseChecksums(true),
+	)
+	require.NoError(t, err)
+	var tgz bytes.Buffer
+	require.NoError(t, tarctx.WriteArchive(&tgz, fsys))
+	zr, err := gzip.NewReader(&tgz)
+	require.NoError(t, err)
+	want, err := io.ReadAll(zr)
+	require.NoError(t, err)
+
+	f, err := os.CreateTemp(t.TempDir(), "data-*.tar.gz")
+	require.NoError(t, err)
+	defer f.Close()
+	require.NoError(t, pc.emitDataSection(fsys, f))
+
+	got, err := io.ReadAll(f)
+	require.NoError(t, err)
+	requireSingleGzipMember(t, want, got)
+}
+
+func TestEmitPackageReproducible(t *testing.T) {
+	emit := func(level int, parallel bool) []byte {
+		ctx := &Context{
+			WorkspaceDir:     t.TempDir(),
+			OutDir:           t.TempDir(),
+			SourceDateEpoch:  time.Unix(0, 0),
+			CompressionLevel: level,
+			ParallelGzip:     parallel,
+		}
+		pc := &PackageContext{
+			Context:     ctx,
+			Origin:      &Package{Name: "hello", Version: "1.0"},
+			PackageName: "hello",
+			OutDir:      ctx.OutDir,
+			Logger:      log.New(io.Discard, "", 0),
+			Arch:        "x86_64",
+		}
+		writeTestPackage(t, pc)
+		require.NoError(t, pc.EmitPackage())
+
+		require.Equal(t, testData(2*parallelGzipChunkSize), readPackageFile(t, pc.Filename(), "usr/share/hello/data"))
+
+		data, err := os.ReadFile(pc.Filename())
+		require.NoError(t, err)
+		return data
+	}
+
+	sizes := map[int]int{}
+	for _, level := range []int{0, gzip.BestSpeed, gzip.BestCompression} {
+		for _, parallel := range []bool{false, true} {
+			t.Run(fmt.Sprintf("level %d parallel %v", level, parallel), func(t *testing.T) {
+				first := emit(level, parallel)
+				require.True(t, bytes.Equal(first, emit(level, parallel)))
+				if !parallel {
+					sizes[level] = len(first)
+				}
+			})
+		}
+	}
+	require.Less(t, sizes[gzip.BestCompression], sizes[gzip.BestSpeed])
+}
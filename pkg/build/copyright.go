@@ -0,0 +1,172 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// licensesDir is where the attestations of a package are installed.
+const licensesDir = "usr/share/licenses"
+
+// Covers returns whether the copyright entry applies to the file at
+// name, relative to the root of the package.  Each of its paths is a
+// glob matched against the file and each of its parent directories, so
+// that a directory covers everything below it; an entry without paths
+// covers every file.
+func (cp Copyright) Covers(name string) (bool, error) {
+	if len(cp.Paths) == 0 {
+		return true, nil
+	}
+
+	name = strings.Trim(name, "/")
+	for _, pattern := range cp.Paths {
+		pattern = strings.Trim(pattern, "/")
+
+		for p := name; p != "." && p != ""; p = path.Dir(p) {
+			ok, err := path.Match(pattern, p)
+			if err != nil {
+				return false, fmt.Errorf("invalid copyright path %q: %w", pattern, err)
+			}
+			if ok {
+				return true, nil
+			}
+		}
+	}
+
+	return false, nil
+}
+
+// licenseExpression returns the SPDX license expression combining the
+// licenses of the copyright entries, or the empty string if none has a
+// license.
+func licenseExpression(copyrights []Copyright) string {
+	licenses := []string{}
+	seen := map[string]bool{}
+	for _, cp := range copyrights {
+		if cp.License == "" || seen[cp.License] {
+			continue
+		}
+		seen[cp.License] = true
+		licenses = append(licenses, cp.License)
+	}
+
+	if len(licenses) > 1 {
+		for i, l := range licenses {
+			if strings.Contains(l, " ") && !strings.HasPrefix(l, "(") {
+				licenses[i] = "(" + l + ")"
+			}
+		}
+	}
+
+	return strings.Join(licenses, " AND ")
+}
+
+// applyCopyright matches the copyright entries of the origin package
+// against the files of the package, computing the license of the package and
+// of each of its files, then installs the attestations of the matching
+// entries in the package.  Files covered by no entry are an error in
+// strict mode.
+func (pc *PackageContext) applyCopyright() error {
+	pc.Copyright = []Copyright{}
+	pc.fileLicenses = map[string]string{}
+
+	matched := make([]bool, len(pc.Origin.Copyright))
+	uncovered := []string{}
+	files := 0
+
+	for _, f := range pc.files {
+		if f.mode.IsDir() {
+			continue
+		}
+		files++
+
+		covering := []Copyright{}
+		for i, cp := range pc.Origin.Copyright {
+			ok, err := cp.Covers(f.path)
+			if err != nil {
+				return fmt.Errorf("unable to match copyright paths: %w", err)
+			}
+			if ok {
+				matched[i] = true
+				covering = append(covering, cp)
+			}
+		}
+
+		if len(covering) == 0 {
+			uncovered = append(uncovered, "/"+f.path)
+			continue
+		}
+
+		pc.fileLicenses[f.path] = licenseExpression(covering)
+	}
+
+	for i, cp := range pc.Origin.Copyright {
+		// a package without files, such as a metapackage, is
+		// licensed like its origin
+		if matched[i] || files == 0 {
+			pc.Copyright = append(pc.Copyright, cp)
+		}
+	}
+	pc.License = licenseExpression(pc.Copyright)
+
+	if len(uncovered) > 0 {
+		if pc.Context.StrictCopyright {
+			return fmt.Errorf("files not covered by any copyright entry: %s", strings.Join(uncovered, ", "))
+		}
+		pc.Logger.Printf("WARNING: %d files not covered by any copyright entry", len(uncovered))
+	}
+
+	return pc.installAttestations()
+}
+
+// installAttestations writes the attestations of the copyright entries
+// of the package to /usr/share/licenses/<package>/copyright.
+func (pc *PackageContext) installAttestations() error {
+	var sb strings.Builder
+	for _, cp := range pc.Copyright {
+		if cp.Attestation == "" {
+			continue
+		}
+
+		if sb.Len() > 0 {
+			sb.WriteString("\n")
+		}
+		sb.WriteString(strings.TrimRight(cp.Attestation, "\n"))
+		sb.WriteString("\n")
+		if cp.License != "" {
+			fmt.Fprintf(&sb, "License: %s\n", cp.License)
+		}
+	}
+
+	if sb.Len() == 0 {
+		return nil
+	}
+
+	dir := filepath.Join(pc.WorkspaceSubdir(), licensesDir, pc.PackageName)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("unable to create licenses directory: %w", err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "copyright"), []byte(sb.String()), 0644); err != nil {
+		return fmt.Errorf("unable to install copyright attestation: %w", err)
+	}
+
+	return pc.addFile(path.Join(licensesDir, pc.PackageName, "copyright"))
+}
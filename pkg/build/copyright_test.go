@@ -0,0 +1,107 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCopyrightCovers(t *testing.T) {
+	for _, tt := range []struct {
+		paths []string
+		name  string
+		want  bool
+	}{
+		{nil, "usr/bin/hello", true},
+		{[]string{"*"}, "usr/bin/hello", true},
+		{[]string{"usr/bin/*"}, "usr/bin/hello", true},
+		{[]string{"/usr/share/doc/"}, "usr/share/doc/hello/README", true},
+		{[]string{"usr/share/doc/*"}, "usr/share/doc/hello/README", true},
+		{[]string{"usr/lib/*.so*"}, "usr/lib/libhello.so.1", true},
+		{[]string{"usr/lib/*.so*"}, "usr/lib/libhello.a", false},
+		{[]string{"usr/share"}, "usr/bin/hello", false},
+		{[]string{"bin"}, "usr/bin/hello", false},
+	} {
+		got, err := Copyright{Paths: tt.paths}.Covers(tt.name)
+		require.NoError(t, err)
+		require.Equal(t, tt.want, got, "%v covers %s", tt.paths, tt.name)
+	}
+
+	_, err := Copyright{Paths: []string{"usr/["}}.Covers("usr/bin")
+	require.Error(t, err)
+}
+
+func TestLicenseExpression(t *testing.T) {
+	require.Equal(t, "", licenseExpression(nil))
+	require.Equal(t, "MIT OR Apache-2.0", licenseExpression([]Copyright{{License: "MIT OR Apache-2.0"}}))
+	require.Equal(t, "GPL-2.0-only AND (MIT OR Apache-2.0)", licenseExpression([]Copyright{
+		{License: "GPL-2.0-only"},
+		{License: "MIT OR Apache-2.0"},
+		{License: "GPL-2.0-only"},
+		{Attestation: "no license"},
+	}))
+}
+
+func TestEmitPackageCopyright(t *testing.T) {
+	newContext := func(strict bool) *PackageContext {
+		ctx := &Context{
+			WorkspaceDir:    t.TempDir(),
+			OutDir:          t.TempDir(),
+			SourceDateEpoch: time.Unix(0, 0),
+			StrictCopyright: strict,
+		}
+		pc := &PackageContext{
+			Context: ctx,
+			Origin: &Package{Name: "hello", Version: "1.0", Copyright: []Copyright{
+				{Paths: []string{"usr/bin/*"}, License: "GPL-3.0-or-later", Attestation: "Copyright Hello Authors\n"},
+				{Paths: []string{"usr/share/doc"}, License: "CC-BY-4.0"},
+				{Paths: []string{"usr/lib/*"}, License: "MIT", Attestation: "Copyright Library Authors"},
+			}},
+			PackageName: "hello",
+			OutDir:      ctx.OutDir,
+			Logger:      log.New(io.Discard, "", 0),
+			Arch:        "x86_64",
+		}
+
+		for _, name := range []string{"usr/bin/hello", "usr/share/doc/hello/README", "etc/hello.conf"} {
+			require.NoError(t, os.MkdirAll(filepath.Join(pc.WorkspaceSubdir(), filepath.Dir(name)), 0755))
+			require.NoError(t, os.WriteFile(filepath.Join(pc.WorkspaceSubdir(), name), []byte(name), 0644))
+		}
+
+		return pc
+	}
+
+	pc := newContext(false)
+	require.NoError(t, pc.EmitPackage())
+
+	// Only the entries matching files of the package apply to it.
+	pkginfo := string(readPackageFile(t, pc.Filename(), ".PKGINFO"))
+	require.Contains(t, pkginfo, "\nlicense = GPL-3.0-or-later AND CC-BY-4.0\n")
+	require.Equal(t, 1, strings.Count(pkginfo, "license ="))
+
+	attestation := readPackageFile(t, pc.Filename(), "usr/share/licenses/hello/copyright")
+	require.Equal(t, "Copyright Hello Authors\nLicense: GPL-3.0-or-later\n", string(attestation))
+
+	pc = newContext(true)
+	require.EqualError(t, pc.EmitPackage(), "files not covered by any copyright entry: /etc/hello.conf")
+}
@@ -0,0 +1,147 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// GeneratedDependency is a dependency generated for a package, with the
+// file which caused it and the generator which produced it.
+type GeneratedDependency struct {
+	Dependency string `json:"dependency"`
+	Path       string `json:"path"`
+	Generator  string `json:"generator"`
+}
+
+// DependencyReport holds the dependencies generated for a package.
+type DependencyReport struct {
+	Runtime  []GeneratedDependency `json:"runtime"`
+	Provides []GeneratedDependency `json:"provides"`
+
+	// SymbolVersions are the GNU symbol versions the files of the
+	// package require from shared objects, which are not dependencies
+	// of the package.
+	SymbolVersions []GeneratedDependency `json:"symbol-versions"`
+}
+
+// addRuntime adds a runtime dependency generated because of the file at
+// path to generated, and records it in the dependency report.
+func (pc *PackageContext) addRuntime(generated *Dependencies, dep, path string) {
+	generated.Runtime = append(generated.Runtime, dep)
+
+	report := pc.dependencyReport()
+	report.Runtime = append(report.Runtime, GeneratedDependency{Dependency: dep, Path: path, Generator: pc.generator})
+}
+
+// addProvides adds a virtual provided because of the file at path to
+// generated, and records it in the dependency report.
+func (pc *PackageContext) addProvides(generated *Dependencies, dep, path string) {
+	generated.Provides = append(generated.Provides, dep)
+
+	report := pc.dependencyReport()
+	report.Provides = append(report.Provides, GeneratedDependency{Dependency: dep, Path: path, Generator: pc.generator})
+}
+
+// addSymbolVersion records in the dependency report that the file at
+// path requires a symbol version of a shared object.
+func (pc *PackageContext) addSymbolVersion(req, path string) {
+	report := pc.dependencyReport()
+	report.SymbolVersions = append(report.SymbolVersions, GeneratedDependency{Dependency: req, Path: path, Generator: pc.generator})
+}
+
+// dependencyReport returns the dependency report of the package, which
+// is part of the dependency log of the build.
+func (pc *PackageContext) dependencyReport() *DependencyReport {
+	if pc.Context.dependencies == nil {
+		pc.Context.dependencies = map[string]*DependencyReport{}
+	}
+
+	report, ok := pc.Context.dependencies[pc.PackageName]
+	if !ok {
+		report = &DependencyReport{Runtime: []GeneratedDependency{}, Provides: []GeneratedDependency{}, SymbolVersions: []GeneratedDependency{}}
+		pc.Context.dependencies[pc.PackageName] = report
+	}
+
+	return report
+}
+
+// DependencyLogFilename returns the path of the dependency log of the
+// build, if one was requested.
+func (ctx *Context) DependencyLogFilename() string {
+	return fmt.Sprintf("%s.%s", ctx.DependencyLog, ctx.Arch.ToAPK())
+}
+
+// writeDependencyLog writes the dependency reports of all the packages
+// of the build, keyed by package name.  The log is replaced atomically,
+// so that it is never seen partially written.
+func (ctx *Context) writeDependencyLog() error {
+	if ctx.DependencyLog == "" {
+		return nil
+	}
+
+	for _, report := range ctx.dependencies {
+		for _, deps := range [][]GeneratedDependency{report.Runtime, report.Provides, report.SymbolVersions} {
+			sort.SliceStable(deps, func(i, j int) bool {
+				if deps[i].Dependency != deps[j].Dependency {
+					return deps[i].Dependency < deps[j].Dependency
+				}
+				return deps[i].Path < deps[j].Path
+			})
+		}
+	}
+
+	reports := ctx.dependencies
+	if reports == nil {
+		reports = map[string]*DependencyReport{}
+	}
+
+	data, err := json.MarshalIndent(reports, "", "  ")
+	if err != nil {
+		return fmt.Errorf("unable to encode dependency log: %w", err)
+	}
+
+	filename := ctx.DependencyLogFilename()
+	tmp, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".*")
+	if err != nil {
+		return fmt.Errorf("unable to create dependency log: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("unable to write dependency log: %w", err)
+	}
+
+	if err := tmp.Chmod(0644); err != nil {
+		return fmt.Errorf("unable to write dependency log: %w", err)
+	}
+
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("unable to write dependency log: %w", err)
+	}
+
+	if err := os.Rename(tmp.Name(), filename); err != nil {
+		return fmt.Errorf("unable to write dependency log: %w", err)
+	}
+
+	ctx.Logger.Printf("wrote dependency log %s", filename)
+
+	return nil
+}
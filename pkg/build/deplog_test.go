@@ -0,0 +1,89 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	apko_types "chainguard.dev/apko/pkg/build/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDependencyLog(t *testing.T) {
+	logDir := t.TempDir()
+	ctx := &Context{
+		WorkspaceDir:    t.TempDir(),
+		OutDir:          t.TempDir(),
+		SourceDateEpoch: time.Unix(0, 0),
+		Arch:            apko_types.ParseArchitecture("x86_64"),
+		DependencyLog:   filepath.Join(logDir, "deps.json"),
+		Logger:          log.New(io.Discard, "", 0),
+	}
+
+	for _, name := range []string{"hello", "hello-tools"} {
+		pc := &PackageContext{
+			Context:     ctx,
+			Origin:      &Package{Name: "hello", Version: "1.0"},
+			PackageName: name,
+			OutDir:      ctx.OutDir,
+			Logger:      log.New(io.Discard, "", 0),
+			Arch:        ctx.Arch.ToAPK(),
+		}
+
+		bin := filepath.Join(pc.WorkspaceSubdir(), "usr", "bin")
+		require.NoError(t, os.MkdirAll(bin, 0755))
+		if name == "hello-tools" {
+			for _, cmd := range []string{"hello-b", "hello-a"} {
+				require.NoError(t, os.WriteFile(filepath.Join(bin, cmd), []byte("#!/bin/sh\n"), 0755))
+			}
+		}
+
+		require.NoError(t, pc.EmitPackage())
+	}
+
+	require.NoError(t, ctx.writeDependencyLog())
+	require.Equal(t, filepath.Join(logDir, "deps.json.x86_64"), ctx.DependencyLogFilename())
+
+	data, err := os.ReadFile(ctx.DependencyLogFilename())
+	require.NoError(t, err)
+
+	var reports map[string]DependencyReport
+	require.NoError(t, json.Unmarshal(data, &reports))
+	require.Equal(t, map[string]DependencyReport{
+		"hello": {Runtime: []GeneratedDependency{}, Provides: []GeneratedDependency{}, SymbolVersions: []GeneratedDependency{}},
+		"hello-tools": {
+			Runtime: []GeneratedDependency{
+				{Dependency: "cmd:sh", Path: "usr/bin/hello-a", Generator: "shebangs"},
+				{Dependency: "cmd:sh", Path: "usr/bin/hello-b", Generator: "shebangs"},
+			},
+			Provides: []GeneratedDependency{
+				{Dependency: "cmd:hello-a=1.0-r0", Path: "usr/bin/hello-a", Generator: "commands"},
+				{Dependency: "cmd:hello-b=1.0-r0", Path: "usr/bin/hello-b", Generator: "commands"},
+			},
+			SymbolVersions: []GeneratedDependency{},
+		},
+	}, reports)
+
+	// Nothing is left behind next to the log.
+	entries, err := os.ReadDir(logDir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+}
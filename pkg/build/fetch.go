@@ -0,0 +1,486 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/ulikunitz/xz"
+)
+
+// fetchPipeline downloads an artifact on the host into a cache keyed by
+// its SHA-256 digest and places it, optionally extracted, into the
+// workspace.  Running on the host means the guest does not need a
+// download tool, and that artifacts which have been fetched once are
+// available to later and offline builds.
+var fetchPipeline = builtinPipeline{
+	Name: "fetch",
+	Inputs: map[string]Input{
+		"uri": {
+			Description: "The URI to fetch as an artifact.",
+			Required:    true,
+		},
+		"expected-sha256": {
+			Description: "The expected SHA256 of the downloaded artifact.",
+			Required:    true,
+		},
+		"strip-components": {
+			Description: "The number of path components to strip while extracting.",
+			Default:     "1",
+		},
+		"extract": {
+			Description: "Whether to extract the downloaded artifact as a source tarball.",
+			Default:     "true",
+		},
+	},
+	Run: runFetch,
+}
+
+func runFetch(goctx context.Context, ctx *PipelineContext, p *Pipeline) error {
+	uri := p.With["${{inputs.uri}}"]
+	digest := strings.ToLower(p.With["${{inputs.expected-sha256}}"])
+	if b, err := hex.DecodeString(digest); err != nil || len(b) != sha256.Size {
+		return fmt.Errorf("expected-sha256 %q is not a SHA256 digest", digest)
+	}
+
+	strip, err := strconv.Atoi(p.With["${{inputs.strip-components}}"])
+	if err != nil || strip < 0 {
+		return fmt.Errorf("strip-components %q is not a non-negative number", p.With["${{inputs.strip-components}}"])
+	}
+
+	cached, err := ctx.Context.fetchToCache(goctx, p, uri, digest)
+	if err != nil {
+		return err
+	}
+	ctx.Context.recordMaterial(uri, digest)
+
+	// The artifact is placed in the workspace under its own name, as
+	// a build may refer to it.
+	name := fetchName(uri)
+	if err := placeArtifact(cached, filepath.Join(ctx.Context.WorkspaceDir, name)); err != nil {
+		return fmt.Errorf("unable to copy %s into the workspace: %w", name, err)
+	}
+
+	if p.With["${{inputs.extract}}"] != "true" {
+		return nil
+	}
+
+	p.logger.Printf("extracting %s", name)
+	if err := extractArchive(cached, ctx.Context.WorkspaceDir, strip); err != nil {
+		return fmt.Errorf("unable to extract %s: %w", name, err)
+	}
+
+	return nil
+}
+
+// fetchName returns the file name of the artifact at uri, which is also
+// the name it is looked up with on mirrors.
+func fetchName(uri string) string {
+	if u, err := url.Parse(uri); err == nil && u.Path != "" {
+		return path.Base(u.Path)
+	}
+
+	return path.Base(uri)
+}
+
+// fetchToCache returns the path of the artifact with the given digest
+// in the cache, fetching it from the mirrors or from uri if it is not
+// cached yet.
+func (ctx *Context) fetchToCache(goctx context.Context, p *Pipeline, uri, digest string) (string, error) {
+	cacheDir := filepath.Join(ctx.CacheDir, "sha256")
+	cached := filepath.Join(cacheDir, digest)
+
+	if actual, err := fileDigest(cached); err == nil {
+		if actual == digest {
+			p.logger.Printf("using cached %s", cached)
+			return cached, nil
+		}
+
+		p.logger.Printf("warning: removing corrupted cache entry %s", cached)
+		if err := os.Remove(cached); err != nil {
+			return "", err
+		}
+	}
+
+	if err := os.MkdirAll(cacheDir, 0755); err != nil {
+		return "", fmt.Errorf("unable to create cache directory: %w", err)
+	}
+
+	sources := []string{}
+	for _, mirror := range ctx.FetchMirrors {
+		sources = append(sources, strings.TrimSuffix(mirror, "/")+"/"+fetchName(uri))
+	}
+	sources = append(sources, uri)
+
+	errs := []string{}
+	for _, source := range sources {
+		p.logger.Printf("fetching %s", source)
+
+		err := download(goctx, source, cacheDir, cached, digest)
+		if err == nil {
+			return cached, nil
+		}
+
+		// Do not try the other sources once the build is canceled.
+		if goctx.Err() != nil {
+			return "", goctx.Err()
+		}
+
+		p.logger.Printf("warning: unable to fetch %s: %v", source, err)
+		errs = append(errs, fmt.Sprintf("%s: %v", source, err))
+	}
+
+	return "", fmt.Errorf("unable to fetch %s: %s", uri, strings.Join(errs, "; "))
+}
+
+// download writes the artifact at source to dest, through a temporary
+// file in dir so that dest only ever holds an artifact with the expected
+// digest.
+func download(goctx context.Context, source, dir, dest, digest string) error {
+	r, err := openSource(goctx, source)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	f, err := os.CreateTemp(dir, filepath.Base(dest)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(f, h), r); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	if actual := hex.EncodeToString(h.Sum(nil)); actual != digest {
+		return fmt.Errorf("SHA256 mismatch: expected %s, got %s", digest, actual)
+	}
+
+	return os.Rename(f.Name(), dest)
+}
+
+// openSource opens an http, https or file URL, or a local path.
+func openSource(goctx context.Context, source string) (io.ReadCloser, error) {
+	u, err := url.Parse(source)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "":
+		return os.Open(source)
+	case "file":
+		return os.Open(u.Path)
+	case "http", "https":
+		req, err := http.NewRequestWithContext(goctx, http.MethodGet, source, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("unexpected status %s", resp.Status)
+		}
+
+		return resp.Body, nil
+	}
+
+	return nil, fmt.Errorf("unsupported URL scheme %q", u.Scheme)
+}
+
+func fileDigest(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// placeArtifact copies a cached artifact to dest.
+func placeArtifact(cached, dest string) error {
+	in, err := os.Open(cached)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	return writeExtractedFile(dest, in, 0644)
+}
+
+// extractArchive extracts the tarball, optionally compressed with gzip,
+// xz or bzip2, or zip archive in file into dest, removing the first strip
+// components from the path of each entry.  The format is detected from
+// the contents of the file rather than its name.
+func extractArchive(file, dest string, strip int) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	br := bufio.NewReader(f)
+	magic, err := br.Peek(512)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+
+	var r io.Reader
+	switch {
+	case bytes.HasPrefix(magic, []byte("PK\x03\x04")):
+		return extractZip(file, dest, strip)
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		r = zr
+	case bytes.HasPrefix(magic, []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}):
+		xr, err := xz.NewReader(br)
+		if err != nil {
+			return err
+		}
+		r = xr
+	case bytes.HasPrefix(magic, []byte("BZh")):
+		r = bzip2.NewReader(br)
+	case len(magic) >= 262 && string(magic[257:262]) == "ustar":
+		r = br
+	default:
+		return fmt.Errorf("unsupported archive format")
+	}
+
+	return extractTar(r, dest, strip)
+}
+
+func extractTar(r io.Reader, dest string, strip int) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		target, ok, err := extractTarget(dest, hdr.Name, strip)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(target, 0755)
+		case tar.TypeReg:
+			err = writeExtractedFile(target, tr, hdr.FileInfo().Mode().Perm())
+			if err == nil {
+				err = os.Chtimes(target, hdr.ModTime, hdr.ModTime)
+			}
+		case tar.TypeSymlink:
+			err = writeExtractedSymlink(target, hdr.Linkname)
+		case tar.TypeLink:
+			var source string
+			source, ok, err = extractTarget(dest, hdr.Linkname, strip)
+			if err == nil && !ok {
+				err = fmt.Errorf("hardlink %s points to stripped path %s", hdr.Name, hdr.Linkname)
+			}
+			if err == nil {
+				os.Remove(target)
+				err = os.Link(source, target)
+			}
+		default:
+			// Devices, FIFOs and global headers cannot be
+			// meaningfully extracted into a workspace.
+			continue
+		}
+
+		if err != nil {
+			return fmt.Errorf("unable to extract %s: %w", hdr.Name, err)
+		}
+	}
+}
+
+func extractZip(file, dest string, strip int) error {
+	zr, err := zip.OpenReader(file)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+
+	for _, zf := range zr.File {
+		target, ok, err := extractTarget(dest, zf.Name, strip)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+
+		if err := extractZipFile(zf, target); err != nil {
+			return fmt.Errorf("unable to extract %s: %w", zf.Name, err)
+		}
+	}
+
+	return nil
+}
+
+func extractZipFile(zf *zip.File, target string) error {
+	mode := zf.Mode()
+	if mode.IsDir() {
+		return os.MkdirAll(target, 0755)
+	}
+
+	r, err := zf.Open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	if mode&os.ModeSymlink != 0 {
+		linkname, err := io.ReadAll(r)
+		if err != nil {
+			return err
+		}
+
+		return writeExtractedSymlink(target, string(linkname))
+	}
+
+	if err := writeExtractedFile(target, r, mode.Perm()); err != nil {
+		return err
+	}
+
+	return os.Chtimes(target, zf.Modified, zf.Modified)
+}
+
+// extractTarget returns the path an archive entry is extracted to, or
+// false if nothing is left of its name once the components have been
+// stripped.  Entries which would be extracted outside of dest, either
+// through their name or through a symlink extracted earlier, are an
+// error.
+func extractTarget(dest, name string, strip int) (string, bool, error) {
+	parts := []string{}
+	for _, part := range strings.Split(path.Clean("/"+name), "/") {
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+
+	if len(parts) <= strip {
+		return "", false, nil
+	}
+
+	rel := filepath.Join(parts[strip:]...)
+	target := filepath.Join(dest, rel)
+
+	// Make sure the nearest existing parent of the target, which may be
+	// a symlink extracted earlier, does not lead out of dest.
+	parent := filepath.Dir(target)
+	for parent != dest {
+		if _, err := os.Lstat(parent); err == nil {
+			break
+		}
+		parent = filepath.Dir(parent)
+	}
+
+	if parent != dest {
+		resolved, err := filepath.EvalSymlinks(parent)
+		if err != nil {
+			return "", false, err
+		}
+
+		realDest, err := filepath.EvalSymlinks(dest)
+		if err != nil {
+			return "", false, err
+		}
+
+		if resolved != realDest && !strings.HasPrefix(resolved, realDest+string(filepath.Separator)) {
+			return "", false, fmt.Errorf("%s would be extracted outside of the workspace", name)
+		}
+	}
+
+	return target, true, nil
+}
+
+func writeExtractedFile(target string, r io.Reader, perm os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+
+	// Replace rather than write through an existing file, which may
+	// be a symlink.
+	os.Remove(target)
+
+	f, err := os.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY, perm)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+func writeExtractedSymlink(target, linkname string) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+
+	os.Remove(target)
+
+	return os.Symlink(linkname, target)
+}
@@ -0,0 +1,239 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/ulikunitz/xz"
+)
+
+type testArchiveEntry struct {
+	name     string
+	linkname string
+	contents string
+}
+
+var testArchiveEntries = []testArchiveEntry{
+	{name: "hello-1.0/"},
+	{name: "hello-1.0/src/"},
+	{name: "hello-1.0/src/main.c", contents: "int main() { return 0; }\n"},
+	{name: "hello-1.0/main.c", linkname: "src/main.c"},
+}
+
+func testTarball(t *testing.T, entries []testArchiveEntry, compress func(io.Writer) io.WriteCloser) []byte {
+	var buf bytes.Buffer
+	w := compress(&buf)
+
+	tw := tar.NewWriter(w)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Mode: 0644, Size: int64(len(e.contents)), Typeflag: tar.TypeReg}
+		switch {
+		case e.linkname != "":
+			hdr.Typeflag = tar.TypeSymlink
+			hdr.Linkname = e.linkname
+		case e.name[len(e.name)-1] == '/':
+			hdr.Typeflag = tar.TypeDir
+			hdr.Mode = 0755
+		}
+
+		require.NoError(t, tw.WriteHeader(hdr))
+		_, err := tw.Write([]byte(e.contents))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	require.NoError(t, w.Close())
+
+	return buf.Bytes()
+}
+
+func testZip(t *testing.T, entries []testArchiveEntry) []byte {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+
+	for _, e := range entries {
+		fh := &zip.FileHeader{Name: e.name}
+		contents := e.contents
+		switch {
+		case e.linkname != "":
+			fh.SetMode(os.ModeSymlink | 0777)
+			contents = e.linkname
+		case e.name[len(e.name)-1] == '/':
+			fh.SetMode(os.ModeDir | 0755)
+		default:
+			fh.SetMode(0644)
+		}
+
+		w, err := zw.CreateHeader(fh)
+		require.NoError(t, err)
+		_, err = w.Write([]byte(contents))
+		require.NoError(t, err)
+	}
+	require.NoError(t, zw.Close())
+
+	return buf.Bytes()
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// writeTestArtifact writes data into dir and returns its path and digest.
+func writeTestArtifact(t *testing.T, dir, name string, data []byte) (string, string) {
+	f := filepath.Join(dir, name)
+	require.NoError(t, os.WriteFile(f, data, 0644))
+
+	sum := sha256.Sum256(data)
+	return f, hex.EncodeToString(sum[:])
+}
+
+func runTestFetch(ctx *Context, with map[string]string) error {
+	p := Pipeline{Uses: "fetch", With: with}
+	return p.Run(context.Background(), &PipelineContext{
+		Context: ctx,
+		Package: &Package{Name: "hello", Version: "1.0"},
+	})
+}
+
+func TestFetchExtract(t *testing.T) {
+	tests := []struct {
+		name string
+		data func(t *testing.T) []byte
+	}{{
+		name: "hello-1.0.tar",
+		data: func(t *testing.T) []byte {
+			return testTarball(t, testArchiveEntries, func(w io.Writer) io.WriteCloser { return nopWriteCloser{w} })
+		},
+	}, {
+		name: "hello-1.0.tar.gz",
+		data: func(t *testing.T) []byte {
+			return testTarball(t, testArchiveEntries, func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) })
+		},
+	}, {
+		name: "hello-1.0.tar.xz",
+		data: func(t *testing.T) []byte {
+			return testTarball(t, testArchiveEntries, func(w io.Writer) io.WriteCloser {
+				xw, err := xz.NewWriter(w)
+				require.NoError(t, err)
+				return xw
+			})
+		},
+	}, {
+		name: "hello-1.0.zip",
+		data: func(t *testing.T) []byte {
+			return testZip(t, testArchiveEntries)
+		},
+	}}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			artifact, digest := writeTestArtifact(t, t.TempDir(), test.name, test.data(t))
+			ctx := &Context{WorkspaceDir: t.TempDir(), CacheDir: t.TempDir()}
+
+			require.NoError(t, runTestFetch(ctx, map[string]string{
+				"uri":             "file://" + artifact,
+				"expected-sha256": digest,
+			}))
+
+			data, err := os.ReadFile(filepath.Join(ctx.WorkspaceDir, "src", "main.c"))
+			require.NoError(t, err)
+			require.Equal(t, "int main() { return 0; }\n", string(data))
+
+			link, err := os.Readlink(filepath.Join(ctx.WorkspaceDir, "main.c"))
+			require.NoError(t, err)
+			require.Equal(t, "src/main.c", link)
+
+			require.FileExists(t, filepath.Join(ctx.WorkspaceDir, test.name))
+			require.FileExists(t, filepath.Join(ctx.CacheDir, "sha256", digest))
+		})
+	}
+}
+
+func TestFetchCacheAndMirror(t *testing.T) {
+	data := testTarball(t, testArchiveEntries, func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) })
+	mirror := t.TempDir()
+	artifact, digest := writeTestArtifact(t, mirror, "hello-1.0.tar.gz", data)
+
+	cacheDir := t.TempDir()
+	with := func() map[string]string {
+		return map[string]string{
+			"uri":              "https://example.invalid/releases/hello-${{package.version}}.tar.gz",
+			"expected-sha256":  digest,
+			"strip-components": "0",
+			"extract":          "false",
+		}
+	}
+
+	// The original location cannot be resolved, so the artifact can only
+	// come from the mirror.
+	ctx := &Context{WorkspaceDir: t.TempDir(), CacheDir: cacheDir, FetchMirrors: []string{"file://" + mirror}}
+	require.NoError(t, runTestFetch(ctx, with()))
+	require.FileExists(t, filepath.Join(ctx.WorkspaceDir, "hello-1.0.tar.gz"))
+	require.NoFileExists(t, filepath.Join(ctx.WorkspaceDir, "src", "main.c"))
+
+	// Once cached, the artifact is available without any source.
+	require.NoError(t, os.Remove(artifact))
+	ctx = &Context{WorkspaceDir: t.TempDir(), CacheDir: cacheDir}
+	require.NoError(t, runTestFetch(ctx, with()))
+	require.FileExists(t, filepath.Join(ctx.WorkspaceDir, "hello-1.0.tar.gz"))
+}
+
+func TestFetchDigestMismatch(t *testing.T) {
+	artifact, _ := writeTestArtifact(t, t.TempDir(), "hello-1.0.tar.gz", []byte("not the expected contents"))
+	digest := hex.EncodeToString(make([]byte, sha256.Size))
+
+	ctx := &Context{WorkspaceDir: t.TempDir(), CacheDir: t.TempDir()}
+	err := runTestFetch(ctx, map[string]string{
+		"uri":             "file://" + artifact,
+		"expected-sha256": digest,
+	})
+	require.ErrorContains(t, err, "SHA256 mismatch")
+
+	entries, err := os.ReadDir(filepath.Join(ctx.CacheDir, "sha256"))
+	require.NoError(t, err)
+	require.Empty(t, entries)
+}
+
+func TestFetchExtractOutsideWorkspace(t *testing.T) {
+	outside := t.TempDir()
+	data := testTarball(t, []testArchiveEntry{
+		{name: "hello-1.0/escape", linkname: outside},
+		{name: "hello-1.0/escape/evil", contents: "evil"},
+	}, func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) })
+	artifact, digest := writeTestArtifact(t, t.TempDir(), "hello-1.0.tar.gz", data)
+
+	ctx := &Context{WorkspaceDir: t.TempDir(), CacheDir: t.TempDir()}
+	err := runTestFetch(ctx, map[string]string{
+		"uri":             "file://" + artifact,
+		"expected-sha256": digest,
+	})
+	require.ErrorContains(t, err, "outside of the workspace")
+	require.NoFileExists(t, filepath.Join(outside, "evil"))
+}
@@ -0,0 +1,101 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// packageFile is an entry of the filesystem of a package.
+type packageFile struct {
+	path string
+	mode fs.FileMode
+	size int64
+}
+
+// walkFiles walks the filesystem of the package, recording its entries
+// in walk order.  The filesystem is walked once per package: the
+// entries feed the dependency generators, the copyright matching, the
+// SBOM and the installed size.
+func (pc *PackageContext) walkFiles(fsys fs.FS) error {
+	files := []packageFile{}
+	if err := fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		files = append(files, packageFile{path: path, mode: fi.Mode(), size: fi.Size()})
+		return nil
+	}); err != nil {
+		return fmt.Errorf("unable to walk package data: %w", err)
+	}
+
+	pc.files = files
+	return nil
+}
+
+// addFile records the entry at name, and any of its parent directories
+// not recorded yet, once it was installed in the package after its
+// filesystem was walked.
+func (pc *PackageContext) addFile(name string) error {
+	known := map[string]bool{}
+	for _, f := range pc.files {
+		known[f.path] = true
+	}
+
+	for p := name; p != "." && !known[p]; p = path.Dir(p) {
+		fi, err := os.Lstat(filepath.Join(pc.WorkspaceSubdir(), filepath.FromSlash(p)))
+		if err != nil {
+			return fmt.Errorf("unable to stat %s: %w", p, err)
+		}
+
+		pc.files = append(pc.files, packageFile{path: p, mode: fi.Mode(), size: fi.Size()})
+	}
+
+	sort.SliceStable(pc.files, func(i, j int) bool {
+		return walkOrderLess(pc.files[i].path, pc.files[j].path)
+	})
+
+	return nil
+}
+
+// walkOrderLess returns whether fs.WalkDir visits a before b: the root
+// first, and then the entries of each directory in lexical order, each
+// followed by its own entries.
+func walkOrderLess(a, b string) bool {
+	if a == "." || b == "." {
+		return a == "." && b != "."
+	}
+
+	as, bs := strings.Split(a, "/"), strings.Split(b, "/")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		if as[i] != bs[i] {
+			return as[i] < bs[i]
+		}
+	}
+
+	return len(as) < len(bs)
+}
@@ -0,0 +1,69 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWalkOrderLess(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a/b/c", "a-b", "a.b/c", "ab", "b/a"} {
+		p := filepath.Join(dir, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(p), 0755))
+		require.NoError(t, os.WriteFile(p, nil, 0644))
+	}
+
+	walked := []string{}
+	require.NoError(t, fs.WalkDir(os.DirFS(dir), ".", func(path string, d fs.DirEntry, err error) error {
+		walked = append(walked, path)
+		return err
+	}))
+
+	sorted := []string{}
+	for i := len(walked) - 1; i >= 0; i-- {
+		sorted = append(sorted, walked[i])
+	}
+	sort.Slice(sorted, func(i, j int) bool { return walkOrderLess(sorted[i], sorted[j]) })
+	require.Equal(t, walked, sorted)
+}
+
+func TestAddFile(t *testing.T) {
+	pc := &PackageContext{
+		Context:     &Context{WorkspaceDir: t.TempDir()},
+		PackageName: "hello",
+	}
+
+	require.NoError(t, os.MkdirAll(filepath.Join(pc.WorkspaceSubdir(), "usr", "bin"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(pc.WorkspaceSubdir(), "usr", "bin", "hello"), []byte("hello"), 0755))
+	require.NoError(t, pc.walkFiles(os.DirFS(pc.WorkspaceSubdir())))
+
+	require.NoError(t, os.MkdirAll(filepath.Join(pc.WorkspaceSubdir(), "usr", "share", "hello"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(pc.WorkspaceSubdir(), "usr", "share", "hello", "data"), []byte("data"), 0644))
+	require.NoError(t, pc.addFile("usr/share/hello/data"))
+
+	paths := []string{}
+	for _, f := range pc.files {
+		paths = append(paths, f.path)
+	}
+	require.Equal(t, []string{".", "usr", "usr/bin", "usr/bin/hello", "usr/share", "usr/share/hello", "usr/share/hello/data"}, paths)
+	require.Equal(t, int64(4), pc.files[len(pc.files)-1].size)
+}
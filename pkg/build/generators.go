@@ -0,0 +1,355 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"regexp"
+	"strings"
+
+	apkofs "chainguard.dev/apko/pkg/fs"
+)
+
+// readHead returns up to n bytes from the start of a file.
+func readHead(fsys fs.FS, name string, n int64) ([]byte, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return io.ReadAll(io.LimitReader(f, n))
+}
+
+// shebangInterpreter returns the name of the command interpreting a
+// script, from its shebang line, or the empty string if it has none.
+// Scripts run through env are interpreted by the command env runs.
+func shebangInterpreter(head []byte) string {
+	if !bytes.HasPrefix(head, []byte("#!")) {
+		return ""
+	}
+
+	line := head[2:]
+	if i := bytes.IndexByte(line, '\n'); i >= 0 {
+		line = line[:i]
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) == 0 {
+		return ""
+	}
+
+	interpreter := fields[0]
+	if path.Base(interpreter) == "env" {
+		interpreter = ""
+		for _, arg := range fields[1:] {
+			// skip the options of env, such as -S, and variable
+			// assignments
+			if strings.HasPrefix(arg, "-") || strings.Contains(arg, "=") {
+				continue
+			}
+			interpreter = arg
+			break
+		}
+	}
+
+	if interpreter == "" {
+		return ""
+	}
+	return path.Base(interpreter)
+}
+
+// providesCommand returns whether the package ships a command named
+// name in one of the directories commands are provided from.
+func providesCommand(fsys fs.FS, name string) bool {
+	for _, dir := range cmdPrefixes {
+		if _, err := fs.Stat(fsys, path.Join(dir, name)); err == nil {
+			return true
+		}
+	}
+
+	return false
+}
+
+// generateShebangDeps adds a cmd: dependency on the interpreter of each
+// executable script of the package, unless the package provides it.
+func generateShebangDeps(pc *PackageContext, generated *Dependencies) error {
+	if pc.Options.NoShebangs || pc.Options.NoDepends {
+		return nil
+	}
+
+	pc.Logger.Printf("scanning for script interpreters...")
+
+	fsys := apkofs.DirFS(pc.WorkspaceSubdir())
+	for _, f := range pc.files {
+		if !f.mode.IsRegular() || f.mode.Perm()&0111 == 0 {
+			continue
+		}
+
+		// the kernel only reads the first line up to this length
+		head, err := readHead(fsys, f.path, 256)
+		if err != nil {
+			return err
+		}
+
+		interpreter := shebangInterpreter(head)
+		if interpreter == "" || providesCommand(fsys, interpreter) {
+			continue
+		}
+
+		pc.addRuntime(generated, fmt.Sprintf("cmd:%s", interpreter), f.path)
+	}
+
+	return nil
+}
+
+var pkgConfigDirs = []string{"usr/lib/pkgconfig", "usr/share/pkgconfig"}
+
+var pkgConfigVarRe = regexp.MustCompile(`\$\{([^}]*)\}`)
+
+// pkgConfigModule holds the fields of a .pc file dependencies are
+// generated from.
+type pkgConfigModule struct {
+	Version  string
+	Requires []string
+}
+
+// parsePkgConfig parses a .pc file, expanding the variables it defines.
+func parsePkgConfig(r io.Reader) (*pkgConfigModule, error) {
+	vars := map[string]string{}
+	expand := func(s string) string {
+		return pkgConfigVarRe.ReplaceAllStringFunc(s, func(m string) string {
+			return vars[m[2:len(m)-1]]
+		})
+	}
+
+	mod := &pkgConfigModule{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		// keywords are followed by a colon, variables by an equal
+		// sign, whichever comes first
+		i := strings.IndexAny(line, ":=")
+		if i < 0 {
+			continue
+		}
+		key, value := strings.TrimSpace(line[:i]), expand(strings.TrimSpace(line[i+1:]))
+
+		if line[i] == '=' {
+			vars[key] = value
+			continue
+		}
+
+		switch key {
+		case "Version":
+			mod.Version = value
+		case "Requires", "Requires.private":
+			mod.Requires = append(mod.Requires, parsePkgConfigRequires(value)...)
+		}
+	}
+
+	return mod, scanner.Err()
+}
+
+// parsePkgConfigRequires returns the pc: dependencies for the modules
+// of a Requires field, such as "glib-2.0 >= 2.50, zlib".
+func parsePkgConfigRequires(value string) []string {
+	tokens := strings.Fields(strings.ReplaceAll(value, ",", " "))
+
+	deps := []string{}
+	for i := 0; i < len(tokens); i++ {
+		dep := "pc:" + tokens[i]
+
+		if i+2 < len(tokens) {
+			switch op := tokens[i+1]; op {
+			case "=", "<", ">", "<=", ">=":
+				dep += op + tokens[i+2]
+				i += 2
+			case "!=":
+				// apk cannot express this constraint
+				i += 2
+			}
+		}
+
+		deps = append(deps, dep)
+	}
+
+	return deps
+}
+
+// generatePkgConfigDeps adds a pc: virtual for each pkg-config module of
+// the package, and pc: dependencies on the modules they require which
+// the package does not provide.
+func generatePkgConfigDeps(pc *PackageContext, generated *Dependencies) error {
+	if pc.Options.NoPkgConfig {
+		return nil
+	}
+
+	pc.Logger.Printf("scanning for pkg-config modules...")
+
+	fsys := apkofs.DirFS(pc.WorkspaceSubdir())
+
+	modules := map[string]*pkgConfigModule{}
+	paths := map[string]string{}
+	names := []string{}
+	for _, dir := range pkgConfigDirs {
+		for _, pf := range pc.files {
+			match := pf.path
+			if ok, _ := path.Match(path.Join(dir, "*.pc"), match); !ok {
+				continue
+			}
+
+			f, err := fsys.Open(match)
+			if err != nil {
+				return err
+			}
+			mod, err := parsePkgConfig(f)
+			f.Close()
+			if err != nil {
+				return fmt.Errorf("unable to parse %s: %w", match, err)
+			}
+
+			name := strings.TrimSuffix(path.Base(match), ".pc")
+			modules[name] = mod
+			paths[name] = match
+			names = append(names, name)
+		}
+	}
+
+	for _, name := range names {
+		mod := modules[name]
+
+		if !pc.Options.NoProvides {
+			version := mod.Version
+			if version == "" {
+				version = "0"
+			}
+			pc.addProvides(generated, fmt.Sprintf("pc:%s=%s", name, version), paths[name])
+		}
+
+		if pc.Options.NoDepends {
+			continue
+		}
+
+		for _, dep := range mod.Requires {
+			required := strings.TrimPrefix(dep, "pc:")
+			if i := strings.IndexAny(required, "=<>"); i >= 0 {
+				required = required[:i]
+			}
+			if _, ok := modules[required]; ok {
+				continue
+			}
+
+			pc.addRuntime(generated, dep, paths[name])
+		}
+	}
+
+	return nil
+}
+
+var pythonSitePackagesRe = regexp.MustCompile(`^usr/lib/python(3\.[0-9]+)/site-packages/([^/]+)$`)
+
+// pythonModuleName returns the name of the top-level module installed
+// as the entry name of site-packages, or the empty string if it is not
+// a module.
+func pythonModuleName(name string, dir bool) string {
+	switch {
+	case strings.HasSuffix(name, ".dist-info"), strings.HasSuffix(name, ".egg-info"),
+		strings.HasSuffix(name, ".pth"), name == "__pycache__":
+		return ""
+	case dir:
+		return name
+	case strings.HasSuffix(name, ".py"), strings.HasSuffix(name, ".so"):
+		// extension modules are named like
+		// foo.cpython-311-x86_64-linux-gnu.so
+		return name[:strings.Index(name, ".")]
+	}
+
+	return ""
+}
+
+// generatePythonProviders adds a py3.X: virtual for each top-level
+// module the package installs for Python 3.X.
+func generatePythonProviders(pc *PackageContext, generated *Dependencies) error {
+	if pc.Options.NoPython || pc.Options.NoProvides {
+		return nil
+	}
+
+	pc.Logger.Printf("scanning for python modules...")
+
+	for _, f := range pc.files {
+		m := pythonSitePackagesRe.FindStringSubmatch(f.path)
+		if m == nil {
+			continue
+		}
+
+		if module := pythonModuleName(m[2], f.mode.IsDir()); module != "" {
+			pc.addProvides(generated, fmt.Sprintf("py%s:%s=%s-r%d", m[1], module, pc.Origin.Version, pc.Origin.Epoch), f.path)
+		}
+	}
+
+	return nil
+}
+
+var perlModuleDirs = []string{
+	"usr/share/perl5/vendor_perl",
+	"usr/share/perl5/core_perl",
+	"usr/share/perl5/site_perl",
+	"usr/lib/perl5/vendor_perl",
+	"usr/lib/perl5/core_perl",
+	"usr/lib/perl5/site_perl",
+}
+
+// generatePerlProviders adds a perl: virtual for each module the package
+// installs in one of the perl module directories.
+func generatePerlProviders(pc *PackageContext, generated *Dependencies) error {
+	if pc.Options.NoPerl || pc.Options.NoProvides {
+		return nil
+	}
+
+	pc.Logger.Printf("scanning for perl modules...")
+
+	for _, dir := range perlModuleDirs {
+		for _, f := range pc.files {
+			if !strings.HasPrefix(f.path, dir+"/") {
+				continue
+			}
+			rel := strings.TrimPrefix(f.path, dir+"/")
+
+			// auto holds the shared objects of XS modules
+			if rel == "auto" || strings.HasPrefix(rel, "auto/") {
+				continue
+			}
+
+			if f.mode.IsDir() || !strings.HasSuffix(rel, ".pm") {
+				continue
+			}
+
+			module := strings.ReplaceAll(strings.TrimSuffix(rel, ".pm"), "/", "::")
+			pc.addProvides(generated, fmt.Sprintf("perl:%s=%s-r%d", module, pc.Origin.Version, pc.Origin.Epoch), f.path)
+		}
+	}
+
+	return nil
+}
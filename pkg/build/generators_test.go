@@ -0,0 +1,125 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestShebangInterpreter(t *testing.T) {
+	for _, tt := range []struct {
+		head string
+		want string
+	}{
+		{"#!/usr/bin/python3\nimport sys\n", "python3"},
+		{"#! /bin/sh -e\n", "sh"},
+		{"#!/usr/bin/env perl\n", "perl"},
+		{"#!/usr/bin/env -S LANG=C bash -x\n", "bash"},
+		{"#!/usr/bin/env\n", ""},
+		{"#!\n", ""},
+		{"\x7fELF\x02\x01\x01", ""},
+	} {
+		require.Equal(t, tt.want, shebangInterpreter([]byte(tt.head)), tt.head)
+	}
+}
+
+func TestParsePkgConfig(t *testing.T) {
+	mod, err := parsePkgConfig(strings.NewReader(`prefix=/usr
+libdir=${prefix}/lib
+major=2
+
+Name: foo
+Description: The foo library
+URL: https://example.com/foo
+Version: ${major}.4.1
+Requires: glib-2.0 >= 2.50, gobject-2.0
+Requires.private: zlib != 1.2.11 libffi=3.4
+Libs: -L${libdir} -lfoo
+`))
+	require.NoError(t, err)
+	require.Equal(t, &pkgConfigModule{
+		Version:  "2.4.1",
+		Requires: []string{"pc:glib-2.0>=2.50", "pc:gobject-2.0", "pc:zlib", "pc:libffi=3.4"},
+	}, mod)
+}
+
+func TestGenerateDependencies(t *testing.T) {
+	files := map[string]struct {
+		mode     fs.FileMode
+		contents string
+	}{
+		"usr/bin/hello":        {0755, "#!/usr/bin/env python3\n"},
+		"usr/bin/hello-sh":     {0755, "#!/bin/sh\n"},
+		"usr/bin/sh":           {0755, "not really a shell"},
+		"usr/share/hello/data": {0644, "#!/usr/bin/ruby\n"},
+
+		"usr/lib/pkgconfig/hello.pc":           {0644, "Version: 1.2\nRequires: glib-2.0 >= 2.50, hello-private\n"},
+		"usr/share/pkgconfig/hello-private.pc": {0644, "Version: 1.2\n"},
+
+		"usr/lib/python3.10/site-packages/hello/__init__.py":                      {0644, ""},
+		"usr/lib/python3.10/site-packages/hello_cli.py":                           {0644, ""},
+		"usr/lib/python3.10/site-packages/_hello.cpython-310-x86_64-linux-gnu.so": {0755, ""},
+		"usr/lib/python3.10/site-packages/hello-1.0.dist-info/METADATA":           {0644, ""},
+
+		"usr/share/perl5/vendor_perl/Hello/World.pm":          {0644, ""},
+		"usr/lib/perl5/vendor_perl/auto/Hello/World/World.so": {0755, ""},
+	}
+
+	newContext := func(opts PackageOption) *PackageContext {
+		pc := &PackageContext{
+			Context:     &Context{WorkspaceDir: t.TempDir()},
+			Origin:      &Package{Name: "hello", Version: "1.0"},
+			PackageName: "hello",
+			Logger:      log.New(io.Discard, "", 0),
+			Options:     opts,
+		}
+
+		for name, f := range files {
+			p := filepath.Join(pc.WorkspaceSubdir(), name)
+			require.NoError(t, os.MkdirAll(filepath.Dir(p), 0755))
+			require.NoError(t, os.WriteFile(p, []byte(f.contents), f.mode))
+		}
+
+		return pc
+	}
+
+	pc := newContext(PackageOption{})
+	require.NoError(t, pc.GenerateDependencies())
+	require.Equal(t, []string{"cmd:python3", "pc:glib-2.0>=2.50"}, pc.Dependencies.Runtime)
+	require.Equal(t, []string{
+		"cmd:hello-sh=1.0-r0",
+		"cmd:hello=1.0-r0",
+		"cmd:sh=1.0-r0",
+		"pc:hello-private=1.2",
+		"pc:hello=1.2",
+		"perl:Hello::World=1.0-r0",
+		"py3.10:_hello=1.0-r0",
+		"py3.10:hello=1.0-r0",
+		"py3.10:hello_cli=1.0-r0",
+	}, pc.Dependencies.Provides)
+
+	pc = newContext(PackageOption{NoShebangs: true, NoPkgConfig: true, NoPython: true, NoPerl: true})
+	require.NoError(t, pc.GenerateDependencies())
+	require.Empty(t, pc.Dependencies.Runtime)
+	require.Equal(t, []string{"cmd:hello-sh=1.0-r0", "cmd:hello=1.0-r0", "cmd:sh=1.0-r0"}, pc.Dependencies.Provides)
+}
@@ -0,0 +1,373 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"chainguard.dev/melange/internal/spdx"
+	"gopkg.in/yaml.v3"
+)
+
+// The maximum depth of nested `uses:` references followed while linting,
+// which also protects against pipelines which reference themselves.
+const maxLintDepth = 16
+
+var (
+	lintLineRe         = regexp.MustCompile(`^(?:yaml: )?line (\d+): (.*)$`)
+	lintSubstitutionRe = regexp.MustCompile(`\${{[^}]*}}`)
+)
+
+// LintIssue describes a problem found in a build configuration or in
+// one of the pipelines it uses.
+type LintIssue struct {
+	File    string
+	Line    int
+	Message string
+}
+
+func (i LintIssue) String() string {
+	return fmt.Sprintf("%s:%d: %s", i.File, i.Line, i.Message)
+}
+
+// lintInput holds the key and value nodes of a `with:` entry.
+type lintInput struct {
+	key   *yaml.Node
+	value *yaml.Node
+}
+
+type linter struct {
+	pipelineDir string
+	issues      []LintIssue
+}
+
+func (l *linter) report(file string, line int, format string, args ...interface{}) {
+	l.issues = append(l.issues, LintIssue{
+		File:    file,
+		Line:    line,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+// LintConfiguration statically checks the configuration file for
+// problems which would otherwise only be noticed during the build:
+// unknown keys, references to pipelines which do not exist, missing
+// required pipeline inputs and substitutions which would be silently
+// erased.  An error is only returned if the configuration could not be
+// checked at all.
+func LintConfiguration(configFile, template, pipelineDir string) ([]LintIssue, error) {
+	data, err := os.ReadFile(configFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load configuration file: %w", err)
+	}
+
+	templatized, err := applyTemplate(data, template)
+	if err != nil {
+		return nil, fmt.Errorf("unable to apply template: %w", err)
+	}
+
+	l := linter{pipelineDir: pipelineDir}
+
+	root, ok := l.parse(configFile, templatized, &Configuration{})
+	if !ok {
+		return l.sorted(), nil
+	}
+
+	pkg := mappingValue(root, "package")
+	switch {
+	case pkg == nil:
+		l.report(configFile, root.Line, "package section is missing")
+	default:
+		for _, field := range []string{"name", "version"} {
+			if v := mappingValue(pkg, field); v == nil || v.Value == "" {
+				l.report(configFile, pkg.Line, "package %s is not set", field)
+			}
+		}
+	}
+
+	if copyright := mappingValue(pkg, "copyright"); copyright != nil && copyright.Kind == yaml.SequenceNode {
+		for _, cp := range copyright.Content {
+			if license := mappingValue(cp, "license"); license != nil && license.Value != "" {
+				if _, err := spdx.Normalize(license.Value); err != nil {
+					l.report(configFile, license.Line, "invalid license: %v", err)
+				}
+			}
+		}
+	}
+
+	pipeline := mappingValue(root, "pipeline")
+	if pipeline == nil || len(pipeline.Content) == 0 {
+		l.report(configFile, root.Line, "no pipeline has been configured")
+	} else {
+		l.lintSteps(configFile, pipeline, nil, false, 0)
+	}
+
+	if tp := mappingValue(mappingValue(root, "test"), "pipeline"); tp != nil {
+		l.lintSteps(configFile, tp, nil, false, 0)
+	}
+
+	if subpackages := mappingValue(root, "subpackages"); subpackages != nil {
+		for _, sp := range subpackages.Content {
+			if spp := mappingValue(sp, "pipeline"); spp != nil {
+				l.lintSteps(configFile, spp, nil, true, 0)
+			}
+
+			if tp := mappingValue(mappingValue(sp, "test"), "pipeline"); tp != nil {
+				l.lintSteps(configFile, tp, nil, true, 0)
+			}
+		}
+	}
+
+	return l.sorted(), nil
+}
+
+// parse strictly decodes data into out, reporting unknown keys and
+// syntax errors, and returns the root mapping node of the document.
+func (l *linter) parse(file string, data []byte, out interface{}) (*yaml.Node, bool) {
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+
+	if err := dec.Decode(out); err != nil {
+		var te *yaml.TypeError
+		if !errors.As(err, &te) {
+			l.reportYAMLError(file, err.Error())
+			return nil, false
+		}
+
+		for _, msg := range te.Errors {
+			l.reportYAMLError(file, msg)
+		}
+	}
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		l.reportYAMLError(file, err.Error())
+		return nil, false
+	}
+
+	if len(doc.Content) == 0 || doc.Content[0].Kind != yaml.MappingNode {
+		l.report(file, 1, "document is not a mapping")
+		return nil, false
+	}
+
+	return doc.Content[0], true
+}
+
+func (l *linter) reportYAMLError(file, msg string) {
+	line := 0
+	if m := lintLineRe.FindStringSubmatch(msg); m != nil {
+		line, _ = strconv.Atoi(m[1])
+		msg = m[2]
+	}
+
+	l.report(file, line, "%s", msg)
+}
+
+// lintSteps checks a sequence of pipeline steps.  inherited contains the
+// inputs which are visible to the steps in addition to their own `with:`
+// values, which is the case for the top-level steps of a pipeline loaded
+// through `uses:`.
+func (l *linter) lintSteps(file string, steps *yaml.Node, inherited map[string]bool, subpackage bool, depth int) {
+	if steps.Kind != yaml.SequenceNode {
+		return
+	}
+
+	for _, step := range steps.Content {
+		l.lintStep(file, step, inherited, subpackage, depth)
+	}
+}
+
+func (l *linter) lintStep(file string, step *yaml.Node, inherited map[string]bool, subpackage bool, depth int) {
+	if step.Kind != yaml.MappingNode {
+		return
+	}
+
+	known := lintKnownSubstitutions(subpackage)
+	for k := range inherited {
+		known[fmt.Sprintf("${{inputs.%s}}", k)] = true
+	}
+
+	with := map[string]lintInput{}
+	if w := mappingValue(step, "with"); w != nil && w.Kind == yaml.MappingNode {
+		for i := 0; i+1 < len(w.Content); i += 2 {
+			with[w.Content[i].Value] = lintInput{key: w.Content[i], value: w.Content[i+1]}
+			known[fmt.Sprintf("${{inputs.%s}}", w.Content[i].Value)] = true
+		}
+
+		for i := 0; i+1 < len(w.Content); i += 2 {
+			l.lintSubstitutions(file, w.Content[i+1], known)
+		}
+	}
+
+	if runs := mappingValue(step, "runs"); runs != nil {
+		l.lintSubstitutions(file, runs, known)
+	}
+
+	if cond := mappingValue(step, "if"); cond != nil {
+		l.lintSubstitutions(file, cond, known)
+	}
+
+	if uses := mappingValue(step, "uses"); uses != nil {
+		l.lintUses(file, uses, step, with, subpackage, depth)
+	}
+
+	if nested := mappingValue(step, "pipeline"); nested != nil {
+		l.lintSteps(file, nested, nil, subpackage, depth)
+	}
+}
+
+func (l *linter) lintUses(file string, uses, step *yaml.Node, with map[string]lintInput, subpackage bool, depth int) {
+	if depth >= maxLintDepth {
+		l.report(file, uses.Line, "pipeline %q is nested too deeply, it may reference itself", uses.Value)
+		return
+	}
+
+	p := Pipeline{}
+	var root *yaml.Node
+
+	usedFile := filepath.Join(l.pipelineDir, uses.Value+".yaml")
+	if b, ok := builtinPipelines[uses.Value]; ok {
+		p.Inputs = b.Inputs
+	} else {
+		data, err := os.ReadFile(usedFile)
+		if err != nil {
+			l.report(file, uses.Line, "unknown pipeline %q (looked for %s)", uses.Value, usedFile)
+			return
+		}
+
+		root, ok = l.parse(usedFile, data, &p)
+		if !ok {
+			return
+		}
+	}
+
+	for _, k := range sortedInputNames(p.Inputs) {
+		in := p.Inputs[k]
+		if !in.Required || in.Default != "" {
+			continue
+		}
+
+		if v, ok := with[k]; !ok || v.value.Value == "" {
+			l.report(file, step.Line, "required input %q for pipeline %q is missing", k, uses.Value)
+		}
+	}
+
+	inputs := map[string]bool{}
+	for k := range p.Inputs {
+		inputs[k] = true
+	}
+
+	for k, n := range with {
+		if !inputs[k] {
+			l.report(file, n.key.Line, "input %q is not declared by pipeline %q", k, uses.Value)
+		}
+
+		inputs[k] = true
+	}
+
+	if steps := mappingValue(root, "pipeline"); steps != nil {
+		l.lintSteps(usedFile, steps, inputs, subpackage, depth+1)
+	}
+}
+
+// lintSubstitutions reports any substitution in the scalar node which is
+// not known, as mutateStringFromMap would erase it from the result.
+func (l *linter) lintSubstitutions(file string, node *yaml.Node, known map[string]bool) {
+	if node.Kind != yaml.ScalarNode {
+		return
+	}
+
+	for i, line := range strings.Split(node.Value, "\n") {
+		lineno := node.Line
+		if node.Style&(yaml.LiteralStyle|yaml.FoldedStyle) != 0 {
+			lineno += i + 1
+		}
+
+		for _, sub := range lintSubstitutionRe.FindAllString(line, -1) {
+			if !known[sub] {
+				l.report(file, lineno, "unknown substitution %s", sub)
+			}
+		}
+	}
+}
+
+// sorted returns the issues found ordered by file and line, without
+// duplicates, as a pipeline used several times is checked each time.
+func (l *linter) sorted() []LintIssue {
+	sort.SliceStable(l.issues, func(i, j int) bool {
+		if l.issues[i].File != l.issues[j].File {
+			return l.issues[i].File < l.issues[j].File
+		}
+		return l.issues[i].Line < l.issues[j].Line
+	})
+
+	out := []LintIssue{}
+	seen := map[LintIssue]bool{}
+	for _, i := range l.issues {
+		if seen[i] {
+			continue
+		}
+		seen[i] = true
+		out = append(out, i)
+	}
+
+	return out
+}
+
+func lintKnownSubstitutions(subpackage bool) map[string]bool {
+	pctx := PipelineContext{Context: &Context{}, Package: &Package{}}
+	if subpackage {
+		pctx.Subpackage = &Subpackage{}
+	}
+
+	known := map[string]bool{}
+	for k := range substitutionMap(&pctx) {
+		known[k] = true
+	}
+
+	return known
+}
+
+func sortedInputNames(inputs map[string]Input) []string {
+	names := make([]string, 0, len(inputs))
+	for k := range inputs {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	if node == nil || node.Kind != yaml.MappingNode {
+		return nil
+	}
+
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+
+	return nil
+}
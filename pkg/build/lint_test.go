@@ -0,0 +1,179 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const lintDownloadPipeline = `name: Download
+
+inputs:
+  uri:
+    required: true
+  strip-components:
+    default: 1
+
+pipeline:
+  - runs: |
+      wget ${{inputs.uri}}
+      tar -x --strip-components=${{inputs.strip-components}} -f out
+      echo ${{inputs.bogus}}
+`
+
+func TestLintConfiguration(t *testing.T) {
+	tests := []struct {
+		description string
+		contents    string
+		expected    []LintIssue
+	}{
+		{
+			description: "problems in used pipeline",
+			contents: `package:
+  name: hello
+  version: 1
+pipeline:
+  - uses: download
+    with:
+      uri: https://example.com/hello-${{package.version}}.tar.gz
+  - runs: |
+      make DESTDIR=${{targets.destdir}} install
+subpackages:
+  - name: hello-doc
+    pipeline:
+      - runs: mv ${{targets.destdir}}/usr/share ${{targets.subpkgdir}}/usr/share
+`,
+			expected: []LintIssue{{
+				File: "download.yaml", Line: 13, Message: "unknown substitution ${{inputs.bogus}}",
+			}},
+		}, {
+			description: "unknown key",
+			contents: `package:
+  name: hello
+  version: 1
+pipeline:
+  - run: make
+`,
+			expected: []LintIssue{{
+				File: "config", Line: 5, Message: "field run not found in type build.Pipeline",
+			}},
+		}, {
+			description: "unknown pipeline and missing input",
+			contents: `package:
+  name: hello
+  version: 1
+pipeline:
+  - uses: download
+    with:
+      url: https://example.com/
+  - uses: fecth
+`,
+			expected: []LintIssue{{
+				File: "config", Line: 5, Message: `required input "uri" for pipeline "download" is missing`,
+			}, {
+				File: "config", Line: 7, Message: `input "url" is not declared by pipeline "download"`,
+			}, {
+				File: "config", Line: 8, Message: `unknown pipeline "fecth" (looked for fecth.yaml)`,
+			}, {
+				File: "download.yaml", Line: 13, Message: "unknown substitution ${{inputs.bogus}}",
+			}},
+		}, {
+			description: "builtin pipeline",
+			contents: `package:
+  name: hello
+  version: 1
+pipeline:
+  - uses: fetch
+    with:
+      uri: https://example.com/hello-${{package.version}}.tar.gz
+      strip: 2
+`,
+			expected: []LintIssue{{
+				File: "config", Line: 5, Message: `required input "expected-sha256" for pipeline "fetch" is missing`,
+			}, {
+				File: "config", Line: 8, Message: `input "strip" is not declared by pipeline "fetch"`,
+			}},
+		}, {
+			description: "unknown substitutions",
+			contents: `package:
+  name: hello
+  version: 1
+pipeline:
+  - runs: |
+      echo ${{package.nmae}}
+      echo ${{targets.subpkgdir}}
+`,
+			expected: []LintIssue{{
+				File: "config", Line: 6, Message: "unknown substitution ${{package.nmae}}",
+			}, {
+				File: "config", Line: 7, Message: "unknown substitution ${{targets.subpkgdir}}",
+			}},
+		}, {
+			description: "invalid license",
+			contents: `package:
+  name: hello
+  version: 1
+  copyright:
+    - license: MIT
+    - paths:
+        - usr/share/doc
+      license: Apache2
+pipeline:
+  - runs: make
+`,
+			expected: []LintIssue{{
+				File: "config", Line: 8, Message: `invalid license: unknown license identifier "Apache2", did you mean "Apache-2.0"?`,
+			}},
+		}, {
+			description: "missing package fields and pipeline",
+			contents: `package:
+  name: hello
+`,
+			expected: []LintIssue{{
+				File: "config", Line: 1, Message: "no pipeline has been configured",
+			}, {
+				File: "config", Line: 2, Message: "package version is not set",
+			}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			dir := t.TempDir()
+			pipelineDir := filepath.Join(dir, "pipelines")
+			require.NoError(t, os.MkdirAll(pipelineDir, 0755))
+			require.NoError(t, os.WriteFile(filepath.Join(pipelineDir, "download.yaml"), []byte(lintDownloadPipeline), 0644))
+
+			f := filepath.Join(dir, "config")
+			require.NoError(t, os.WriteFile(f, []byte(test.contents), 0644))
+
+			issues, err := LintConfiguration(f, "", pipelineDir)
+			require.NoError(t, err)
+
+			// Make the results independent of the temporary directory.
+			for i := range issues {
+				issues[i].File = filepath.Base(issues[i].File)
+				issues[i].Message = strings.ReplaceAll(issues[i].Message, pipelineDir+"/", "")
+			}
+
+			require.Equal(t, test.expected, issues)
+		})
+	}
+}
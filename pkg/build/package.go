@@ -15,12 +15,11 @@
 package build
 
 import (
+	"archive/tar"
 	"bytes"
-	"crypto/sha1"
+	"crypto/sha1" // nolint:gosec
 	"crypto/sha256"
-	"debug/elf"
 	"encoding/hex"
-	"encoding/json"
 	"fmt"
 	"hash"
 	"io"
@@ -30,12 +29,13 @@ import (
 	"path/filepath"
 	"sort"
 	"strings"
+	"syscall"
 	"text/template"
 
 	apkofs "chainguard.dev/apko/pkg/fs"
 	"chainguard.dev/apko/pkg/tarball"
-	"chainguard.dev/melange/internal/sign"
 	"github.com/psanford/memfs"
+	"golang.org/x/sync/errgroup"
 )
 
 type PackageContext struct {
@@ -51,9 +51,25 @@ type PackageContext struct {
 	Options       PackageOption
 	Scriptlets    Scriptlets
 	Description   string
+	Copyright     []Copyright
+	License       string
+	fileLicenses  map[string]string
+	generator     string
+	imports       []sharedObjectImport
+	files         []packageFile
+
+	dependenciesGenerated bool
 }
 
 func (pkg *Package) Emit(ctx *PipelineContext) error {
+	return pkg.packageContext(ctx).EmitPackage()
+}
+
+func (spkg *Subpackage) Emit(ctx *PipelineContext) error {
+	return spkg.packageContext(ctx).EmitPackage()
+}
+
+func (pkg *Package) packageContext(ctx *PipelineContext) *PackageContext {
 	fakesp := Subpackage{
 		Name:         pkg.Name,
 		Dependencies: pkg.Dependencies,
@@ -61,11 +77,11 @@ func (pkg *Package) Emit(ctx *PipelineContext) error {
 		Scriptlets:   pkg.Scriptlets,
 		Description:  pkg.Description,
 	}
-	return fakesp.Emit(ctx)
+	return fakesp.packageContext(ctx)
 }
 
-func (spkg *Subpackage) Emit(ctx *PipelineContext) error {
-	pc := PackageContext{
+func (spkg *Subpackage) packageContext(ctx *PipelineContext) *PackageContext {
+	return &PackageContext{
 		Context:      ctx.Context,
 		Origin:       &ctx.Context.Configuration.Package,
 		PackageName:  spkg.Name,
@@ -77,7 +93,6 @@ func (spkg *Subpackage) Emit(ctx *PipelineContext) error {
 		Scriptlets:   spkg.Scriptlets,
 		Description:  spkg.Description,
 	}
-	return pc.EmitPackage()
 }
 
 func (pc *PackageContext) Identity() string {
@@ -98,8 +113,8 @@ pkgver = {{.Origin.Version}}-r{{.Origin.Epoch}}
 arch = {{.Arch}}
 size = {{.InstalledSize}}
 pkgdesc = {{.Description}}
-{{- range $copyright := .Origin.Copyright }}
-license = {{ $copyright.License }}
+{{- if .License }}
+license = {{ .License }}
 {{- end }}
 {{- range $dep := .Dependencies.Runtime }}
 depend = {{ $dep }}
@@ -205,11 +220,25 @@ func (pc *PackageContext) generateControlSection(digest hash.Hash, w io.WriteSee
 }
 
 func (pc *PackageContext) SignatureName() string {
-	return fmt.Sprintf(".SIGN.RSA.%s.pub", filepath.Base(pc.Context.SigningKey))
+	return pc.Context.signer().SignatureName()
 }
 
 type DependencyGenerator func(*PackageContext, *Dependencies) error
 
+// dependencyGenerators are the generators run for each package, with the
+// names they are recorded under in the dependency log.
+var dependencyGenerators = []struct {
+	name     string
+	generate DependencyGenerator
+}{
+	{"shared-objects", generateSharedObjectNameDeps},
+	{"commands", generateCmdProviders},
+	{"shebangs", generateShebangDeps},
+	{"pkg-config", generatePkgConfigDeps},
+	{"python", generatePythonProviders},
+	{"perl", generatePerlProviders},
+}
+
 func dedup(in []string) []string {
 	sort.Strings(in)
 	out := make([]string, 0, len(in))
@@ -245,219 +274,254 @@ func generateCmdProviders(pc *PackageContext, generated *Dependencies) error {
 
 	pc.Logger.Printf("scanning for commands...")
 
-	fsys := apkofs.DirFS(pc.WorkspaceSubdir())
-	if err := fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
-		if err != nil {
-			return err
-		}
-
-		fi, err := d.Info()
-		if err != nil {
-			return err
-		}
-
-		mode := fi.Mode()
-		if !mode.IsRegular() {
-			return nil
+	for _, f := range pc.files {
+		if !f.mode.IsRegular() {
+			continue
 		}
 
-		if mode.Perm()&0555 == 0555 {
-			if allowedPrefix(path, cmdPrefixes) {
-				basename := filepath.Base(path)
-				generated.Provides = append(generated.Provides, fmt.Sprintf("cmd:%s=%s-r%d", basename, pc.Origin.Version, pc.Origin.Epoch))
+		if f.mode.Perm()&0555 == 0555 {
+			if allowedPrefix(f.path, cmdPrefixes) {
+				basename := filepath.Base(f.path)
+				pc.addProvides(generated, fmt.Sprintf("cmd:%s=%s-r%d", basename, pc.Origin.Version, pc.Origin.Epoch), f.path)
 			}
 		}
-
-		return nil
-	}); err != nil {
-		return err
 	}
 
 	return nil
 }
 
-func generateSharedObjectNameDeps(pc *PackageContext, generated *Dependencies) error {
-	pc.Logger.Printf("scanning for shared object dependencies...")
-
-	depends := map[string][]string{}
+func (dep *Dependencies) Summarize(logger *log.Logger) {
+	if len(dep.Runtime) > 0 {
+		logger.Printf("  runtime:")
 
-	fsys := apkofs.DirFS(pc.WorkspaceSubdir())
-	if err := fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
-		if err != nil {
-			return err
+		for _, dep := range dep.Runtime {
+			logger.Printf("    %s", dep)
 		}
+	}
 
-		fi, err := d.Info()
-		if err != nil {
-			return err
-		}
+	if len(dep.Provides) > 0 {
+		logger.Printf("  provides:")
 
-		mode := fi.Mode()
-		if !mode.IsRegular() {
-			return nil
+		for _, dep := range dep.Provides {
+			logger.Printf("    %s", dep)
 		}
+	}
+}
 
-		if mode.Perm()&0555 == 0555 {
-			basename := filepath.Base(path)
+func (pc *PackageContext) GenerateDependencies() error {
+	return GenerateDependencies([]*PackageContext{pc})
+}
 
-			// most likely a shell script instead of an ELF, so treat any
-			// error as non-fatal.
-			// TODO(kaniini): use DirFS for this
-			ef, err := elf.Open(filepath.Join(pc.WorkspaceSubdir(), path))
-			if err != nil {
-				return nil
-			}
-			defer ef.Close()
+// GenerateDependencies generates the dependencies of packages built
+// together, resolving the shared objects each of them imports against
+// all of them: imports satisfied by the package itself are dropped, and
+// imports satisfied by another package of the build become dependencies
+// on that package.
+//
+// The packages are scanned concurrently, each with a single walk of its
+// filesystem.
+func GenerateDependencies(pcs []*PackageContext) error {
+	if len(pcs) == 0 {
+		return nil
+	}
+	jobs := pcs[0].Context.jobs()
 
-			libs, err := ef.ImportedLibraries()
-			if err != nil {
-				pc.Logger.Printf("WTF: ImportedLibraries() returned error: %v", err)
-				return nil
-			}
+	// every emitted package is part of the dependency log, even when
+	// nothing is generated for it; the reports are all created before
+	// the packages are scanned, so that each scan only touches its own
+	for _, pc := range pcs {
+		pc.dependencyReport()
+	}
 
-			if !pc.Options.NoDepends {
-				for _, lib := range libs {
-					if strings.Contains(lib, ".so.") {
-						generated.Runtime = append(generated.Runtime, fmt.Sprintf("so:%s", lib))
-						depends[lib] = append(depends[lib], path)
-					}
-				}
-			}
+	generated := make([]Dependencies, len(pcs))
+	if err := forEachPackage(jobs, pcs, func(i int, pc *PackageContext) error {
+		if err := pc.walkFiles(apkofs.DirFS(pc.WorkspaceSubdir())); err != nil {
+			return err
+		}
+		pc.imports = nil
 
-			if !pc.Options.NoProvides && strings.Contains(basename, ".so.") {
-				sonames, err := ef.DynString(elf.DT_SONAME)
-				// most likely SONAME is not set on this object
-				if err != nil {
-					pc.Logger.Printf("WARNING: library %s lacks SONAME", path)
-					return nil
-				}
-
-				for _, soname := range sonames {
-					parts := strings.Split(soname, ".so.")
-
-					var libver string
-					if len(parts) > 1 {
-						libver = parts[1]
-					} else {
-						libver = "0"
-					}
-
-					generated.Provides = append(generated.Provides, fmt.Sprintf("so:%s=%s", soname, libver))
-				}
+		for _, gen := range dependencyGenerators {
+			pc.generator = gen.name
+			if err := gen.generate(pc, &generated[i]); err != nil {
+				return err
 			}
 		}
+		pc.generator = ""
 
 		return nil
 	}); err != nil {
 		return err
 	}
 
-	if pc.Context.DependencyLog != "" {
-		pc.Logger.Printf("writing dependency log")
+	// the provides of every package are only read while the imports are
+	// resolved against them
+	if err := forEachPackage(jobs, pcs, func(i int, pc *PackageContext) error {
+		pc.resolveSharedObjects(pcs, generated, &generated[i])
+		return nil
+	}); err != nil {
+		return err
+	}
 
-		logFile, err := os.Create(fmt.Sprintf("%s.%s", pc.Context.DependencyLog, pc.Arch))
-		if err != nil {
-			pc.Logger.Printf("WARNING: Unable to open dependency log: %v", err)
-		}
-		defer logFile.Close()
+	for i, pc := range pcs {
+		newruntime := append(pc.Dependencies.Runtime, generated[i].Runtime...)
+		pc.Dependencies.Runtime = dedup(newruntime)
 
-		je := json.NewEncoder(logFile)
-		if err := je.Encode(depends); err != nil {
-			return err
-		}
+		newprovides := append(pc.Dependencies.Provides, generated[i].Provides...)
+		pc.Dependencies.Provides = dedup(newprovides)
+
+		pc.Dependencies.Summarize(pc.Logger)
+		pc.dependenciesGenerated = true
 	}
 
 	return nil
 }
 
-func (dep *Dependencies) Summarize(logger *log.Logger) {
-	if len(dep.Runtime) > 0 {
-		logger.Printf("  runtime:")
+// forEachPackage calls fn for each package, with at most jobs calls
+// running at once, and returns the first error encountered.
+func forEachPackage(jobs int, pcs []*PackageContext, fn func(int, *PackageContext) error) error {
+	var g errgroup.Group
+	g.SetLimit(jobs)
 
-		for _, dep := range dep.Runtime {
-			logger.Printf("    %s", dep)
-		}
+	for i, pc := range pcs {
+		i, pc := i, pc
+		g.Go(func() error {
+			return fn(i, pc)
+		})
 	}
 
-	if len(dep.Provides) > 0 {
-		logger.Printf("  provides:")
+	return g.Wait()
+}
 
-		for _, dep := range dep.Provides {
-			logger.Printf("    %s", dep)
+func combine(out io.Writer, inputs ...io.Reader) error {
+	for _, input := range inputs {
+		if _, err := io.Copy(out, input); err != nil {
+			return err
 		}
 	}
+
+	return nil
 }
 
-func (pc *PackageContext) GenerateDependencies() error {
-	generated := Dependencies{}
-	generators := []DependencyGenerator{
-		generateSharedObjectNameDeps,
-		generateCmdProviders,
+// calculateInstalledSize sums the sizes of the entries of the package,
+// including those installed after its filesystem was walked.
+func (pc *PackageContext) calculateInstalledSize() {
+	pc.InstalledSize = 0
+	for _, f := range pc.files {
+		pc.InstalledSize += f.size
 	}
+}
 
-	for _, gen := range generators {
-		if err := gen(pc, &generated); err != nil {
-			return err
-		}
+// hardlinkInode returns the inode of a file with several links, or 0 if
+// it has a single one or its inode is unknown.
+func hardlinkInode(fi fs.FileInfo) uint64 {
+	if fi.IsDir() {
+		return 0
 	}
 
-	newruntime := append(pc.Dependencies.Runtime, generated.Runtime...)
-	pc.Dependencies.Runtime = dedup(newruntime)
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok || st == nil || st.Nlink <= 1 {
+		return 0
+	}
 
-	newprovides := append(pc.Dependencies.Provides, generated.Provides...)
-	pc.Dependencies.Provides = dedup(newprovides)
+	return st.Ino
+}
 
-	pc.Dependencies.Summarize(pc.Logger)
+// writeDataTar writes the entries of fsys to tw like the tarball
+// package of apko: owned by root, dated at the build date, with the
+// links between hardlinked files kept and the SHA1 checksum apk-tools
+// verifies in a PAX record of each file and symlink.
+func (pc *PackageContext) writeDataTar(tw *tar.Writer, fsys apkofs.ReadLinkFS) error {
+	seen := map[uint64]string{}
 
-	return nil
-}
+	return fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == "." {
+			return nil
+		}
 
-func combine(out io.Writer, inputs ...io.Reader) error {
-	for _, input := range inputs {
-		if _, err := io.Copy(out, input); err != nil {
+		fi, err := d.Info()
+		if err != nil {
 			return err
 		}
-	}
 
-	return nil
-}
+		var link string
+		if fi.Mode()&fs.ModeSymlink != 0 {
+			if link, err = fsys.Readlink(path); err != nil {
+				return err
+			}
+		}
 
-// TODO(kaniini): generate APKv3 packages
-func (pc *PackageContext) calculateInstalledSize(fsys fs.FS) error {
-	if err := fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
+		header, err := tar.FileInfoHeader(fi, link)
 		if err != nil {
 			return err
 		}
+		header.Name = path
+		header.AccessTime = pc.Context.SourceDateEpoch
+		header.ModTime = pc.Context.SourceDateEpoch
+		header.ChangeTime = pc.Context.SourceDateEpoch
+		header.Uid, header.Gid = 0, 0
+		header.Uname, header.Gname = "root", "root"
+
+		if ino := hardlinkInode(fi); ino != 0 {
+			if first, ok := seen[ino]; ok {
+				header.Typeflag = tar.TypeLink
+				header.Linkname = first
+				header.Size = 0
+			} else {
+				seen[ino] = path
+			}
+		}
 
-		fi, err := d.Info()
-		if err != nil {
+		header.PAXRecords = map[string]string{}
+		if link != "" {
+			digest := sha1.Sum([]byte(link)) // nolint:gosec
+			header.PAXRecords["APK-TOOLS.checksum.SHA1"] = hex.EncodeToString(digest[:])
+		} else if fi.Mode().IsRegular() {
+			sha1sum, _, err := fsDigests(fsys, path)
+			if err != nil {
+				return err
+			}
+			header.PAXRecords["APK-TOOLS.checksum.SHA1"] = sha1sum
+		}
+
+		if err := tw.WriteHeader(header); err != nil {
 			return err
 		}
 
-		pc.InstalledSize += fi.Size()
-		return nil
-	}); err != nil {
-		return fmt.Errorf("unable to preprocess package data: %w", err)
-	}
+		if header.Typeflag != tar.TypeReg || header.Size == 0 {
+			return nil
+		}
 
-	return nil
+		f, err := fsys.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		_, err = io.Copy(tw, f)
+		return err
+	})
 }
 
-func (pc *PackageContext) emitDataSection(fsys fs.FS, w io.WriteSeeker) error {
-	tarctx, err := tarball.NewContext(
-		tarball.WithSourceDateEpoch(pc.Context.SourceDateEpoch),
-		tarball.WithOverrideUIDGID(0, 0),
-		tarball.WithOverrideUname("root"),
-		tarball.WithOverrideGname("root"),
-		tarball.WithUseChecksums(true),
-	)
+// emitDataSection writes the data section of the package to w,
+// compressed as configured for the build.
+func (pc *PackageContext) emitDataSection(fsys apkofs.ReadLinkFS, w io.WriteSeeker) error {
+	digest := sha256.New()
+	zw, err := pc.Context.newDataWriter(io.MultiWriter(digest, w))
 	if err != nil {
-		return fmt.Errorf("unable to build tarball context: %w", err)
+		return fmt.Errorf("unable to set up data compression: %w", err)
 	}
 
-	digest := sha256.New()
-	mw := io.MultiWriter(digest, w)
-	if err := tarctx.WriteArchive(mw, fsys); err != nil {
+	tw := tar.NewWriter(zw)
+	if err := pc.writeDataTar(tw, fsys); err != nil {
+		return fmt.Errorf("unable to write data tarball: %w", err)
+	}
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("unable to write data tarball: %w", err)
+	}
+	if err := zw.Close(); err != nil {
 		return fmt.Errorf("unable to write data tarball: %w", err)
 	}
 
@@ -484,7 +548,7 @@ func (pc *PackageContext) emitNormalSignatureSection(h hash.Hash, w io.WriteSeek
 	}
 
 	fsys := memfs.New()
-	sigbuf, err := sign.RSASignSHA1Digest(h.Sum(nil), pc.Context.SigningKey, pc.Context.SigningPassphrase)
+	sigbuf, err := pc.Context.signer().Sign(h.Sum(nil))
 	if err != nil {
 		return fmt.Errorf("unable to generate signature: %w", err)
 	}
@@ -505,7 +569,7 @@ func (pc *PackageContext) emitNormalSignatureSection(h hash.Hash, w io.WriteSeek
 }
 
 func (pc *PackageContext) wantSignature() bool {
-	return pc.Context.SigningKey != ""
+	return pc.Context.signer() != nil
 }
 
 func (pc *PackageContext) EmitPackage() error {
@@ -514,18 +578,38 @@ func (pc *PackageContext) EmitPackage() error {
 	// filesystem for the data package
 	fsys := apkofs.DirFS(pc.WorkspaceSubdir())
 
-	// generate so:/cmd: virtuals for the filesystem
-	if err := pc.GenerateDependencies(); err != nil {
-		return fmt.Errorf("unable to build final dependencies set: %w", err)
+	// generate so:/cmd: virtuals for the filesystem, unless they were
+	// generated with those of the other packages of the build
+	if !pc.dependenciesGenerated {
+		if err := pc.GenerateDependencies(); err != nil {
+			return fmt.Errorf("unable to build final dependencies set: %w", err)
+		}
+	}
+
+	// match copyright entries against the data, installing their
+	// attestations
+	if err := pc.applyCopyright(); err != nil {
+		return err
 	}
 
-	// walk the filesystem to calculate the installed-size
-	if err := pc.calculateInstalledSize(fsys); err != nil {
+	// describe the data in an SBOM, possibly embedding it
+	if err := pc.emitSBOM(fsys); err != nil {
 		return err
 	}
 
+	// the installed-size is calculated from the walk done when
+	// generating the dependencies
+	pc.calculateInstalledSize()
+
 	pc.Logger.Printf("  installed-size: %d", pc.InstalledSize)
 
+	if pc.Context.ApkFormat == "v3" {
+		if err := pc.emitAPKv3(fsys); err != nil {
+			return err
+		}
+		return pc.emitProvenance()
+	}
+
 	// prepare data.tar.gz
 	dataTarGz, err := os.CreateTemp("", "melange-data-*.tar.gz")
 	if err != nil {
@@ -546,16 +630,14 @@ func (pc *PackageContext) EmitPackage() error {
 	defer controlTarGz.Close()
 	defer os.Remove(controlTarGz.Name())
 
-	var controlDigest hash.Hash
-
 	// APKv2 style signature is a SHA-1 hash on the control digest,
 	// APKv2+Fulcio style signature is an SHA-256 hash on the control
-	// digest.
-	controlDigest = sha256.New()
-
-	// Key-based signature (normal), use SHA-1
-	if pc.Context.SigningKey != "" {
-		controlDigest = sha1.New()
+	// digest, so the signer decides.
+	controlDigest := sha256.New()
+	if pc.wantSignature() {
+		controlDigest = pc.Context.signer().Hash().New()
+	} else {
+		pc.Logger.Printf("WARNING: no signing key or identity token configured, the package will not be signed")
 	}
 
 	finalDigest, err := pc.generateControlSection(controlDigest, controlTarGz)
@@ -573,7 +655,6 @@ func (pc *PackageContext) EmitPackage() error {
 		defer signatureTarGz.Close()
 		defer os.Remove(signatureTarGz.Name())
 
-		// TODO(kaniini): Emit fulcio signature if signing key not configured.
 		if err := pc.emitNormalSignatureSection(finalDigest, signatureTarGz); err != nil {
 			return err
 		}
@@ -598,5 +679,5 @@ func (pc *PackageContext) EmitPackage() error {
 
 	pc.Logger.Printf("wrote %s", outFile.Name())
 
-	return nil
+	return pc.emitProvenance()
 }
@@ -0,0 +1,177 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"bytes"
+	"crypto/x509"
+	"debug/elf"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	apko_types "chainguard.dev/apko/pkg/build/types"
+	"chainguard.dev/melange/internal/sign"
+	"chainguard.dev/melange/internal/sign/signtest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEmitPackageKeyless(t *testing.T) {
+	ca := signtest.NewCA(t)
+	ctx := &Context{
+		WorkspaceDir:    t.TempDir(),
+		OutDir:          t.TempDir(),
+		SourceDateEpoch: time.Unix(0, 0),
+		Signer:          sign.NewKeylessSigner(ca),
+	}
+	pc := &PackageContext{
+		Context:     ctx,
+		Origin:      &Package{Name: "hello", Version: "1.0"},
+		PackageName: "hello",
+		OutDir:      ctx.OutDir,
+		Logger:      log.New(io.Discard, "", 0),
+		Arch:        "x86_64",
+	}
+
+	require.NoError(t, os.MkdirAll(pc.WorkspaceSubdir(), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(pc.WorkspaceSubdir(), "hello"), []byte("hello"), 0644))
+	require.NoError(t, pc.EmitPackage())
+
+	data, err := os.ReadFile(pc.Filename())
+	require.NoError(t, err)
+
+	sigs, _, err := sign.SplitSignatures(data)
+	require.NoError(t, err)
+	require.Len(t, sigs, 1)
+	require.Equal(t, sign.CertificateSignatureName, sigs[0].Name)
+
+	// The package verifies against the root of the certificate
+	// authority, with no key distributed.
+	v, err := sign.Verify(bytes.NewReader(data), nil, ca.Roots())
+	require.NoError(t, err)
+	require.Equal(t, sign.KindPackage, v.Kind)
+	require.Equal(t, []string{"builder@example.com"}, v.Certificate.EmailAddresses)
+
+	_, err = sign.Verify(bytes.NewReader(data), nil, x509.NewCertPool())
+	require.ErrorIs(t, err, sign.ErrUntrusted)
+}
+
+func TestSigningSummary(t *testing.T) {
+	for _, tt := range []struct {
+		description string
+		ctx         *Context
+		want        string
+	}{
+		{"unsigned", &Context{}, "none, packages will not be signed"},
+		{"key", &Context{SigningKey: "melange.rsa"}, "with key melange.rsa"},
+		{"keyless", &Context{Signer: sign.NewKeylessSigner(&sign.FulcioCA{URL: "https://fulcio.example.com"})}, "keyless, with certificates issued by https://fulcio.example.com"},
+		{"key over keyless", &Context{SigningKey: "melange.rsa", Signer: sign.NewKeylessSigner(signtest.NewCA(t))}, "with key melange.rsa"},
+	} {
+		t.Run(tt.description, func(t *testing.T) {
+			var buf bytes.Buffer
+			tt.ctx.Logger = log.New(&buf, "", 0)
+			tt.ctx.Summarize()
+			require.Contains(t, buf.String(), "  signing: "+tt.want+"\n")
+		})
+	}
+}
+
+func TestEmitPackagesDeterministic(t *testing.T) {
+	emit := func(jobs int) map[string][]byte {
+		ctx := &Context{
+			Configuration: Configuration{
+				Package: Package{
+					Name:      "hello",
+					Version:   "1.0",
+					Copyright: []Copyright{{License: "MIT", Attestation: "Copyright Hello Authors"}},
+				},
+			},
+			WorkspaceDir:    t.TempDir(),
+			OutDir:          t.TempDir(),
+			SourceDateEpoch: time.Unix(0, 0),
+			Arch:            apko_types.ParseArchitecture("x86_64"),
+			Logger:          log.New(io.Discard, "", 0),
+			Jobs:            jobs,
+		}
+		ctx.DependencyLog = filepath.Join(ctx.OutDir, "deps.json")
+
+		for i := 0; i < 8; i++ {
+			ctx.Configuration.Subpackages = append(ctx.Configuration.Subpackages, Subpackage{Name: fmt.Sprintf("hello-%d", i)})
+		}
+
+		pctx := &PipelineContext{Context: ctx, Package: &ctx.Configuration.Package}
+		pcs := []*PackageContext{ctx.Configuration.Package.packageContext(pctx)}
+		for i := range ctx.Configuration.Subpackages {
+			pcs = append(pcs, ctx.Configuration.Subpackages[i].packageContext(pctx))
+		}
+
+		// each library imports the one of the previous package, so
+		// that the packages depend on each other
+		for i, pc := range pcs {
+			pc.Logger = log.New(io.Discard, "", 0)
+
+			files := map[string][]byte{
+				fmt.Sprintf("usr/bin/%s", pc.PackageName):              []byte("#!/bin/sh\n"),
+				fmt.Sprintf("usr/share/doc/%s/README", pc.PackageName): []byte(pc.PackageName),
+			}
+			entries := []testDynEntry{{elf.DT_SONAME, fmt.Sprintf("lib%s.so.1", pc.PackageName)}}
+			if i > 0 {
+				entries = append(entries, testDynEntry{elf.DT_NEEDED, fmt.Sprintf("lib%s.so.1", pcs[i-1].PackageName)})
+			}
+			files[fmt.Sprintf("usr/lib/lib%s.so.1", pc.PackageName)] = testELF(entries...)
+
+			for name, data := range files {
+				p := filepath.Join(pc.WorkspaceSubdir(), name)
+				require.NoError(t, os.MkdirAll(filepath.Dir(p), 0755))
+				require.NoError(t, os.WriteFile(p, data, 0755))
+			}
+		}
+
+		require.NoError(t, ctx.emitPackages(pcs))
+
+		outputs := map[string][]byte{}
+		require.NoError(t, filepath.WalkDir(ctx.OutDir, func(p string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return err
+			}
+
+			rel, err := filepath.Rel(ctx.OutDir, p)
+			if err != nil {
+				return err
+			}
+			outputs[rel], err = os.ReadFile(p)
+			return err
+		}))
+
+		return outputs
+	}
+
+	serial := emit(1)
+	require.Contains(t, serial, filepath.Join("x86_64", "hello-7-1.0-r0.apk"))
+	require.Contains(t, serial, "deps.json.x86_64")
+
+	for _, jobs := range []int{4, 16} {
+		concurrent := emit(jobs)
+		require.Equal(t, len(serial), len(concurrent))
+		for name, data := range serial {
+			require.True(t, bytes.Equal(data, concurrent[name]), "%s differs with %d jobs", name, jobs)
+		}
+	}
+}
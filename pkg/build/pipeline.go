@@ -16,6 +16,8 @@ package build
 
 import (
 	"bufio"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -24,7 +26,9 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
+	"chainguard.dev/melange/pkg/cond"
 	"gopkg.in/yaml.v3"
 )
 
@@ -34,6 +38,7 @@ const (
 	substitutionPackageEpoch   = "${{package.epoch}}"
 	substitutionTargetsDestdir = "${{targets.destdir}}"
 	substitutionSubPkgDir      = "${{targets.subpkgdir}}"
+	substitutionBuildArch      = "${{build.arch}}"
 )
 
 type PipelineContext struct {
@@ -42,6 +47,30 @@ type PipelineContext struct {
 	Subpackage *Subpackage
 }
 
+// PipelineInterruptedError is returned when a pipeline step is killed
+// because it exceeded its timeout or the build was canceled.
+type PipelineInterruptedError struct {
+	Step string
+
+	// Timeout is the timeout of the step, if it exceeded it, or zero
+	// if the build was canceled.
+	Timeout time.Duration
+
+	// Err is context.DeadlineExceeded or context.Canceled.
+	Err error
+}
+
+func (e *PipelineInterruptedError) Error() string {
+	if e.Timeout > 0 {
+		return fmt.Sprintf("step %s timed out after %s", e.Step, e.Timeout)
+	}
+	return fmt.Sprintf("step %s was interrupted: %v", e.Step, e.Err)
+}
+
+func (e *PipelineInterruptedError) Unwrap() error {
+	return e.Err
+}
+
 func (p *Pipeline) Identity() string {
 	if p.Name != "" {
 		return p.Name
@@ -87,6 +116,7 @@ func substitutionMap(ctx *PipelineContext) map[string]string {
 		substitutionPackageVersion: ctx.Package.Version,
 		substitutionPackageEpoch:   strconv.FormatUint(ctx.Package.Epoch, 10),
 		substitutionTargetsDestdir: fmt.Sprintf("/home/build/melange-out/%s", ctx.Package.Name),
+		substitutionBuildArch:      ctx.Context.Arch.ToAPK(),
 	}
 
 	if ctx.Subpackage != nil {
@@ -139,14 +169,32 @@ func validateWith(data map[string]string, inputs map[string]Input) (map[string]s
 	return data, nil
 }
 
+// builtinPipeline is a pipeline which is implemented by melange rather
+// than loaded from the pipeline directory, and runs on the host.
+type builtinPipeline struct {
+	Name   string
+	Inputs map[string]Input
+	Run    func(goctx context.Context, ctx *PipelineContext, p *Pipeline) error
+}
+
+// builtinPipelines are looked up before the pipeline directory.
+var builtinPipelines = map[string]*builtinPipeline{
+	"fetch": &fetchPipeline,
+}
+
 func (p *Pipeline) loadUse(ctx *PipelineContext, uses string, with map[string]string) error {
-	data, err := os.ReadFile(filepath.Join(ctx.Context.PipelineDir, uses+".yaml"))
-	if err != nil {
-		return fmt.Errorf("unable to load pipeline: %w", err)
-	}
+	if b, ok := builtinPipelines[uses]; ok {
+		p.Inputs = b.Inputs
+		p.builtin = b
+	} else {
+		data, err := os.ReadFile(filepath.Join(ctx.Context.PipelineDir, uses+".yaml"))
+		if err != nil {
+			return fmt.Errorf("unable to load pipeline: %w", err)
+		}
 
-	if err := yaml.Unmarshal(data, p); err != nil {
-		return fmt.Errorf("unable to parse pipeline: %w", err)
+		if err := yaml.Unmarshal(data, p); err != nil {
+			return fmt.Errorf("unable to parse pipeline: %w", err)
+		}
 	}
 
 	validated, err := validateWith(with, p.Inputs)
@@ -168,7 +216,7 @@ func (p *Pipeline) dumpWith() {
 	}
 }
 
-func (p *Pipeline) evalUse(ctx *PipelineContext) error {
+func (p *Pipeline) evalUse(goctx context.Context, ctx *PipelineContext) error {
 	sp, err := NewPipeline(ctx)
 	if err != nil {
 		return err
@@ -181,7 +229,7 @@ func (p *Pipeline) evalUse(ctx *PipelineContext) error {
 	p.logger.Printf("  using %s", p.Uses)
 	sp.dumpWith()
 
-	if err := sp.Run(ctx); err != nil {
+	if err := sp.Run(goctx, ctx); err != nil {
 		return err
 	}
 
@@ -203,33 +251,19 @@ func (p *Pipeline) monitorPipe(pipe io.ReadCloser, finish chan struct{}) {
 	finish <- struct{}{}
 }
 
-func (p *Pipeline) evalRun(ctx *PipelineContext) error {
+func (p *Pipeline) evalRun(goctx context.Context, ctx *PipelineContext) error {
 	p.With = mutateWith(ctx, p.With)
 	p.dumpWith()
 
 	fragment := mutateStringFromMap(p.With, p.Runs)
+	ctx.recordStep(provenanceStep{Name: p.Name, Runs: fragment})
+
 	sys_path := "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
 	script := fmt.Sprintf("#!/bin/sh\nset -e\nexport PATH=%s\n%s\nexit 0\n", sys_path, fragment)
 	command := []string{"/bin/sh", "-c", script}
 
-	cmd, err := ctx.Context.WorkspaceCmd(command...)
-	if err != nil {
-		return err
-	}
-
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		return err
-	}
-
-	stderr, err := cmd.StderrPipe()
-	if err != nil {
-		return err
-	}
-
-	if err := cmd.Start(); err != nil {
-		return err
-	}
+	stdout, stdoutWriter := io.Pipe()
+	stderr, stderrWriter := io.Pipe()
 
 	finishStdout := make(chan struct{})
 	finishStderr := make(chan struct{})
@@ -237,36 +271,95 @@ func (p *Pipeline) evalRun(ctx *PipelineContext) error {
 	go p.monitorPipe(stdout, finishStdout)
 	go p.monitorPipe(stderr, finishStderr)
 
-	if err := cmd.Wait(); err != nil {
-		return err
-	}
+	err := ctx.Context.Runner.Run(goctx, ctx.Context.RunnerConfig(), stdoutWriter, stderrWriter, command...)
+
+	stdoutWriter.Close()
+	stderrWriter.Close()
 
 	<-finishStdout
 	<-finishStderr
 
-	return nil
+	return err
 }
 
-func (p *Pipeline) Run(ctx *PipelineContext) error {
+func (p *Pipeline) Run(goctx context.Context, ctx *PipelineContext) error {
 	if p.logger == nil {
 		if err := p.initializeFromContext(ctx); err != nil {
 			return err
 		}
 	}
 
+	if err := goctx.Err(); err != nil {
+		return &PipelineInterruptedError{Step: p.Identity(), Err: err}
+	}
+
+	if run, err := p.shouldRun(ctx); err != nil {
+		return err
+	} else if !run {
+		p.logger.Printf("skipping step %s, condition %q is false", p.Identity(), p.If)
+		return nil
+	}
+
 	if p.Identity() != "???" {
 		p.logger.Printf("running step %s", p.Identity())
 	}
 
+	stepctx := goctx
+	if p.Timeout > 0 {
+		var cancel context.CancelFunc
+		stepctx, cancel = context.WithTimeout(goctx, p.Timeout)
+		defer cancel()
+	}
+
+	err := p.run(stepctx, ctx)
+	if err == nil {
+		return nil
+	}
+
+	var interrupted *PipelineInterruptedError
+	switch {
+	case goctx.Err() != nil:
+		// Report the innermost step which was running when the build
+		// was canceled.
+		if errors.As(err, &interrupted) {
+			return err
+		}
+		return &PipelineInterruptedError{Step: p.Identity(), Err: goctx.Err()}
+	case stepctx.Err() != nil:
+		return &PipelineInterruptedError{Step: p.Identity(), Timeout: p.Timeout, Err: stepctx.Err()}
+	}
+
+	return err
+}
+
+// shouldRun evaluates the condition of the step, if it has one.
+func (p *Pipeline) shouldRun(ctx *PipelineContext) (bool, error) {
+	if p.If == "" {
+		return true, nil
+	}
+
+	result, err := cond.Evaluate(p.If, mutateWith(ctx, p.With))
+	if err != nil {
+		return false, fmt.Errorf("unable to evaluate condition %q of step %s: %w", p.If, p.Identity(), err)
+	}
+
+	return result, nil
+}
+
+func (p *Pipeline) run(goctx context.Context, ctx *PipelineContext) error {
+	if p.builtin != nil {
+		ctx.recordStep(provenanceStep{Name: p.Name, Uses: p.builtin.Name, With: inputValues(p.With)})
+		return p.builtin.Run(goctx, ctx, p)
+	}
 	if p.Uses != "" {
-		return p.evalUse(ctx)
+		return p.evalUse(goctx, ctx)
 	}
 	if p.Runs != "" {
-		return p.evalRun(ctx)
+		return p.evalRun(goctx, ctx)
 	}
 
 	for _, sp := range p.Pipeline {
-		if err := sp.Run(ctx); err != nil {
+		if err := sp.Run(goctx, ctx); err != nil {
 			return err
 		}
 	}
@@ -299,6 +392,19 @@ func NewPipeline(ctx *PipelineContext) (*Pipeline, error) {
 func (p *Pipeline) ApplyNeeds(ctx *PipelineContext) error {
 	ic := &ctx.Context.Configuration.Environment
 
+	if p.logger == nil {
+		if err := p.initializeFromContext(ctx); err != nil {
+			return err
+		}
+	}
+
+	if run, err := p.shouldRun(ctx); err != nil {
+		return err
+	} else if !run {
+		p.logger.Printf("  skipping requirements of step %s, condition %q is false", p.Identity(), p.If)
+		return nil
+	}
+
 	for _, pkg := range p.Needs.Packages {
 		p.logger.Printf("  adding package %q for pipeline %q", pkg, p.Identity())
 		ic.Contents.Packages = append(ic.Contents.Packages, pkg)
@@ -15,8 +15,14 @@
 package build
 
 import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
+	apko_types "chainguard.dev/apko/pkg/build/types"
 	"github.com/stretchr/testify/require"
 )
 
@@ -31,3 +37,131 @@ func Test_mutateStringFromMap(t *testing.T) {
 
 	require.Equal(t, output1, "foo ", "bogus variable substitution not deleted")
 }
+
+func TestPipelineRunCanceled(t *testing.T) {
+	goctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	p := Pipeline{Name: "hang", Runs: "sleep 1000"}
+	err := p.Run(goctx, &PipelineContext{
+		Context: &Context{},
+		Package: &Package{Name: "hello"},
+	})
+
+	var interrupted *PipelineInterruptedError
+	require.ErrorAs(t, err, &interrupted)
+	require.Equal(t, "hang", interrupted.Step)
+	require.ErrorIs(t, err, context.Canceled)
+}
+
+func TestPipelineRunTimeout(t *testing.T) {
+	ctx := &Context{
+		WorkspaceDir: t.TempDir(),
+		Runner:       HostRunner(),
+	}
+
+	// The step starts a process in the background, which must be killed
+	// along with the shell when the step times out.
+	p := Pipeline{Name: "hang", Runs: "sleep 1000 & echo $! > sleep.pid; wait", Timeout: 100 * time.Millisecond}
+
+	start := time.Now()
+	err := p.Run(context.Background(), &PipelineContext{
+		Context: ctx,
+		Package: &Package{Name: "hello"},
+	})
+
+	var interrupted *PipelineInterruptedError
+	require.ErrorAs(t, err, &interrupted)
+	require.Equal(t, "hang", interrupted.Step)
+	require.Equal(t, p.Timeout, interrupted.Timeout)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.EqualError(t, err, "step hang timed out after 100ms")
+	require.Less(t, time.Since(start), 10*time.Second)
+
+	data, err := os.ReadFile(filepath.Join(ctx.WorkspaceDir, "sleep.pid"))
+	require.NoError(t, err)
+	pid := strings.TrimSpace(string(data))
+	require.Eventually(t, func() bool { return !processRunning(pid) }, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestPipelineRunNestedTimeout(t *testing.T) {
+	ctx := &Context{
+		WorkspaceDir: t.TempDir(),
+		Runner:       HostRunner(),
+	}
+
+	// The step which exceeded its timeout is reported, not the one it
+	// is nested in.
+	p := Pipeline{Name: "outer", Pipeline: []Pipeline{
+		{Name: "quick", Runs: "true"},
+		{Name: "slow", Runs: "sleep 1000", Timeout: 100 * time.Millisecond},
+	}}
+
+	err := p.Run(context.Background(), &PipelineContext{
+		Context: ctx,
+		Package: &Package{Name: "hello"},
+	})
+
+	var interrupted *PipelineInterruptedError
+	require.ErrorAs(t, err, &interrupted)
+	require.Equal(t, "slow", interrupted.Step)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+// processRunning returns whether the process with the given pid is
+// running, zombies which were not reaped yet excepted.
+func processRunning(pid string) bool {
+	data, err := os.ReadFile(filepath.Join("/proc", pid, "stat"))
+	if err != nil {
+		return false
+	}
+
+	// the state follows the command name, which is in parentheses
+	stat := string(data)
+	fields := strings.Fields(stat[strings.LastIndex(stat, ")")+1:])
+	return len(fields) > 0 && fields[0] != "Z"
+}
+
+func TestPipelineApplyNeedsCondition(t *testing.T) {
+	ctx := &Context{Arch: apko_types.ParseArchitecture("x86_64")}
+	pctx := &PipelineContext{
+		Context: ctx,
+		Package: &Package{Name: "hello"},
+	}
+
+	pipelines := []Pipeline{{
+		If:    "${{build.arch}} == 'aarch64'",
+		Needs: Needs{Packages: []string{"aarch64-only"}},
+	}, {
+		If:    "${{build.arch}} == 'x86_64' && ${{inputs.patch}} != ''",
+		With:  map[string]string{"patch": "fix.patch"},
+		Needs: Needs{Packages: []string{"patch"}},
+	}}
+
+	for _, p := range pipelines {
+		require.NoError(t, p.ApplyNeeds(pctx))
+	}
+
+	require.Equal(t, []string{"patch"}, ctx.Configuration.Environment.Contents.Packages)
+}
+
+func TestPipelineRunHostRunner(t *testing.T) {
+	ctx := &Context{
+		WorkspaceDir:    t.TempDir(),
+		SourceDateEpoch: time.Unix(1234, 0),
+		Runner:          HostRunner(),
+	}
+
+	p := Pipeline{
+		Runs: `echo "${{inputs.greeting}} $SOURCE_DATE_EPOCH" > ${{package.name}}.txt`,
+		With: map[string]string{"greeting": "hello"},
+	}
+	require.NoError(t, p.Run(context.Background(), &PipelineContext{
+		Context: ctx,
+		Package: &Package{Name: "hello"},
+	}))
+
+	data, err := os.ReadFile(filepath.Join(ctx.WorkspaceDir, "hello.txt"))
+	require.NoError(t, err)
+	require.Equal(t, "hello 1234\n", string(data))
+}
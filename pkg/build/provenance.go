@@ -0,0 +1,268 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	provenanceStatementType = "https://in-toto.io/Statement/v0.1"
+	provenancePredicateType = "https://slsa.dev/provenance/v0.2"
+	provenanceBuilderID     = "https://github.com/chainguard-dev/melange"
+	provenanceBuildType     = "https://github.com/chainguard-dev/melange/build@v1"
+)
+
+// buildRecord holds what went into a build, for its provenance.
+type buildRecord struct {
+	steps     []provenanceStep
+	materials []provenanceMaterial
+	packages  []provenancePackage
+}
+
+type provenanceDigest map[string]string
+
+type provenanceSubject struct {
+	Name   string           `json:"name"`
+	Digest provenanceDigest `json:"digest"`
+}
+
+type provenanceMaterial struct {
+	URI    string           `json:"uri"`
+	Digest provenanceDigest `json:"digest"`
+}
+
+// provenanceStep is a pipeline step which ran, with its inputs or script
+// fully expanded.
+type provenanceStep struct {
+	// Package is the package or subpackage whose pipeline the step is
+	// part of.
+	Package string            `json:"package"`
+	Name    string            `json:"name,omitempty"`
+	Uses    string            `json:"uses,omitempty"`
+	With    map[string]string `json:"with,omitempty"`
+	Runs    string            `json:"runs,omitempty"`
+}
+
+// provenancePackage is a package installed in the build environment.
+type provenancePackage struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type provenanceConfigSource struct {
+	URI        string           `json:"uri,omitempty"`
+	Digest     provenanceDigest `json:"digest,omitempty"`
+	EntryPoint string           `json:"entryPoint"`
+}
+
+type provenanceInvocation struct {
+	ConfigSource provenanceConfigSource `json:"configSource"`
+	Parameters   map[string]interface{} `json:"parameters,omitempty"`
+	Environment  map[string]string      `json:"environment"`
+}
+
+type provenanceBuildConfig struct {
+	Steps       []provenanceStep    `json:"steps"`
+	Environment []provenancePackage `json:"environment"`
+}
+
+type provenancePredicate struct {
+	Builder struct {
+		ID string `json:"id"`
+	} `json:"builder"`
+	BuildType   string                `json:"buildType"`
+	Invocation  provenanceInvocation  `json:"invocation"`
+	BuildConfig provenanceBuildConfig `json:"buildConfig"`
+	Materials   []provenanceMaterial  `json:"materials"`
+}
+
+type provenanceStatement struct {
+	Type          string              `json:"_type"`
+	Subject       []provenanceSubject `json:"subject"`
+	PredicateType string              `json:"predicateType"`
+	Predicate     provenancePredicate `json:"predicate"`
+}
+
+// recordStep records a step of the pipeline of the package or subpackage
+// being built.
+func (ctx *PipelineContext) recordStep(step provenanceStep) {
+	step.Package = ctx.Package.Name
+	if ctx.Subpackage != nil {
+		step.Package = ctx.Subpackage.Name
+	}
+
+	ctx.Context.record.steps = append(ctx.Context.record.steps, step)
+}
+
+// recordMaterial records an artifact fetched during the build.
+func (ctx *Context) recordMaterial(uri, digest string) {
+	ctx.record.materials = append(ctx.record.materials, provenanceMaterial{
+		URI:    uri,
+		Digest: provenanceDigest{"sha256": digest},
+	})
+}
+
+// inputValues returns the values of the inputs of a step, keyed by the
+// name of the input.
+func inputValues(with map[string]string) map[string]string {
+	values := map[string]string{}
+	for k, v := range with {
+		if strings.HasPrefix(k, "${{inputs.") {
+			values[strings.TrimSuffix(strings.TrimPrefix(k, "${{inputs."), "}}")] = v
+		}
+	}
+
+	return values
+}
+
+// installedPackages returns the packages recorded in the apk database of
+// the guest.
+func installedPackages(guestDir string) ([]provenancePackage, error) {
+	f, err := os.Open(filepath.Join(guestDir, "lib", "apk", "db", "installed"))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	pkgs := []provenancePackage{}
+	var cur provenancePackage
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			if cur.Name != "" {
+				pkgs = append(pkgs, cur)
+			}
+			cur = provenancePackage{}
+		case strings.HasPrefix(line, "P:"):
+			cur.Name = line[2:]
+		case strings.HasPrefix(line, "V:"):
+			cur.Version = line[2:]
+		}
+	}
+	if cur.Name != "" {
+		pkgs = append(pkgs, cur)
+	}
+
+	return pkgs, scanner.Err()
+}
+
+// ProvenanceFilename returns the path of the provenance document written
+// next to the package.
+func (pc *PackageContext) ProvenanceFilename() string {
+	return fmt.Sprintf("%s/%s.provenance.json", pc.OutDir, pc.Identity())
+}
+
+// configSourceURI returns the configuration file as it is recorded in
+// the provenance: relative to the working directory if it is within it,
+// or its base name otherwise, so that the provenance does not depend on
+// where the build ran.  The digest identifies its contents.
+func configSourceURI(configFile string) string {
+	wd, err := os.Getwd()
+	if err != nil {
+		return filepath.Base(configFile)
+	}
+
+	abs, err := filepath.Abs(configFile)
+	if err != nil {
+		return filepath.Base(configFile)
+	}
+
+	rel, err := filepath.Rel(wd, abs)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return filepath.Base(configFile)
+	}
+
+	return filepath.ToSlash(rel)
+}
+
+// emitProvenance writes the provenance document of the emitted package:
+// an in-toto statement with a SLSA provenance predicate describing the
+// configuration, the expanded pipeline steps, the build environment and
+// the fetched sources it was built from.
+func (pc *PackageContext) emitProvenance() error {
+	apkDigest, err := fileDigest(pc.Filename())
+	if err != nil {
+		return fmt.Errorf("unable to compute package digest: %w", err)
+	}
+
+	ctx := pc.Context
+	stmt := provenanceStatement{
+		Type: provenanceStatementType,
+		Subject: []provenanceSubject{{
+			Name:   filepath.Base(pc.Filename()),
+			Digest: provenanceDigest{"sha256": apkDigest},
+		}},
+		PredicateType: provenancePredicateType,
+	}
+
+	pred := &stmt.Predicate
+	pred.Builder.ID = provenanceBuilderID
+	pred.BuildType = provenanceBuildType
+	pred.Invocation.ConfigSource.EntryPoint = pc.PackageName
+	pred.Invocation.Environment = map[string]string{
+		"arch":              pc.Arch,
+		"SOURCE_DATE_EPOCH": fmt.Sprintf("%d", ctx.SourceDateEpoch.Unix()),
+	}
+
+	if ctx.ConfigFile != "" {
+		configDigest, err := fileDigest(ctx.ConfigFile)
+		if err != nil {
+			return fmt.Errorf("unable to compute configuration digest: %w", err)
+		}
+		pred.Invocation.ConfigSource.URI = configSourceURI(ctx.ConfigFile)
+		pred.Invocation.ConfigSource.Digest = provenanceDigest{"sha256": configDigest}
+	}
+
+	if ctx.Template != "" {
+		if err := json.Unmarshal([]byte(ctx.Template), &pred.Invocation.Parameters); err != nil {
+			return fmt.Errorf("unable to parse template values: %w", err)
+		}
+	}
+
+	pred.BuildConfig.Steps = ctx.record.steps
+	if pred.BuildConfig.Steps == nil {
+		pred.BuildConfig.Steps = []provenanceStep{}
+	}
+	pred.BuildConfig.Environment = ctx.record.packages
+	if pred.BuildConfig.Environment == nil {
+		pred.BuildConfig.Environment = []provenancePackage{}
+	}
+	pred.Materials = ctx.record.materials
+	if pred.Materials == nil {
+		pred.Materials = []provenanceMaterial{}
+	}
+
+	data, err := json.MarshalIndent(stmt, "", "  ")
+	if err != nil {
+		return fmt.Errorf("unable to encode provenance: %w", err)
+	}
+
+	if err := os.WriteFile(pc.ProvenanceFilename(), append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("unable to write provenance: %w", err)
+	}
+
+	pc.Logger.Printf("wrote %s", pc.ProvenanceFilename())
+
+	return nil
+}
@@ -0,0 +1,117 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEmitProvenance(t *testing.T) {
+	dir := t.TempDir()
+	configFile, configDigest := writeTestArtifact(t, dir, "hello.yaml", []byte("package:\n  name: hello\n"))
+	artifact, artifactDigest := writeTestArtifact(t, dir, "hello-1.0.tar.gz", []byte("not extracted"))
+
+	guestDir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(guestDir, "lib", "apk", "db"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(guestDir, "lib", "apk", "db", "installed"),
+		[]byte("C:Q1abc=\nP:busybox\nV:1.35.0-r17\nA:x86_64\n\nP:make\nV:4.3-r0\n"), 0644))
+	pkgs, err := installedPackages(guestDir)
+	require.NoError(t, err)
+
+	ctx := &Context{
+		ConfigFile:      configFile,
+		Template:        `{"Version": "1.0"}`,
+		WorkspaceDir:    t.TempDir(),
+		OutDir:          t.TempDir(),
+		CacheDir:        t.TempDir(),
+		SourceDateEpoch: time.Unix(1234, 0),
+		Runner:          HostRunner(),
+		record:          buildRecord{packages: pkgs},
+	}
+	pctx := &PipelineContext{Context: ctx, Package: &Package{Name: "hello", Version: "1.0"}}
+
+	fetch := Pipeline{Uses: "fetch", With: map[string]string{
+		"uri":             "file://" + artifact,
+		"expected-sha256": artifactDigest,
+		"extract":         "false",
+	}}
+	require.NoError(t, fetch.Run(context.Background(), pctx))
+
+	build := Pipeline{Name: "build", Runs: "mkdir -p melange-out/${{package.name}} && echo ${{package.version}} > melange-out/${{package.name}}/version"}
+	require.NoError(t, build.Run(context.Background(), pctx))
+
+	pc := &PackageContext{
+		Context:     ctx,
+		Origin:      pctx.Package,
+		PackageName: "hello",
+		OutDir:      ctx.OutDir,
+		Logger:      log.New(io.Discard, "", 0),
+		Arch:        "x86_64",
+	}
+	require.NoError(t, pc.EmitPackage())
+
+	apkDigest, err := fileDigest(pc.Filename())
+	require.NoError(t, err)
+
+	data, err := os.ReadFile(pc.ProvenanceFilename())
+	require.NoError(t, err)
+
+	var stmt provenanceStatement
+	require.NoError(t, json.Unmarshal(data, &stmt))
+
+	require.Equal(t, provenancePredicateType, stmt.PredicateType)
+	require.Equal(t, []provenanceSubject{{Name: "hello-1.0-r0.apk", Digest: provenanceDigest{"sha256": apkDigest}}}, stmt.Subject)
+
+	pred := stmt.Predicate
+	require.Equal(t, provenanceConfigSource{URI: "hello.yaml", Digest: provenanceDigest{"sha256": configDigest}, EntryPoint: "hello"}, pred.Invocation.ConfigSource)
+	require.Equal(t, map[string]interface{}{"Version": "1.0"}, pred.Invocation.Parameters)
+	require.Equal(t, "1234", pred.Invocation.Environment["SOURCE_DATE_EPOCH"])
+	require.Equal(t, []provenancePackage{{Name: "busybox", Version: "1.35.0-r17"}, {Name: "make", Version: "4.3-r0"}}, pred.BuildConfig.Environment)
+	require.Equal(t, []provenanceMaterial{{URI: "file://" + artifact, Digest: provenanceDigest{"sha256": artifactDigest}}}, pred.Materials)
+
+	require.Len(t, pred.BuildConfig.Steps, 2)
+	require.Equal(t, "fetch", pred.BuildConfig.Steps[0].Uses)
+	require.Equal(t, "file://"+artifact, pred.BuildConfig.Steps[0].With["uri"])
+	require.Equal(t, provenanceStep{Package: "hello", Name: "build", Runs: "mkdir -p melange-out/hello && echo 1.0 > melange-out/hello/version"}, pred.BuildConfig.Steps[1])
+}
+
+func TestConfigSourceURI(t *testing.T) {
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+
+	for _, tt := range []struct {
+		configFile string
+		want       string
+	}{
+		{"hello.yaml", "hello.yaml"},
+		{"./examples/hello.yaml", "examples/hello.yaml"},
+		{filepath.Join(wd, "examples", "hello.yaml"), "examples/hello.yaml"},
+		{"../hello.yaml", "hello.yaml"},
+		{"/home/builder/src/hello.yaml", "hello.yaml"},
+	} {
+		t.Run(tt.configFile, func(t *testing.T) {
+			require.Equal(t, tt.want, configSourceURI(tt.configFile))
+		})
+	}
+}
@@ -0,0 +1,288 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+// BindMount describes a host path which is made available in the guest.
+type BindMount struct {
+	Source      string
+	Destination string
+}
+
+// RunnerConfig describes the guest which commands are run in.
+type RunnerConfig struct {
+	// GuestDir is the host directory holding the root filesystem of
+	// the guest.
+	GuestDir string
+
+	// WorkDir is the directory in the guest commands are run from.
+	WorkDir string
+
+	// Mounts are the host paths bound into the guest.
+	Mounts []BindMount
+
+	// Environment is set for every command run in the guest.
+	Environment map[string]string
+}
+
+// Runner runs commands in a build guest.
+type Runner interface {
+	// Name returns the name of the runner, as accepted by GetRunner.
+	Name() string
+
+	// Prepare is called once the guest has been built, before any
+	// command is run in it.
+	Prepare(goctx context.Context, cfg *RunnerConfig) error
+
+	// Run runs args in the guest, writing its output to stdout and
+	// stderr.  The command and anything it started are killed when
+	// goctx is done, in which case goctx.Err() is returned.
+	Run(goctx context.Context, cfg *RunnerConfig, stdout, stderr io.Writer, args ...string) error
+
+	// Teardown is called once no more commands will be run in the
+	// guest.
+	Teardown(cfg *RunnerConfig) error
+}
+
+// Runners lists the names of the available runners.
+var Runners = []string{"bwrap", "proot"}
+
+// GetRunner returns the runner with the given name.
+func GetRunner(name string) (Runner, error) {
+	switch name {
+	case "bwrap":
+		return BubblewrapRunner(), nil
+	case "proot":
+		return ProotRunner(), nil
+	}
+
+	return nil, fmt.Errorf("unknown runner %q (available: %s)", name, strings.Join(Runners, ", "))
+}
+
+type bubblewrapRunner struct{}
+
+// BubblewrapRunner returns a runner which uses bwrap to run commands in
+// the guest, with their own PID namespace.
+func BubblewrapRunner() Runner {
+	return bubblewrapRunner{}
+}
+
+func (bubblewrapRunner) Name() string {
+	return "bwrap"
+}
+
+func (bubblewrapRunner) Prepare(goctx context.Context, cfg *RunnerConfig) error {
+	if _, err := exec.LookPath("bwrap"); err != nil {
+		return fmt.Errorf("unable to find bwrap: %w", err)
+	}
+
+	return nil
+}
+
+func (bubblewrapRunner) Run(goctx context.Context, cfg *RunnerConfig, stdout, stderr io.Writer, args ...string) error {
+	baseargs := []string{"--bind", cfg.GuestDir, "/"}
+	for _, m := range cfg.Mounts {
+		baseargs = append(baseargs, "--bind", m.Source, m.Destination)
+	}
+	baseargs = append(baseargs,
+		"--unshare-pid",
+		"--dev", "/dev",
+		"--proc", "/proc",
+		"--chdir", cfg.WorkDir,
+	)
+	for _, k := range sortedEnvironment(cfg.Environment) {
+		baseargs = append(baseargs, "--setenv", k, cfg.Environment[k])
+	}
+
+	cmd := exec.Command("bwrap", append(baseargs, args...)...)
+
+	return runCommand(goctx, cmd, stdout, stderr)
+}
+
+func (bubblewrapRunner) Teardown(cfg *RunnerConfig) error {
+	return nil
+}
+
+type prootRunner struct{}
+
+// ProotRunner returns a runner which uses proot to run commands in the
+// guest, which does not require user namespaces.
+func ProotRunner() Runner {
+	return prootRunner{}
+}
+
+func (prootRunner) Name() string {
+	return "proot"
+}
+
+func (prootRunner) Prepare(goctx context.Context, cfg *RunnerConfig) error {
+	if _, err := exec.LookPath("proot"); err != nil {
+		return fmt.Errorf("unable to find proot: %w", err)
+	}
+
+	return nil
+}
+
+func (prootRunner) Run(goctx context.Context, cfg *RunnerConfig, stdout, stderr io.Writer, args ...string) error {
+	baseargs := []string{"-S", cfg.GuestDir, "-i", "1000:1000"}
+	for _, m := range cfg.Mounts {
+		baseargs = append(baseargs, "-b", fmt.Sprintf("%s:%s", m.Source, m.Destination))
+	}
+	baseargs = append(baseargs, "-w", cfg.WorkDir)
+
+	cmd := exec.Command("proot", append(baseargs, args...)...)
+	cmd.Env = environ(cfg.Environment)
+
+	return runCommand(goctx, cmd, stdout, stderr)
+}
+
+func (prootRunner) Teardown(cfg *RunnerConfig) error {
+	return nil
+}
+
+type hostRunner struct{}
+
+// HostRunner returns a runner which runs commands directly on the host,
+// without any isolation, from the host directory mounted at the working
+// directory of the guest.  The guest filesystem is not used, and the
+// absolute guest paths pipelines are given, such as their destination
+// directory, are not mapped to the host, so this is only suitable for
+// testing and is not one of Runners.
+func HostRunner() Runner {
+	return hostRunner{}
+}
+
+func (hostRunner) Name() string {
+	return "host"
+}
+
+func (hostRunner) Prepare(goctx context.Context, cfg *RunnerConfig) error {
+	return nil
+}
+
+func (hostRunner) Run(goctx context.Context, cfg *RunnerConfig, stdout, stderr io.Writer, args ...string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("no command to run")
+	}
+
+	dir, err := hostPath(cfg, cfg.WorkDir)
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Dir = dir
+	cmd.Env = environ(cfg.Environment)
+
+	return runCommand(goctx, cmd, stdout, stderr)
+}
+
+func (hostRunner) Teardown(cfg *RunnerConfig) error {
+	return nil
+}
+
+// hostPath returns the host path of a guest path which is within one of
+// the mounts.
+func hostPath(cfg *RunnerConfig, guestPath string) (string, error) {
+	for _, m := range cfg.Mounts {
+		rel, err := filepath.Rel(m.Destination, guestPath)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+			continue
+		}
+
+		return filepath.Join(m.Source, rel), nil
+	}
+
+	return "", fmt.Errorf("%s is not within a mount", guestPath)
+}
+
+// environ returns the environment of the current process extended with
+// env.
+func environ(env map[string]string) []string {
+	out := os.Environ()
+	for _, k := range sortedEnvironment(env) {
+		out = append(out, fmt.Sprintf("%s=%s", k, env[k]))
+	}
+
+	return out
+}
+
+func sortedEnvironment(env map[string]string) []string {
+	keys := make([]string, 0, len(env))
+	for k := range env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+// runCommand runs cmd in its own process group, killing the whole group
+// when goctx is done, as killing only the process which was started
+// would leave anything it started running.
+func runCommand(goctx context.Context, cmd *exec.Cmd, stdout, stderr io.Writer) error {
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	if err := goctx.Err(); err != nil {
+		return err
+	}
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	finishCmd := make(chan struct{})
+	defer close(finishCmd)
+	go func() {
+		select {
+		case <-goctx.Done():
+			killProcessGroup(cmd)
+		case <-finishCmd:
+		}
+	}()
+
+	if err := cmd.Wait(); err != nil {
+		if goctx.Err() != nil {
+			return goctx.Err()
+		}
+		return err
+	}
+
+	return nil
+}
+
+// killProcessGroup kills the process group of a command started by
+// runCommand.
+func killProcessGroup(cmd *exec.Cmd) {
+	if cmd.Process == nil {
+		return
+	}
+
+	// The process group may already be gone, which is fine.
+	_ = syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
@@ -0,0 +1,326 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"crypto/sha1" // nolint:gosec
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	spdxVersion     = "SPDX-2.3"
+	spdxNoAssertion = "NOASSERTION"
+
+	// sbomDir is where the SBOM is embedded in the data section.
+	sbomDir = "var/lib/db/sbom"
+)
+
+type spdxChecksum struct {
+	Algorithm     string `json:"algorithm"`
+	ChecksumValue string `json:"checksumValue"`
+}
+
+type spdxExternalRef struct {
+	ReferenceCategory string `json:"referenceCategory"`
+	ReferenceType     string `json:"referenceType"`
+	ReferenceLocator  string `json:"referenceLocator"`
+}
+
+type spdxVerificationCode struct {
+	PackageVerificationCodeValue string `json:"packageVerificationCodeValue"`
+}
+
+type spdxPackage struct {
+	SPDXID                  string                `json:"SPDXID"`
+	Name                    string                `json:"name"`
+	VersionInfo             string                `json:"versionInfo,omitempty"`
+	Description             string                `json:"description,omitempty"`
+	DownloadLocation        string                `json:"downloadLocation"`
+	FilesAnalyzed           bool                  `json:"filesAnalyzed"`
+	PackageVerificationCode *spdxVerificationCode `json:"packageVerificationCode,omitempty"`
+	LicenseConcluded        string                `json:"licenseConcluded,omitempty"`
+	LicenseDeclared         string                `json:"licenseDeclared,omitempty"`
+	CopyrightText           string                `json:"copyrightText,omitempty"`
+	ExternalRefs            []spdxExternalRef     `json:"externalRefs,omitempty"`
+}
+
+type spdxFile struct {
+	SPDXID           string         `json:"SPDXID"`
+	FileName         string         `json:"fileName"`
+	Checksums        []spdxChecksum `json:"checksums"`
+	LicenseConcluded string         `json:"licenseConcluded"`
+	CopyrightText    string         `json:"copyrightText"`
+}
+
+type spdxRelationship struct {
+	Element string `json:"spdxElementId"`
+	Type    string `json:"relationshipType"`
+	Related string `json:"relatedSpdxElement"`
+}
+
+type spdxCreationInfo struct {
+	Created  string   `json:"created"`
+	Creators []string `json:"creators"`
+}
+
+type spdxDocument struct {
+	SPDXVersion       string             `json:"spdxVersion"`
+	DataLicense       string             `json:"dataLicense"`
+	SPDXID            string             `json:"SPDXID"`
+	Name              string             `json:"name"`
+	DocumentNamespace string             `json:"documentNamespace"`
+	CreationInfo      spdxCreationInfo   `json:"creationInfo"`
+	DocumentDescribes []string           `json:"documentDescribes"`
+	Packages          []spdxPackage      `json:"packages"`
+	Files             []spdxFile         `json:"files,omitempty"`
+	Relationships     []spdxRelationship `json:"relationships"`
+}
+
+var spdxIDInvalid = regexp.MustCompile(`[^a-zA-Z0-9.-]+`)
+
+// spdxIDs allocates the SPDX identifiers of a document.  They are
+// derived from names, which may map to the same identifier once the
+// characters SPDX does not allow are replaced, such as usr/lib/a_b and
+// usr/lib/a-b, so a counter is appended to keep them unique.
+type spdxIDs map[string]bool
+
+// id returns a new SPDX identifier of the given kind for name.
+func (ids spdxIDs) id(kind, name string) string {
+	base := fmt.Sprintf("SPDXRef-%s-%s", kind, spdxIDInvalid.ReplaceAllString(name, "-"))
+
+	id := base
+	for n := 2; ids[id]; n++ {
+		id = fmt.Sprintf("%s-%d", base, n)
+	}
+	ids[id] = true
+
+	return id
+}
+
+// SBOMFilename returns the path of the SBOM written next to the package.
+func (pc *PackageContext) SBOMFilename() string {
+	return fmt.Sprintf("%s/%s.spdx.json", pc.OutDir, pc.Identity())
+}
+
+// spdxLicense returns license, or NOASSERTION if it is empty.
+func spdxLicense(license string) string {
+	if license == "" {
+		return spdxNoAssertion
+	}
+	return license
+}
+
+// generateSBOM returns an SPDX document describing the package, with
+// every regular file of the package read from fsys, its dependencies
+// and its relationship to the other packages of the same build.
+func (pc *PackageContext) generateSBOM(fsys fs.FS) ([]byte, error) {
+	version := fmt.Sprintf("%s-r%d", pc.Origin.Version, pc.Origin.Epoch)
+	ids := spdxIDs{}
+	pkgID := ids.id("Package", pc.PackageName)
+
+	attestations := []string{}
+	for _, cp := range pc.Copyright {
+		if cp.Attestation != "" {
+			attestations = append(attestations, cp.Attestation)
+		}
+	}
+	copyright := spdxNoAssertion
+	if len(attestations) > 0 {
+		copyright = strings.Join(attestations, "\n")
+	}
+
+	pkg := spdxPackage{
+		SPDXID:           pkgID,
+		Name:             pc.PackageName,
+		VersionInfo:      version,
+		Description:      pc.Description,
+		DownloadLocation: spdxNoAssertion,
+		FilesAnalyzed:    true,
+		LicenseConcluded: spdxNoAssertion,
+		LicenseDeclared:  spdxLicense(pc.License),
+		CopyrightText:    copyright,
+	}
+
+	for _, prov := range pc.Dependencies.Provides {
+		pkg.ExternalRefs = append(pkg.ExternalRefs, spdxExternalRef{
+			ReferenceCategory: "OTHER",
+			ReferenceType:     "apk-provides",
+			ReferenceLocator:  prov,
+		})
+	}
+
+	doc := spdxDocument{
+		SPDXVersion:       spdxVersion,
+		DataLicense:       "CC0-1.0",
+		SPDXID:            "SPDXRef-DOCUMENT",
+		Name:              pc.Identity(),
+		DocumentNamespace: fmt.Sprintf("https://spdx.org/spdxdocs/melange/%s/%s", pc.Arch, pc.Identity()),
+		CreationInfo: spdxCreationInfo{
+			// The build date keeps the document reproducible.
+			Created:  pc.Context.SourceDateEpoch.UTC().Format(time.RFC3339),
+			Creators: []string{"Tool: melange"},
+		},
+		DocumentDescribes: []string{pkgID},
+		Relationships: []spdxRelationship{{
+			Element: "SPDXRef-DOCUMENT",
+			Type:    "DESCRIBES",
+			Related: pkgID,
+		}},
+	}
+
+	sha1s := []string{}
+	for _, f := range pc.files {
+		if !f.mode.IsRegular() {
+			continue
+		}
+		path := f.path
+
+		sha1sum, sha256sum, err := fsDigests(fsys, path)
+		if err != nil {
+			return nil, fmt.Errorf("unable to digest package data: %w", err)
+		}
+		sha1s = append(sha1s, sha1sum)
+
+		fileID := ids.id("File", path)
+		doc.Files = append(doc.Files, spdxFile{
+			SPDXID:   fileID,
+			FileName: "/" + path,
+			Checksums: []spdxChecksum{
+				{Algorithm: "SHA1", ChecksumValue: sha1sum},
+				{Algorithm: "SHA256", ChecksumValue: sha256sum},
+			},
+			LicenseConcluded: spdxLicense(pc.fileLicenses[path]),
+			CopyrightText:    spdxNoAssertion,
+		})
+		doc.Relationships = append(doc.Relationships, spdxRelationship{Element: pkgID, Type: "CONTAINS", Related: fileID})
+	}
+
+	// The verification code is the SHA1 digest of the sorted SHA1
+	// digests of the files.
+	sort.Strings(sha1s)
+	code := sha1.Sum([]byte(strings.Join(sha1s, ""))) // nolint:gosec
+	pkg.PackageVerificationCode = &spdxVerificationCode{PackageVerificationCodeValue: hex.EncodeToString(code[:])}
+	doc.Packages = append(doc.Packages, pkg)
+
+	for _, dep := range pc.Dependencies.Runtime {
+		depID := ids.id("Dependency", dep)
+		doc.Packages = append(doc.Packages, spdxPackage{
+			SPDXID:           depID,
+			Name:             dep,
+			DownloadLocation: spdxNoAssertion,
+		})
+		doc.Relationships = append(doc.Relationships, spdxRelationship{Element: pkgID, Type: "DEPENDS_ON", Related: depID})
+	}
+
+	// The origin package and its subpackages are all generated by the
+	// same build, so each subpackage is related to the origin.
+	related := []string{pc.Origin.Name}
+	if pc.PackageName == pc.Origin.Name {
+		related = []string{}
+		if pc.Context.Configuration.Package.Name == pc.Origin.Name {
+			for _, sp := range pc.Context.Configuration.Subpackages {
+				related = append(related, sp.Name)
+			}
+		}
+	}
+
+	for _, name := range related {
+		id := ids.id("Package", name)
+		doc.Packages = append(doc.Packages, spdxPackage{
+			SPDXID:           id,
+			Name:             name,
+			VersionInfo:      version,
+			DownloadLocation: spdxNoAssertion,
+		})
+
+		if name == pc.Origin.Name {
+			doc.Relationships = append(doc.Relationships, spdxRelationship{Element: pkgID, Type: "GENERATED_FROM", Related: id})
+		} else {
+			doc.Relationships = append(doc.Relationships, spdxRelationship{Element: id, Type: "GENERATED_FROM", Related: pkgID})
+		}
+	}
+
+	data, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("unable to encode SBOM: %w", err)
+	}
+
+	return append(data, '\n'), nil
+}
+
+// fsDigests returns the SHA1 and SHA256 digests of the contents of a
+// file.
+func fsDigests(fsys fs.FS, name string) (string, string, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return "", "", err
+	}
+	defer f.Close()
+
+	h1 := sha1.New() // nolint:gosec
+	h256 := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(h1, h256), f); err != nil {
+		return "", "", err
+	}
+
+	return hex.EncodeToString(h1.Sum(nil)), hex.EncodeToString(h256.Sum(nil)), nil
+}
+
+// emitSBOM writes the SBOM of the package next to it, and embeds it in
+// the package under /var/lib/db/sbom if requested.  It must be called
+// before the installed size is computed.
+func (pc *PackageContext) emitSBOM(fsys fs.FS) error {
+	sbom, err := pc.generateSBOM(fsys)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(pc.OutDir, 0755); err != nil {
+		return fmt.Errorf("unable to create output directory: %w", err)
+	}
+
+	if err := os.WriteFile(pc.SBOMFilename(), sbom, 0644); err != nil {
+		return fmt.Errorf("unable to write SBOM: %w", err)
+	}
+
+	pc.Logger.Printf("wrote %s", pc.SBOMFilename())
+
+	if !pc.Context.EmbedSBOM {
+		return nil
+	}
+
+	dir := filepath.Join(pc.WorkspaceSubdir(), sbomDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("unable to create SBOM directory: %w", err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, filepath.Base(pc.SBOMFilename())), sbom, 0644); err != nil {
+		return fmt.Errorf("unable to embed SBOM: %w", err)
+	}
+
+	return pc.addFile(path.Join(sbomDir, filepath.Base(pc.SBOMFilename())))
+}
@@ -0,0 +1,161 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEmitSBOM(t *testing.T) {
+	ctx := &Context{
+		WorkspaceDir:    t.TempDir(),
+		OutDir:          t.TempDir(),
+		SourceDateEpoch: time.Unix(0, 0),
+		EmbedSBOM:       true,
+		Configuration: Configuration{
+			Package:     Package{Name: "hello"},
+			Subpackages: []Subpackage{{Name: "hello-doc"}},
+		},
+	}
+	origin := &Package{
+		Name:      "hello",
+		Version:   "1.0",
+		Copyright: []Copyright{{License: "MIT", Attestation: "Copyright Hello Authors"}, {License: "Apache-2.0"}},
+	}
+
+	newContext := func(name string) *PackageContext {
+		return &PackageContext{
+			Context:     ctx,
+			Origin:      origin,
+			PackageName: name,
+			OutDir:      ctx.OutDir,
+			Logger:      log.New(io.Discard, "", 0),
+			Arch:        "x86_64",
+		}
+	}
+
+	pc := newContext("hello")
+	pc.Dependencies.Runtime = []string{"busybox"}
+	contents := []byte("#!/bin/sh\necho hello\n")
+	require.NoError(t, os.MkdirAll(filepath.Join(pc.WorkspaceSubdir(), "usr", "bin"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(pc.WorkspaceSubdir(), "usr", "bin", "hello"), contents, 0755))
+	require.NoError(t, pc.EmitPackage())
+
+	data, err := os.ReadFile(pc.SBOMFilename())
+	require.NoError(t, err)
+
+	var doc spdxDocument
+	require.NoError(t, json.Unmarshal(data, &doc))
+
+	digest := sha256.Sum256(contents)
+	require.Equal(t, "SPDX-2.3", doc.SPDXVersion)
+	require.Equal(t, []string{"SPDXRef-Package-hello"}, doc.DocumentDescribes)
+	require.Len(t, doc.Files, 2)
+	require.Equal(t, "/usr/bin/hello", doc.Files[0].FileName)
+	require.Equal(t, "MIT AND Apache-2.0", doc.Files[0].LicenseConcluded)
+	require.Equal(t, "/usr/share/licenses/hello/copyright", doc.Files[1].FileName)
+	require.Contains(t, doc.Files[0].Checksums, spdxChecksum{Algorithm: "SHA256", ChecksumValue: hex.EncodeToString(digest[:])})
+
+	pkg := doc.Packages[0]
+	require.Equal(t, "hello", pkg.Name)
+	require.Equal(t, "1.0-r0", pkg.VersionInfo)
+	require.Equal(t, "MIT AND Apache-2.0", pkg.LicenseDeclared)
+	require.Equal(t, "Copyright Hello Authors", pkg.CopyrightText)
+	require.Equal(t, []spdxExternalRef{{ReferenceCategory: "OTHER", ReferenceType: "apk-provides", ReferenceLocator: "cmd:hello=1.0-r0"}}, pkg.ExternalRefs)
+
+	require.Contains(t, doc.Relationships, spdxRelationship{Element: "SPDXRef-Package-hello", Type: "CONTAINS", Related: "SPDXRef-File-usr-bin-hello"})
+	require.Contains(t, doc.Relationships, spdxRelationship{Element: "SPDXRef-Package-hello", Type: "DEPENDS_ON", Related: "SPDXRef-Dependency-busybox"})
+	require.Contains(t, doc.Relationships, spdxRelationship{Element: "SPDXRef-Package-hello-doc", Type: "GENERATED_FROM", Related: "SPDXRef-Package-hello"})
+
+	// The SBOM is installed by the package, but does not describe itself.
+	embedded := readPackageFile(t, pc.Filename(), "var/lib/db/sbom/hello-1.0-r0.spdx.json")
+	require.Equal(t, data, embedded)
+
+	// Paths which only differ by characters SPDX identifiers cannot
+	// hold still get unique identifiers.
+	sub := newContext("hello-doc")
+	docDir := filepath.Join(sub.WorkspaceSubdir(), "usr", "share", "doc")
+	require.NoError(t, os.MkdirAll(filepath.Join(docDir, "foo"), 0755))
+	for _, name := range []string{"foo-bar", "foo/bar", "a_b", "a-b"} {
+		require.NoError(t, os.WriteFile(filepath.Join(docDir, name), []byte(name), 0644))
+	}
+	require.NoError(t, sub.EmitPackage())
+
+	data, err = os.ReadFile(sub.SBOMFilename())
+	require.NoError(t, err)
+
+	doc = spdxDocument{}
+	require.NoError(t, json.Unmarshal(data, &doc))
+	require.Contains(t, doc.Relationships, spdxRelationship{Element: "SPDXRef-Package-hello-doc", Type: "GENERATED_FROM", Related: "SPDXRef-Package-hello"})
+
+	ids := map[string]string{}
+	seen := map[string]bool{}
+	for _, f := range doc.Files {
+		require.False(t, seen[f.SPDXID], "duplicate SPDXID %s", f.SPDXID)
+		seen[f.SPDXID] = true
+		ids[f.FileName] = f.SPDXID
+		require.Contains(t, doc.Relationships, spdxRelationship{Element: "SPDXRef-Package-hello-doc", Type: "CONTAINS", Related: f.SPDXID})
+	}
+	for _, p := range doc.Packages {
+		require.False(t, seen[p.SPDXID], "duplicate SPDXID %s", p.SPDXID)
+		seen[p.SPDXID] = true
+	}
+
+	require.Equal(t, "SPDXRef-File-usr-share-doc-a-b", ids["/usr/share/doc/a-b"])
+	require.Equal(t, "SPDXRef-File-usr-share-doc-a-b-2", ids["/usr/share/doc/a_b"])
+	require.Equal(t, "SPDXRef-File-usr-share-doc-foo-bar", ids["/usr/share/doc/foo/bar"])
+	require.Equal(t, "SPDXRef-File-usr-share-doc-foo-bar-2", ids["/usr/share/doc/foo-bar"])
+}
+
+// readPackageFile returns the contents of a file of the data section of
+// an apk.
+func readPackageFile(t *testing.T, apk, name string) []byte {
+	f, err := os.Open(apk)
+	require.NoError(t, err)
+	defer f.Close()
+
+	// The signature and control sections are not terminated, so the
+	// sections read as a single tar stream.
+	zr, err := gzip.NewReader(f)
+	require.NoError(t, err)
+
+	tr := tar.NewReader(zr)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			t.Fatalf("%s not found in %s", name, apk)
+		}
+		require.NoError(t, err)
+
+		if hdr.Name == name {
+			data, err := io.ReadAll(tr)
+			require.NoError(t, err)
+			return data
+		}
+	}
+}
@@ -0,0 +1,409 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"bytes"
+	"debug/elf"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+
+	apkofs "chainguard.dev/apko/pkg/fs"
+)
+
+// defaultLibraryPath are the directories the dynamic linker searches
+// after those of the run search path of an object.
+var defaultLibraryPath = []string{"lib", "usr/lib"}
+
+var elfMagic = []byte("\x7fELF")
+
+// readELF calls fn with the ELF object at name, if the file is one, which
+// is detected by its magic bytes.  The file is closed before returning,
+// so that a single file is open at a time however many are scanned.
+func readELF(fsys fs.FS, name string, fn func(*elf.File) error) error {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	magic := make([]byte, len(elfMagic))
+	if _, err := io.ReadFull(f, magic); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil
+		}
+		return err
+	}
+	if !bytes.Equal(magic, elfMagic) {
+		return nil
+	}
+
+	ra, ok := f.(io.ReaderAt)
+	if !ok {
+		data, err := io.ReadAll(f)
+		if err != nil {
+			return err
+		}
+		ra = bytes.NewReader(append(magic, data...))
+	}
+
+	ef, err := elf.NewFile(ra)
+	if err != nil {
+		// objects which cannot be parsed, such as those of an
+		// unsupported class, are not fatal
+		return nil
+	}
+
+	return fn(ef)
+}
+
+// sharedObjectVersion returns the version a shared object is provided
+// with: the version in its file name when the name extends its SONAME,
+// such as 1.2.3 for libfoo.so.1.2.3 with the SONAME libfoo.so.1, and
+// otherwise the version in its SONAME, or 0 if it has none.
+func sharedObjectVersion(soname, filename string) string {
+	name := soname
+	if filename == soname || strings.HasPrefix(filename, soname+".") {
+		name = filename
+	}
+
+	if i := strings.Index(name, ".so."); i >= 0 {
+		return name[i+len(".so."):]
+	}
+	return "0"
+}
+
+// verFlagBase marks the version definition of an object itself, which is
+// named after its SONAME rather than a symbol version.
+const verFlagBase = 0x1
+
+// elfString returns the NUL terminated string at off in strtab.
+func elfString(strtab []byte, off uint32) (string, bool) {
+	if uint64(off) >= uint64(len(strtab)) {
+		return "", false
+	}
+
+	end := bytes.IndexByte(strtab[off:], 0)
+	if end < 0 {
+		return "", false
+	}
+
+	return string(strtab[off : off+uint32(end)]), true
+}
+
+// symbolVersionDefinitions returns the GNU symbol versions an ELF object
+// defines, such as GLIBC_2.34, in the order they are defined.  They are
+// read from its SHT_GNU_verdef section, which DT_VERDEF points at: each
+// Elf_Verdef entry is followed by its Elf_Verdaux entries, the first of
+// which names the version.
+func symbolVersionDefinitions(ef *elf.File) ([]string, error) {
+	sec := ef.SectionByType(elf.SHT_GNU_VERDEF)
+	if sec == nil {
+		return nil, nil
+	}
+
+	data, err := sec.Data()
+	if err != nil {
+		return nil, err
+	}
+
+	if int(sec.Link) >= len(ef.Sections) {
+		return nil, fmt.Errorf("version definitions refer to missing string table %d", sec.Link)
+	}
+	strtab, err := ef.Sections[sec.Link].Data()
+	if err != nil {
+		return nil, err
+	}
+
+	const verdefSize, verdauxSize = 20, 8
+	bo := ef.ByteOrder
+
+	versions := []string{}
+	// every entry takes at least verdefSize bytes, which bounds the
+	// number of entries however they are linked
+	for off, n := uint64(0), 0; n < len(data)/verdefSize; n++ {
+		if off+verdefSize > uint64(len(data)) {
+			return nil, fmt.Errorf("truncated version definition at %d", off)
+		}
+		entry := data[off:]
+
+		flags := bo.Uint16(entry[2:])
+		count := bo.Uint16(entry[6:])
+		aux := uint64(bo.Uint32(entry[12:]))
+		next := uint64(bo.Uint32(entry[16:]))
+
+		if flags&verFlagBase == 0 && count > 0 {
+			if off+aux+verdauxSize > uint64(len(data)) {
+				return nil, fmt.Errorf("truncated version definition at %d", off)
+			}
+
+			name, ok := elfString(strtab, bo.Uint32(data[off+aux:]))
+			if !ok {
+				return nil, fmt.Errorf("invalid name of version definition at %d", off)
+			}
+			versions = append(versions, name)
+		}
+
+		if next == 0 {
+			break
+		}
+		off += next
+	}
+
+	return versions, nil
+}
+
+// symbolVersionRequirements returns the GNU symbol versions an ELF object
+// requires from the shared objects it imports, which are recorded in its
+// SHT_GNU_verneed section, as sorted so:<lib>(<version>) names.
+func symbolVersionRequirements(ef *elf.File) ([]string, error) {
+	symbols, err := ef.ImportedSymbols()
+	if errors.Is(err, elf.ErrNoSymbols) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	seen := map[string]bool{}
+	requirements := []string{}
+	for _, sym := range symbols {
+		if sym.Library == "" || sym.Version == "" {
+			continue
+		}
+
+		req := symbolVersionName(sym.Library, sym.Version)
+		if !seen[req] {
+			seen[req] = true
+			requirements = append(requirements, req)
+		}
+	}
+	sort.Strings(requirements)
+
+	return requirements, nil
+}
+
+// symbolVersionName returns the name of the virtual for the symbol
+// version of a shared object, such as so:libc.so.6(GLIBC_2.34).
+func symbolVersionName(soname, version string) string {
+	return fmt.Sprintf("so:%s(%s)", soname, version)
+}
+
+func generateSharedObjectNameDeps(pc *PackageContext, generated *Dependencies) error {
+	pc.Logger.Printf("scanning for shared object dependencies...")
+
+	fsys := apkofs.DirFS(pc.WorkspaceSubdir())
+	for _, f := range pc.files {
+		// objects are detected by their contents, whatever their
+		// permissions and names
+		if !f.mode.IsRegular() {
+			continue
+		}
+
+		if err := readELF(fsys, f.path, func(ef *elf.File) error {
+			pc.scanSharedObject(generated, ef, f.path)
+			return nil
+		}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// scanSharedObject records the shared objects an ELF object imports, and
+// adds a so: virtual for its SONAME if it is a shared object itself.
+func (pc *PackageContext) scanSharedObject(generated *Dependencies, ef *elf.File, name string) {
+	if ef.Type != elf.ET_EXEC && ef.Type != elf.ET_DYN {
+		return
+	}
+
+	// the dependencies are only added once the libraries provided by
+	// every package of the build are known
+	if !pc.Options.NoDepends {
+		libs, err := ef.ImportedLibraries()
+		if err != nil {
+			pc.Logger.Printf("WARNING: unable to read the libraries imported by %s: %v", name, err)
+		} else {
+			searchPath := runSearchPath(ef, name)
+			for _, lib := range libs {
+				pc.imports = append(pc.imports, sharedObjectImport{lib: lib, path: name, searchPath: searchPath})
+			}
+		}
+
+		// apk cannot require a symbol version of a shared object
+		// which repositories do not provide, so the versions are only
+		// recorded in the dependency log
+		requirements, err := symbolVersionRequirements(ef)
+		if err != nil {
+			pc.Logger.Printf("WARNING: unable to read the symbol versions required by %s: %v", name, err)
+		}
+		for _, req := range requirements {
+			pc.addSymbolVersion(req, name)
+		}
+	}
+
+	if pc.Options.NoProvides || ef.Type != elf.ET_DYN {
+		return
+	}
+
+	// position independent executables are ET_DYN objects as well, but
+	// without a SONAME
+	sonames, err := ef.DynString(elf.DT_SONAME)
+	if err != nil || len(sonames) == 0 {
+		if strings.Contains(path.Base(name), ".so") {
+			pc.Logger.Printf("WARNING: library %s lacks SONAME", name)
+		}
+		return
+	}
+
+	versions, err := symbolVersionDefinitions(ef)
+	if err != nil {
+		pc.Logger.Printf("WARNING: unable to read the symbol versions defined by %s: %v", name, err)
+	}
+
+	for _, soname := range sonames {
+		pc.addProvides(generated, fmt.Sprintf("so:%s=%s", soname, sharedObjectVersion(soname, path.Base(name))), name)
+
+		for _, version := range versions {
+			pc.addProvides(generated, symbolVersionName(soname, version), name)
+		}
+	}
+}
+
+// sharedObjectImport is a shared object imported by a file of a package.
+type sharedObjectImport struct {
+	lib  string
+	path string
+	// searchPath are the directories the object is looked up in
+	// before the default ones, relative to the root of the package.
+	searchPath []string
+}
+
+// runSearchPath returns the run search path of an ELF object at name,
+// relative to the root of the package: its DT_RUNPATH, or its DT_RPATH
+// when it has none, which the dynamic linker then ignores.
+func runSearchPath(ef *elf.File, name string) []string {
+	entries, err := ef.DynString(elf.DT_RUNPATH)
+	if err != nil || len(entries) == 0 {
+		entries, err = ef.DynString(elf.DT_RPATH)
+		if err != nil {
+			return nil
+		}
+	}
+
+	origin := path.Dir(name)
+
+	dirs := []string{}
+	for _, entry := range entries {
+		for _, dir := range strings.Split(entry, ":") {
+			if dir == "" {
+				continue
+			}
+
+			dir = strings.ReplaceAll(dir, "${ORIGIN}", "/"+origin)
+			dir = strings.ReplaceAll(dir, "$ORIGIN", "/"+origin)
+			if !strings.HasPrefix(dir, "/") {
+				// relative entries are relative to the working
+				// directory, which cannot be known in advance
+				continue
+			}
+
+			dirs = append(dirs, strings.TrimPrefix(path.Clean(dir), "/"))
+		}
+	}
+
+	return dirs
+}
+
+// providesSharedObject returns whether provides includes the so: virtual
+// for lib.
+func providesSharedObject(provides []string, lib string) bool {
+	for _, prov := range provides {
+		if prov == "so:"+lib || strings.HasPrefix(prov, "so:"+lib+"=") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// resolveSharedObjects adds the dependencies for the shared objects the
+// package imports, given all the packages of the build and the
+// dependencies generated for them.  An import is looked up in the run
+// search path of the importing object and in the default library path,
+// first in the package itself and then in the other packages; failing
+// that, the so: virtuals the packages provide are checked.  Imports the
+// package satisfies itself are dropped, imports another package of the
+// build satisfies become a dependency on that package, and any other
+// import becomes a so: dependency.
+func (pc *PackageContext) resolveSharedObjects(pcs []*PackageContext, generated []Dependencies, deps *Dependencies) {
+	if len(pc.imports) == 0 {
+		return
+	}
+
+	// search the package itself first
+	candidates := []int{}
+	for i, other := range pcs {
+		if other == pc {
+			candidates = append([]int{i}, candidates...)
+		} else {
+			candidates = append(candidates, i)
+		}
+	}
+
+	filesystems := make([]fs.FS, len(pcs))
+	for i, other := range pcs {
+		filesystems[i] = apkofs.DirFS(other.WorkspaceSubdir())
+	}
+
+	provider := func(imp sharedObjectImport) *PackageContext {
+		dirs := append(append([]string{}, imp.searchPath...), defaultLibraryPath...)
+		for _, dir := range dirs {
+			for _, i := range candidates {
+				if _, err := fs.Stat(filesystems[i], path.Join(dir, imp.lib)); err == nil {
+					return pcs[i]
+				}
+			}
+		}
+
+		for _, i := range candidates {
+			if providesSharedObject(pcs[i].Dependencies.Provides, imp.lib) || providesSharedObject(generated[i].Provides, imp.lib) {
+				return pcs[i]
+			}
+		}
+
+		return nil
+	}
+
+	pc.generator = "shared-objects"
+	defer func() { pc.generator = "" }()
+
+	for _, imp := range pc.imports {
+		switch p := provider(imp); p {
+		case pc:
+			continue
+		case nil:
+			pc.addRuntime(deps, fmt.Sprintf("so:%s", imp.lib), imp.path)
+		default:
+			pc.addRuntime(deps, fmt.Sprintf("%s=%s-r%d", p.PackageName, p.Origin.Version, p.Origin.Epoch), imp.path)
+		}
+	}
+}
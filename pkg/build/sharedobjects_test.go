@@ -0,0 +1,434 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/require"
+)
+
+type testDynEntry struct {
+	tag elf.DynTag
+	val string
+}
+
+// testSymbolVersion is a GNU symbol version required from a library.
+type testSymbolVersion struct {
+	lib     string
+	version string
+}
+
+// testELF returns a minimal 64-bit ELF object whose dynamic section holds
+// the given string entries, which is all dependency generation reads.
+func testELF(entries ...testDynEntry) []byte {
+	return testVersionedELF(nil, nil, entries...)
+}
+
+// testVersionedELF returns a minimal 64-bit ELF object like testELF, which
+// also defines the symbol versions in defines and imports a symbol for
+// each of the symbol versions in requires.
+func testVersionedELF(defines []string, requires []testSymbolVersion, entries ...testDynEntry) []byte {
+	bo := binary.LittleEndian
+
+	dynstr := []byte{0}
+	addString := func(s string) uint32 {
+		off := uint32(len(dynstr))
+		dynstr = append(append(dynstr, s...), 0)
+		return off
+	}
+
+	dynamic := new(bytes.Buffer)
+	soname := uint32(0)
+	for _, e := range entries {
+		off := addString(e.val)
+		if e.tag == elf.DT_SONAME {
+			soname = off
+		}
+		binary.Write(dynamic, bo, [2]uint64{uint64(e.tag), uint64(off)}) // nolint:errcheck
+	}
+	binary.Write(dynamic, bo, [2]uint64{uint64(elf.DT_NULL), 0}) // nolint:errcheck
+
+	sections := []elf.Section64{{}}
+	contents := [][]byte{nil}
+	addSection := func(sec elf.Section64, data []byte) {
+		sections = append(sections, sec)
+		contents = append(contents, data)
+	}
+	addSection(elf.Section64{Type: uint32(elf.SHT_STRTAB), Addralign: 1}, nil)
+	addSection(elf.Section64{Type: uint32(elf.SHT_DYNAMIC), Link: 1, Addralign: 8, Entsize: 16}, dynamic.Bytes())
+
+	if len(defines) > 0 {
+		// the base definition, named after the object itself, comes
+		// first and has index 1
+		verdef := new(bytes.Buffer)
+		names := []uint32{soname}
+		for _, v := range defines {
+			names = append(names, addString(v))
+		}
+		for i, name := range names {
+			flags, next := uint16(0), uint32(28)
+			if i == 0 {
+				flags = verFlagBase
+			}
+			if i == len(names)-1 {
+				next = 0
+			}
+			binary.Write(verdef, bo, struct { // nolint:errcheck
+				Version, Flags, Ndx, Cnt uint16
+				Hash, Aux, Next          uint32
+			}{1, flags, uint16(i + 1), 1, 0, 20, next})
+			binary.Write(verdef, bo, [2]uint32{name, 0}) // nolint:errcheck
+		}
+		addSection(elf.Section64{Type: uint32(elf.SHT_GNU_VERDEF), Link: 1, Info: uint32(len(names)), Addralign: 4}, verdef.Bytes())
+	}
+
+	if len(requires) > 0 {
+		// every required version gets its own index and a symbol
+		// importing it, grouped by library in the verneed section
+		libs := []string{}
+		needs := map[string][]int{}
+		for i, req := range requires {
+			if _, ok := needs[req.lib]; !ok {
+				libs = append(libs, req.lib)
+			}
+			needs[req.lib] = append(needs[req.lib], i)
+		}
+
+		firstIndex := len(defines) + 2
+		verneed := new(bytes.Buffer)
+		for i, lib := range libs {
+			next := uint32(16 + 16*len(needs[lib]))
+			if i == len(libs)-1 {
+				next = 0
+			}
+			binary.Write(verneed, bo, struct { // nolint:errcheck
+				Version, Cnt    uint16
+				File, Aux, Next uint32
+			}{1, uint16(len(needs[lib])), addString(lib), 16, next})
+			for j, req := range needs[lib] {
+				next := uint32(16)
+				if j == len(needs[lib])-1 {
+					next = 0
+				}
+				binary.Write(verneed, bo, struct { // nolint:errcheck
+					Hash         uint32
+					Flags, Other uint16
+					Name, Next   uint32
+				}{0, 0, uint16(firstIndex + req), addString(requires[req].version), next})
+			}
+		}
+
+		dynsym := new(bytes.Buffer)
+		versym := new(bytes.Buffer)
+		binary.Write(dynsym, bo, elf.Sym64{}) // nolint:errcheck
+		binary.Write(versym, bo, uint16(0))   // nolint:errcheck
+		for i := range requires {
+			binary.Write(dynsym, bo, elf.Sym64{ // nolint:errcheck
+				Name: addString(fmt.Sprintf("symbol%d", i)),
+				Info: elf.ST_INFO(elf.STB_GLOBAL, elf.STT_FUNC),
+			})
+			binary.Write(versym, bo, uint16(firstIndex+i)) // nolint:errcheck
+		}
+
+		symtab := uint32(len(sections))
+		addSection(elf.Section64{Type: uint32(elf.SHT_DYNSYM), Link: 1, Info: 1, Addralign: 8, Entsize: 24}, dynsym.Bytes())
+		addSection(elf.Section64{Type: uint32(elf.SHT_GNU_VERSYM), Link: symtab, Addralign: 2, Entsize: 2}, versym.Bytes())
+		addSection(elf.Section64{Type: uint32(elf.SHT_GNU_VERNEED), Link: 1, Info: uint32(len(libs)), Addralign: 4}, verneed.Bytes())
+	}
+	contents[1] = dynstr
+
+	const ehsize, shentsize = 64, 64
+	off := uint64(ehsize)
+	for i := range sections[1:] {
+		sections[i+1].Off = off
+		sections[i+1].Size = uint64(len(contents[i+1]))
+		off += uint64(len(contents[i+1]))
+	}
+
+	out := new(bytes.Buffer)
+	ident := [elf.EI_NIDENT]byte{0x7f, 'E', 'L', 'F', byte(elf.ELFCLASS64), byte(elf.ELFDATA2LSB), byte(elf.EV_CURRENT)}
+	binary.Write(out, bo, elf.Header64{ // nolint:errcheck
+		Ident:     ident,
+		Type:      uint16(elf.ET_DYN),
+		Machine:   uint16(elf.EM_X86_64),
+		Version:   uint32(elf.EV_CURRENT),
+		Shoff:     off,
+		Ehsize:    ehsize,
+		Phentsize: 56,
+		Shentsize: shentsize,
+		Shnum:     uint16(len(sections)),
+	})
+	for _, data := range contents {
+		out.Write(data)
+	}
+	binary.Write(out, bo, sections) // nolint:errcheck
+
+	return out.Bytes()
+}
+
+func TestRunSearchPath(t *testing.T) {
+	for _, tt := range []struct {
+		entries []testDynEntry
+		want    []string
+	}{
+		{nil, nil},
+		{[]testDynEntry{{elf.DT_RPATH, "/usr/lib/hello"}}, []string{"usr/lib/hello"}},
+		{[]testDynEntry{{elf.DT_RUNPATH, "$ORIGIN/../lib/hello:/opt/hello/lib/:lib"}}, []string{"usr/lib/hello", "opt/hello/lib"}},
+		{[]testDynEntry{{elf.DT_RPATH, "/usr/lib/ignored"}, {elf.DT_RUNPATH, "${ORIGIN}"}}, []string{"usr/bin"}},
+	} {
+		ef, err := elf.NewFile(bytes.NewReader(testELF(tt.entries...)))
+		require.NoError(t, err)
+
+		got := runSearchPath(ef, "usr/bin/hello")
+		if tt.want == nil {
+			require.Empty(t, got)
+			continue
+		}
+		require.Equal(t, tt.want, got)
+	}
+}
+
+func TestGenerateDependenciesSharedObjects(t *testing.T) {
+	ctx := &Context{WorkspaceDir: t.TempDir()}
+	origin := &Package{Name: "hello", Version: "1.0"}
+
+	packages := map[string]map[string][]byte{
+		"hello": {
+			"usr/bin/hello": testELF(
+				testDynEntry{elf.DT_NEEDED, "libhello.so.1"},
+				testDynEntry{elf.DT_NEEDED, "libprivate.so.1"},
+				testDynEntry{elf.DT_NEEDED, "libc.musl-x86_64.so.1"},
+				testDynEntry{elf.DT_RUNPATH, "$ORIGIN/../lib/hello"},
+			),
+			"usr/lib/hello/libprivate.so.1": []byte("found through the run search path"),
+		},
+		"hello-libs": {
+			"usr/bin/hello-tool": testELF(
+				testDynEntry{elf.DT_NEEDED, "libhello.so.1"},
+			),
+			"usr/lib/libhello.so.1": testELF(
+				testDynEntry{elf.DT_NEEDED, "libc.musl-x86_64.so.1"},
+				testDynEntry{elf.DT_SONAME, "libhello.so.1"},
+			),
+		},
+		"hello-plugins": {
+			"usr/lib/hello/plugins/greet.so.1": testELF(
+				testDynEntry{elf.DT_NEEDED, "libhello.so.1"},
+				testDynEntry{elf.DT_NEEDED, "libbar.so.2"},
+			),
+		},
+	}
+
+	pcs := []*PackageContext{}
+	for _, name := range []string{"hello", "hello-libs", "hello-plugins"} {
+		pc := &PackageContext{
+			Context:     ctx,
+			Origin:      origin,
+			PackageName: name,
+			Logger:      log.New(io.Discard, "", 0),
+			Options:     PackageOption{NoCommands: true},
+		}
+		if name == "hello-libs" {
+			pc.Dependencies.Provides = []string{"so:libbar.so.2=2"}
+		}
+
+		for file, data := range packages[name] {
+			p := filepath.Join(pc.WorkspaceSubdir(), file)
+			require.NoError(t, os.MkdirAll(filepath.Dir(p), 0755))
+			require.NoError(t, os.WriteFile(p, data, 0755))
+		}
+
+		pcs = append(pcs, pc)
+	}
+
+	require.NoError(t, GenerateDependencies(pcs))
+
+	require.Equal(t, []string{"hello-libs=1.0-r0", "so:libc.musl-x86_64.so.1"}, pcs[0].Dependencies.Runtime)
+	require.Equal(t, []string{"so:libc.musl-x86_64.so.1"}, pcs[1].Dependencies.Runtime)
+	require.Equal(t, []string{"so:libbar.so.2=2", "so:libhello.so.1=1"}, pcs[1].Dependencies.Provides)
+	require.Equal(t, []string{"hello-libs=1.0-r0"}, pcs[2].Dependencies.Runtime)
+
+	require.Contains(t, ctx.dependencies["hello"].Runtime, GeneratedDependency{
+		Dependency: "hello-libs=1.0-r0", Path: "usr/bin/hello", Generator: "shared-objects",
+	})
+}
+
+func TestSharedObjectVersion(t *testing.T) {
+	for _, tt := range []struct {
+		soname   string
+		filename string
+		want     string
+	}{
+		{"libfoo.so.1", "libfoo.so.1", "1"},
+		{"libfoo.so.1", "libfoo.so.1.2.3", "1.2.3"},
+		{"libfoo.so.1", "libbar.so.2", "1"},
+		{"libfoo.so", "libfoo.so", "0"},
+		{"libfoo.so", "libfoo.so.4.5", "4.5"},
+		{"libfoo-1.2.so", "libfoo-1.2.so", "0"},
+	} {
+		require.Equal(t, tt.want, sharedObjectVersion(tt.soname, tt.filename), "%s %s", tt.soname, tt.filename)
+	}
+}
+
+func TestReadELF(t *testing.T) {
+	fsys := fstest.MapFS{
+		"elf":    {Data: testELF(testDynEntry{elf.DT_SONAME, "libfoo.so.1"})},
+		"script": {Data: []byte("#!/bin/sh\n")},
+		"short":  {Data: []byte("\x7fE")},
+		"empty":  {},
+	}
+
+	for _, name := range []string{"script", "short", "empty"} {
+		require.NoError(t, readELF(fsys, name, func(*elf.File) error {
+			t.Fatalf("%s is not an ELF object", name)
+			return nil
+		}))
+	}
+
+	var sonames []string
+	require.NoError(t, readELF(fsys, "elf", func(ef *elf.File) error {
+		var err error
+		sonames, err = ef.DynString(elf.DT_SONAME)
+		return err
+	}))
+	require.Equal(t, []string{"libfoo.so.1"}, sonames)
+}
+
+func TestGenerateSharedObjectProvides(t *testing.T) {
+	pc := &PackageContext{
+		Context:     &Context{WorkspaceDir: t.TempDir()},
+		Origin:      &Package{Name: "hello", Version: "1.0"},
+		PackageName: "hello",
+		Logger:      log.New(io.Discard, "", 0),
+	}
+
+	for name, data := range map[string][]byte{
+		// libraries are detected whatever their permissions and names
+		"usr/lib/libfoo.so":       testELF(testDynEntry{elf.DT_SONAME, "libfoo.so"}),
+		"usr/lib/libbar.so.2.1.0": testELF(testDynEntry{elf.DT_SONAME, "libbar.so.2"}),
+		"usr/lib/hello/module":    testELF(testDynEntry{elf.DT_SONAME, "hello-module"}),
+		"usr/lib/libnot.so.1":     []byte("INPUT(libbar.so.2)"),
+	} {
+		p := filepath.Join(pc.WorkspaceSubdir(), name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(p), 0755))
+		require.NoError(t, os.WriteFile(p, data, 0644))
+	}
+
+	require.NoError(t, pc.GenerateDependencies())
+	require.Equal(t, []string{"so:hello-module=0", "so:libbar.so.2=2.1.0", "so:libfoo.so=0"}, pc.Dependencies.Provides)
+	require.Empty(t, pc.Dependencies.Runtime)
+}
+
+func TestSymbolVersionDefinitions(t *testing.T) {
+	for _, tt := range []struct {
+		defines []string
+		want    []string
+	}{
+		{nil, nil},
+		{[]string{"FOO_1.0"}, []string{"FOO_1.0"}},
+		{[]string{"FOO_1.0", "FOO_1.1", "FOO_PRIVATE"}, []string{"FOO_1.0", "FOO_1.1", "FOO_PRIVATE"}},
+	} {
+		ef, err := elf.NewFile(bytes.NewReader(testVersionedELF(tt.defines, nil, testDynEntry{elf.DT_SONAME, "libfoo.so.1"})))
+		require.NoError(t, err)
+
+		got, err := symbolVersionDefinitions(ef)
+		require.NoError(t, err)
+		if tt.want == nil {
+			require.Empty(t, got)
+			continue
+		}
+		require.Equal(t, tt.want, got)
+	}
+}
+
+func TestSymbolVersionRequirements(t *testing.T) {
+	ef, err := elf.NewFile(bytes.NewReader(testVersionedELF(nil, []testSymbolVersion{
+		{"libc.so.6", "GLIBC_2.34"},
+		{"libfoo.so.1", "FOO_1.0"},
+		{"libc.so.6", "GLIBC_2.2.5"},
+		{"libc.so.6", "GLIBC_2.34"},
+	}, testDynEntry{elf.DT_NEEDED, "libc.so.6"}, testDynEntry{elf.DT_NEEDED, "libfoo.so.1"})))
+	require.NoError(t, err)
+
+	got, err := symbolVersionRequirements(ef)
+	require.NoError(t, err)
+	require.Equal(t, []string{"so:libc.so.6(GLIBC_2.2.5)", "so:libc.so.6(GLIBC_2.34)", "so:libfoo.so.1(FOO_1.0)"}, got)
+
+	// objects without a dynamic symbol table require no versions
+	ef, err = elf.NewFile(bytes.NewReader(testELF(testDynEntry{elf.DT_NEEDED, "libc.so.6"})))
+	require.NoError(t, err)
+
+	got, err = symbolVersionRequirements(ef)
+	require.NoError(t, err)
+	require.Empty(t, got)
+}
+
+func TestGenerateSymbolVersions(t *testing.T) {
+	ctx := &Context{WorkspaceDir: t.TempDir()}
+	pc := &PackageContext{
+		Context:     ctx,
+		Origin:      &Package{Name: "hello", Version: "1.0"},
+		PackageName: "hello",
+		Logger:      log.New(io.Discard, "", 0),
+		Options:     PackageOption{NoCommands: true},
+	}
+
+	for name, data := range map[string][]byte{
+		"usr/lib/libhello.so.1": testVersionedELF(
+			[]string{"HELLO_1.0", "HELLO_1.1"},
+			[]testSymbolVersion{{"libc.so.6", "GLIBC_2.34"}},
+			testDynEntry{elf.DT_NEEDED, "libc.so.6"},
+			testDynEntry{elf.DT_SONAME, "libhello.so.1"},
+		),
+		"usr/bin/hello": testVersionedELF(
+			nil,
+			[]testSymbolVersion{{"libhello.so.1", "HELLO_1.1"}, {"libc.so.6", "GLIBC_2.2.5"}},
+			testDynEntry{elf.DT_NEEDED, "libhello.so.1"},
+			testDynEntry{elf.DT_NEEDED, "libc.so.6"},
+		),
+	} {
+		p := filepath.Join(pc.WorkspaceSubdir(), name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(p), 0755))
+		require.NoError(t, os.WriteFile(p, data, 0755))
+	}
+
+	require.NoError(t, pc.GenerateDependencies())
+	require.Equal(t, []string{
+		"so:libhello.so.1(HELLO_1.0)",
+		"so:libhello.so.1(HELLO_1.1)",
+		"so:libhello.so.1=1",
+	}, pc.Dependencies.Provides)
+	require.Equal(t, []string{"so:libc.so.6"}, pc.Dependencies.Runtime)
+
+	report := ctx.dependencies["hello"]
+	require.Contains(t, report.Provides, GeneratedDependency{
+		Dependency: "so:libhello.so.1(HELLO_1.1)", Path: "usr/lib/libhello.so.1", Generator: "shared-objects",
+	})
+	require.ElementsMatch(t, []GeneratedDependency{
+		{Dependency: "so:libc.so.6(GLIBC_2.34)", Path: "usr/lib/libhello.so.1", Generator: "shared-objects"},
+		{Dependency: "so:libc.so.6(GLIBC_2.2.5)", Path: "usr/bin/hello", Generator: "shared-objects"},
+		{Dependency: "so:libhello.so.1(HELLO_1.1)", Path: "usr/bin/hello", Generator: "shared-objects"},
+	}, report.SymbolVersions)
+}
@@ -0,0 +1,302 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	apko_types "chainguard.dev/apko/pkg/build/types"
+	"chainguard.dev/melange/internal/sign"
+	apkrepo "gitlab.alpinelinux.org/alpine/go/repository"
+)
+
+// Test describes how to verify a package after it has been built.  The
+// pipeline runs in a fresh guest, built from the test environment, which
+// has the package under test installed from a repository containing the
+// packages emitted by the build.
+type Test struct {
+	Environment apko_types.ImageConfiguration
+	Pipeline    []Pipeline
+}
+
+// packageTest is a package emitted by the build together with its test.
+type packageTest struct {
+	name       string
+	subpackage *Subpackage
+	test       *Test
+}
+
+// packageTests returns the tests of the main package and of the
+// subpackages which have one.
+func (ctx *Context) packageTests() []packageTest {
+	tests := []packageTest{}
+
+	if len(ctx.Configuration.Test.Pipeline) > 0 {
+		tests = append(tests, packageTest{
+			name: ctx.Configuration.Package.Name,
+			test: &ctx.Configuration.Test,
+		})
+	}
+
+	for i := range ctx.Configuration.Subpackages {
+		sp := &ctx.Configuration.Subpackages[i]
+		if len(sp.Test.Pipeline) > 0 {
+			tests = append(tests, packageTest{
+				name:       sp.Name,
+				subpackage: sp,
+				test:       &sp.Test,
+			})
+		}
+	}
+
+	return tests
+}
+
+// TestPackages runs the tests of the main package and of any subpackages
+// which have one against the packages emitted by the build.  Every test
+// is run, and an error listing the failed packages is returned if any
+// test failed.
+func (ctx *Context) TestPackages(goctx context.Context) error {
+	tests := ctx.packageTests()
+	if len(tests) == 0 {
+		return nil
+	}
+
+	repoDir, err := os.MkdirTemp("", "melange-test-repo-*")
+	if err != nil {
+		return fmt.Errorf("unable to make test repository directory: %w", err)
+	}
+	defer os.RemoveAll(repoDir)
+
+	keyFile, err := ctx.buildTestRepository(repoDir)
+	if err != nil {
+		return fmt.Errorf("unable to build test repository: %w", err)
+	}
+
+	failed := []string{}
+	for _, t := range tests {
+		if err := ctx.testPackage(goctx, t, repoDir, keyFile); err != nil {
+			ctx.Logger.Printf("test for package %s failed: %v", t.name, err)
+			failed = append(failed, t.name)
+			continue
+		}
+
+		ctx.Logger.Printf("test for package %s passed", t.name)
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("tests failed for packages: %s", strings.Join(failed, ", "))
+	}
+
+	return nil
+}
+
+func (ctx *Context) testPackage(goctx context.Context, t packageTest, repoDir, keyFile string) error {
+	ctx.Logger.Printf("testing package %s", t.name)
+
+	// The test runs with its own guest, workspace and environment, so
+	// run it with a copy of the build context.
+	tctx := *ctx
+	tctx.Configuration.Environment = t.test.Environment
+	tctx.Configuration.Environment.Accounts = ctx.Configuration.Environment.Accounts
+	tctx.Configuration.Environment.Contents.Packages = append([]string{
+		fmt.Sprintf("%s=%s-r%d", t.name, ctx.Configuration.Package.Version, ctx.Configuration.Package.Epoch),
+	}, t.test.Environment.Contents.Packages...)
+	tctx.ExtraRepos = append([]string{repoDir}, ctx.ExtraRepos...)
+	tctx.ExtraKeys = append([]string{keyFile}, ctx.ExtraKeys...)
+	tctx.Logger = log.New(log.Writer(), fmt.Sprintf("melange (%s/%s test): ", t.name, ctx.Arch.ToAPK()), log.LstdFlags|log.Lmsgprefix)
+
+	guestDir, err := os.MkdirTemp("", "melange-test-guest-*")
+	if err != nil {
+		return fmt.Errorf("unable to make guest directory: %w", err)
+	}
+	defer os.RemoveAll(guestDir)
+	tctx.GuestDir = guestDir
+
+	workspaceDir, err := os.MkdirTemp("", "melange-test-workspace-*")
+	if err != nil {
+		return fmt.Errorf("unable to make workspace directory: %w", err)
+	}
+	defer os.RemoveAll(workspaceDir)
+	tctx.WorkspaceDir = workspaceDir
+
+	pctx := PipelineContext{
+		Context:    &tctx,
+		Package:    &ctx.Configuration.Package,
+		Subpackage: t.subpackage,
+	}
+
+	for _, p := range t.test.Pipeline {
+		if err := p.ApplyNeeds(&pctx); err != nil {
+			return fmt.Errorf("unable to apply pipeline requirements: %w", err)
+		}
+	}
+
+	if err := tctx.BuildWorkspace(guestDir); err != nil {
+		return fmt.Errorf("unable to build test environment: %w", err)
+	}
+
+	if err := goctx.Err(); err != nil {
+		return err
+	}
+
+	if err := tctx.OverlayBinSh(); err != nil {
+		return fmt.Errorf("unable to install overlay /bin/sh: %w", err)
+	}
+
+	cfg := tctx.RunnerConfig()
+	if err := tctx.Runner.Prepare(goctx, cfg); err != nil {
+		return fmt.Errorf("unable to prepare %s runner: %w", tctx.Runner.Name(), err)
+	}
+	defer func() {
+		if err := tctx.Runner.Teardown(cfg); err != nil {
+			tctx.Logger.Printf("warning: unable to tear down %s runner: %v", tctx.Runner.Name(), err)
+		}
+	}()
+
+	for _, p := range t.test.Pipeline {
+		if err := p.Run(goctx, &pctx); err != nil {
+			return fmt.Errorf("unable to run pipeline: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// emittedFilenames returns the paths of the packages emitted by the
+// build.
+func (ctx *Context) emittedFilenames() []string {
+	names := []string{ctx.Configuration.Package.Name}
+	for _, sp := range ctx.Configuration.Subpackages {
+		names = append(names, sp.Name)
+	}
+
+	files := make([]string, 0, len(names))
+	for _, name := range names {
+		pc := PackageContext{
+			Context:     ctx,
+			Origin:      &ctx.Configuration.Package,
+			PackageName: name,
+			OutDir:      filepath.Join(ctx.OutDir, ctx.Arch.ToAPK()),
+		}
+		files = append(files, pc.Filename())
+	}
+
+	return files
+}
+
+// buildTestRepository creates a repository in repoDir holding the
+// packages emitted by the build, with an index signed by an ephemeral
+// key so it can be used by apko, and returns the public key which the
+// index was signed with.
+func (ctx *Context) buildTestRepository(repoDir string) (string, error) {
+	archDir := filepath.Join(repoDir, ctx.Arch.ToAPK())
+	if err := os.MkdirAll(archDir, 0755); err != nil {
+		return "", err
+	}
+
+	packages := []*apkrepo.Package{}
+	for _, apkFile := range ctx.emittedFilenames() {
+		src, err := filepath.Abs(apkFile)
+		if err != nil {
+			return "", err
+		}
+
+		if err := os.Symlink(src, filepath.Join(archDir, filepath.Base(apkFile))); err != nil {
+			return "", err
+		}
+
+		f, err := os.Open(src)
+		if err != nil {
+			return "", fmt.Errorf("failed to open package %s: %w", apkFile, err)
+		}
+
+		pkg, err := apkrepo.ParsePackage(f)
+		f.Close()
+		if err != nil {
+			return "", fmt.Errorf("failed to parse package %s: %w", apkFile, err)
+		}
+		packages = append(packages, pkg)
+	}
+
+	archive, err := apkrepo.ArchiveFromIndex(&apkrepo.ApkIndex{Packages: packages})
+	if err != nil {
+		return "", err
+	}
+
+	indexData, err := io.ReadAll(archive)
+	if err != nil {
+		return "", err
+	}
+
+	signingKey, err := generateTestKey(repoDir)
+	if err != nil {
+		return "", fmt.Errorf("unable to generate test repository key: %w", err)
+	}
+
+	signed, err := sign.SignIndex(indexData, signingKey, "")
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.WriteFile(filepath.Join(archDir, "APKINDEX.tar.gz"), signed, 0644); err != nil {
+		return "", err
+	}
+
+	return signingKey + ".pub", nil
+}
+
+// generateTestKey writes an ephemeral RSA keypair into dir and returns
+// the path of the private key, the public key being next to it with a
+// .pub suffix.
+func generateTestKey(dir string) (string, error) {
+	privkey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return "", err
+	}
+
+	keyFile := filepath.Join(dir, "melange-test.rsa")
+	privateKeyBlock := pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(privkey),
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&privateKeyBlock), 0600); err != nil {
+		return "", err
+	}
+
+	publicKeyData, err := x509.MarshalPKIXPublicKey(&privkey.PublicKey)
+	if err != nil {
+		return "", err
+	}
+	publicKeyBlock := pem.Block{
+		Type:  "PUBLIC KEY",
+		Bytes: publicKeyData,
+	}
+	if err := os.WriteFile(keyFile+".pub", pem.EncodeToMemory(&publicKeyBlock), 0644); err != nil {
+		return "", err
+	}
+
+	return keyFile, nil
+}
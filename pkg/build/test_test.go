@@ -0,0 +1,158 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1" // nolint:gosec
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	apko_types "chainguard.dev/apko/pkg/build/types"
+	"chainguard.dev/melange/internal/sign"
+	"github.com/stretchr/testify/require"
+	apkrepo "gitlab.alpinelinux.org/alpine/go/repository"
+)
+
+// newTestBuild returns a build context of the hello package with a
+// hello-doc subpackage, both emitted with the given files, relative to
+// the root of each package.
+func newTestBuild(t *testing.T, files map[string]string) *Context {
+	ctx := &Context{
+		Configuration: Configuration{
+			Package:     Package{Name: "hello", Version: "1.0", Epoch: 2},
+			Subpackages: []Subpackage{{Name: "hello-doc"}},
+		},
+		WorkspaceDir:    t.TempDir(),
+		OutDir:          t.TempDir(),
+		SourceDateEpoch: time.Unix(0, 0),
+		Arch:            apko_types.ParseArchitecture("x86_64"),
+		Logger:          log.New(io.Discard, "", 0),
+		Runner:          HostRunner(),
+	}
+
+	pctx := &PipelineContext{Context: ctx, Package: &ctx.Configuration.Package}
+	pcs := []*PackageContext{ctx.Configuration.Package.packageContext(pctx)}
+	for i := range ctx.Configuration.Subpackages {
+		pcs = append(pcs, ctx.Configuration.Subpackages[i].packageContext(pctx))
+	}
+
+	for _, pc := range pcs {
+		pc.Logger = log.New(io.Discard, "", 0)
+		for name, data := range files {
+			p := filepath.Join(pc.WorkspaceSubdir(), name)
+			require.NoError(t, os.MkdirAll(filepath.Dir(p), 0755))
+			require.NoError(t, os.WriteFile(p, []byte(data), 0644))
+		}
+	}
+
+	require.NoError(t, ctx.emitPackages(pcs))
+
+	return ctx
+}
+
+func TestEmittedFilenames(t *testing.T) {
+	ctx := newTestBuild(t, map[string]string{"usr/share/hello/README": "hello"})
+
+	emitted, err := filepath.Glob(filepath.Join(ctx.OutDir, "x86_64", "*.apk"))
+	require.NoError(t, err)
+
+	got := ctx.emittedFilenames()
+	sort.Strings(got)
+	require.Equal(t, emitted, got)
+	require.Equal(t, []string{
+		filepath.Join(ctx.OutDir, "x86_64", "hello-1.0-r2.apk"),
+		filepath.Join(ctx.OutDir, "x86_64", "hello-doc-1.0-r2.apk"),
+	}, got)
+}
+
+func TestBuildTestRepository(t *testing.T) {
+	ctx := newTestBuild(t, map[string]string{"usr/share/hello/README": "hello"})
+
+	repoDir := t.TempDir()
+	pubKey, err := ctx.buildTestRepository(repoDir)
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(repoDir, "melange-test.rsa.pub"), pubKey)
+
+	// the repository links to the emitted packages
+	for _, apkFile := range ctx.emittedFilenames() {
+		target, err := os.Readlink(filepath.Join(repoDir, "x86_64", filepath.Base(apkFile)))
+		require.NoError(t, err)
+		require.Equal(t, apkFile, target)
+	}
+
+	// the index is signed with the key whose public part is returned
+	data, err := os.ReadFile(filepath.Join(repoDir, "x86_64", "APKINDEX.tar.gz"))
+	require.NoError(t, err)
+
+	sigs, rest, err := sign.SplitSignatures(data)
+	require.NoError(t, err)
+	require.Len(t, sigs, 1)
+	require.Equal(t, sign.RSASignatureName(filepath.Join(repoDir, "melange-test.rsa")), sigs[0].Name)
+
+	digest := sha1.Sum(rest) // nolint:gosec
+	require.NoError(t, sign.RSAVerifySHA1Digest(digest[:], sigs[0].Data, pubKey))
+
+	index, err := apkrepo.IndexFromArchive(io.NopCloser(bytes.NewReader(rest)))
+	require.NoError(t, err)
+
+	names := []string{}
+	for _, pkg := range index.Packages {
+		names = append(names, pkg.Name+"-"+pkg.Version)
+	}
+	sort.Strings(names)
+	require.Equal(t, []string{"hello-1.0-r2", "hello-doc-1.0-r2"}, names)
+}
+
+func TestPackageTests(t *testing.T) {
+	ctx := &Context{
+		Configuration: Configuration{
+			Package: Package{Name: "hello"},
+			Subpackages: []Subpackage{
+				{Name: "hello-doc"},
+				{Name: "hello-dev", Test: Test{Pipeline: []Pipeline{{Runs: "true"}}}},
+			},
+		},
+	}
+
+	tests := ctx.packageTests()
+	require.Len(t, tests, 1)
+	require.Equal(t, "hello-dev", tests[0].name)
+	require.Equal(t, &ctx.Configuration.Subpackages[1], tests[0].subpackage)
+
+	ctx.Configuration.Test = Test{Pipeline: []Pipeline{{Runs: "true"}}}
+	tests = ctx.packageTests()
+	require.Len(t, tests, 2)
+	require.Equal(t, "hello", tests[0].name)
+	require.Nil(t, tests[0].subpackage)
+}
+
+func TestTestPackagesWithoutTests(t *testing.T) {
+	ctx := newTestBuild(t, map[string]string{"usr/share/hello/README": "hello"})
+
+	// without any test, the emitted packages are not even read
+	require.NoError(t, os.RemoveAll(ctx.OutDir))
+	require.NoError(t, ctx.TestPackages(context.Background()))
+
+	// with one, the repository of the emitted packages is built first
+	ctx.Configuration.Subpackages[0].Test = Test{Pipeline: []Pipeline{{Runs: "true"}}}
+	require.ErrorContains(t, ctx.TestPackages(context.Background()), "unable to build test repository")
+}
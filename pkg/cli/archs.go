@@ -0,0 +1,59 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"context"
+	"fmt"
+
+	apko_types "chainguard.dev/apko/pkg/build/types"
+	"chainguard.dev/melange/pkg/build"
+	"github.com/spf13/cobra"
+)
+
+func Archs() *cobra.Command {
+	var archstrs []string
+	var template string
+
+	cmd := &cobra.Command{
+		Use:     "archs",
+		Short:   "List the architectures a package would be built for",
+		Long:    `List the architectures a package would be built for, one per line.`,
+		Example: `  melange archs [--arch x86_64,aarch64] config.yaml`,
+		Args:    cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			archs := apko_types.ParseArchitectures(archstrs)
+			return ArchsCmd(cmd.Context(), args[0], template, archs)
+		},
+	}
+
+	cmd.Flags().StringVar(&template, "template", "", "template to apply to melange config (optional)")
+	cmd.Flags().StringSliceVar(&archstrs, "arch", nil, "architectures to intersect with the package's target-architecture (e.g., x86_64,ppc64le,arm64)")
+
+	return cmd
+}
+
+func ArchsCmd(ctx context.Context, configFile, template string, archs []apko_types.Architecture) error {
+	cfg := build.Configuration{}
+	if err := cfg.Load(configFile, template); err != nil {
+		return fmt.Errorf("failed to load configuration: %w", err)
+	}
+
+	for _, arch := range cfg.Package.ResolveArchitectures(archs) {
+		fmt.Println(arch.ToAPK())
+	}
+
+	return nil
+}
@@ -16,10 +16,13 @@ package cli
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"os"
 	"path/filepath"
+	"runtime"
+	"strings"
 
 	apko_types "chainguard.dev/apko/pkg/build/types"
 	"chainguard.dev/melange/pkg/build"
@@ -33,6 +36,7 @@ func Build() *cobra.Command {
 	var pipelineDir string
 	var sourceDir string
 	var signingKey string
+	var signingPassphraseEnv string
 	var useProot bool
 	var emptyWorkspace bool
 	var outDir string
@@ -42,6 +46,17 @@ func Build() *cobra.Command {
 	var template string
 	var dependencyLog string
 	var overlayBinSh string
+	var runnerName string
+	var cacheDir string
+	var fetchMirrors []string
+	var apkFormat string
+	var fulcioURL string
+	var identityTokenEnv string
+	var embedSBOM bool
+	var strictCopyright bool
+	var jobs int
+	var compressionLevel int
+	var parallelGzip bool
 
 	cmd := &cobra.Command{
 		Use:     "build",
@@ -51,11 +66,23 @@ func Build() *cobra.Command {
 		Args:    cobra.MinimumNArgs(0),
 		RunE: func(cmd *cobra.Command, args []string) error {
 			archs := apko_types.ParseArchitectures(archstrs)
+
+			signingPassphrase, err := readPassphrase(cmd.InOrStdin(), signingPassphraseEnv, false)
+			if err != nil {
+				return err
+			}
+
+			runner, err := build.GetRunner(runnerName)
+			if err != nil {
+				return err
+			}
+
 			options := []build.Option{
 				build.WithBuildDate(buildDate),
 				build.WithWorkspaceDir(workspaceDir),
 				build.WithPipelineDir(pipelineDir),
 				build.WithSigningKey(signingKey),
+				build.WithSigningPassphrase(signingPassphrase),
 				build.WithUseProot(useProot),
 				build.WithEmptyWorkspace(emptyWorkspace),
 				build.WithOutDir(outDir),
@@ -64,6 +91,16 @@ func Build() *cobra.Command {
 				build.WithTemplate(template),
 				build.WithDependencyLog(dependencyLog),
 				build.WithBinShOverlay(overlayBinSh),
+				build.WithRunner(runner),
+				build.WithCacheDir(cacheDir),
+				build.WithFetchMirrors(fetchMirrors),
+				build.WithApkFormat(apkFormat),
+				build.WithKeylessSigning(fulcioURL, os.Getenv(identityTokenEnv)),
+				build.WithEmbedSBOM(embedSBOM),
+				build.WithStrictCopyright(strictCopyright),
+				build.WithJobs(jobs),
+				build.WithCompressionLevel(compressionLevel),
+				build.WithParallelGzip(parallelGzip),
 			}
 
 			if len(args) > 0 {
@@ -92,12 +129,24 @@ func Build() *cobra.Command {
 	cmd.Flags().StringVar(&pipelineDir, "pipeline-dir", "/usr/share/melange/pipelines", "directory used to store defined pipelines")
 	cmd.Flags().StringVar(&sourceDir, "source-dir", "", "directory used for included sources")
 	cmd.Flags().StringVar(&signingKey, "signing-key", "", "key to use for signing")
+	cmd.Flags().StringVar(&signingPassphraseEnv, "signing-passphrase-env", "", "name of the environment variable holding the passphrase the signing key is encrypted with")
 	cmd.Flags().BoolVar(&useProot, "use-proot", false, "whether to use proot for fakeroot")
 	cmd.Flags().BoolVar(&emptyWorkspace, "empty-workspace", false, "whether the build workspace should be empty")
 	cmd.Flags().StringVar(&outDir, "out-dir", filepath.Join(cwd, "packages"), "directory where packages will be output")
 	cmd.Flags().StringVar(&template, "template", "", "template to apply to melange config (optional)")
-	cmd.Flags().StringVar(&dependencyLog, "dependency-log", "", "log dependencies to a specified file")
+	cmd.Flags().StringVar(&dependencyLog, "dependency-log", "", "write a report of the generated dependencies of all packages to the specified file, suffixed with the architecture")
 	cmd.Flags().StringVar(&overlayBinSh, "overlay-binsh", "", "use specified file as /bin/sh overlay in build environment")
+	cmd.Flags().StringVar(&runnerName, "runner", "bwrap", fmt.Sprintf("runner used to run the pipelines in the build environment (%s)", strings.Join(build.Runners, ", ")))
+	cmd.Flags().StringVar(&cacheDir, "cache-dir", "", "directory used to cache fetched artifacts (default is melange in the user cache directory)")
+	cmd.Flags().StringSliceVar(&fetchMirrors, "fetch-mirror", []string{}, "URL of a mirror to try before the original location of fetched artifacts (may be repeated)")
+	cmd.Flags().StringVar(&fulcioURL, "fulcio-url", "https://fulcio.sigstore.dev", "URL of the Fulcio instance issuing certificates for keyless signing")
+	cmd.Flags().StringVar(&identityTokenEnv, "identity-token-env", "SIGSTORE_ID_TOKEN", "name of the environment variable holding the OIDC identity token used for keyless signing when no signing key is set")
+	cmd.Flags().StringVar(&apkFormat, "apk-format", "v2", fmt.Sprintf("format of the emitted packages (%s)", strings.Join(build.ApkFormats, ", ")))
+	cmd.Flags().BoolVar(&embedSBOM, "embed-sbom", false, "whether to embed the SBOM of each package under /var/lib/db/sbom in the package")
+	cmd.Flags().BoolVar(&strictCopyright, "strict-copyright", false, "whether to fail the build when a package ships files not covered by any copyright entry")
+	cmd.Flags().IntVar(&jobs, "jobs", runtime.NumCPU(), "number of packages scanned and emitted at once")
+	cmd.Flags().IntVar(&compressionLevel, "compression-level", 0, "gzip level of the package data, from 1 (fastest) to 9 (smallest), or 0 for the default")
+	cmd.Flags().BoolVar(&parallelGzip, "parallel-gzip", true, "whether to compress the package data on all CPUs")
 	cmd.Flags().StringSliceVar(&archstrs, "arch", nil, "architectures to build for (e.g., x86_64,ppc64le,arm64) -- default is all, unless specified in config.")
 	cmd.Flags().StringSliceVarP(&extraKeys, "keyring-append", "k", []string{}, "path to extra keys to include in the build environment keyring")
 	cmd.Flags().StringSliceVarP(&extraRepos, "repository-append", "r", []string{}, "path to extra repositories to include in the build environment")
@@ -110,9 +159,9 @@ func BuildCmd(ctx context.Context, archs []apko_types.Architecture, base_opts ..
 		archs = apko_types.AllArchs
 	}
 
-	log.Printf("building for %v", archs)
-
-	var errg errgroup.Group
+	// A failure building for one architecture cancels the builds for
+	// the others.
+	errg, goctx := errgroup.WithContext(ctx)
 
 	// Set up the build contexts before running them.  This avoids various
 	// race conditions and the possibility that a context may be garbage
@@ -125,6 +174,10 @@ func BuildCmd(ctx context.Context, archs []apko_types.Architecture, base_opts ..
 		opts := append(base_opts, build.WithArch(arch))
 
 		bc, err := build.New(opts...)
+		if errors.Is(err, build.ErrSkipThisArch) {
+			log.Printf("skipping build for %s: not listed in the package's target-architecture", arch.ToAPK())
+			continue
+		}
 		if err != nil {
 			return err
 		}
@@ -132,11 +185,22 @@ func BuildCmd(ctx context.Context, archs []apko_types.Architecture, base_opts ..
 		bcs = append(bcs, bc)
 	}
 
+	if len(bcs) == 0 {
+		log.Printf("none of the requested architectures are supported by the package, nothing to build")
+		return nil
+	}
+
+	built := make([]string, 0, len(bcs))
+	for _, bc := range bcs {
+		built = append(built, bc.Arch.ToAPK())
+	}
+	log.Printf("building for %v", built)
+
 	for _, bc := range bcs {
 		bc := bc
 
 		errg.Go(func() error {
-			if err := bc.BuildPackage(); err != nil {
+			if err := bc.BuildPackage(goctx); err != nil {
 				return fmt.Errorf("failed to build package: %w", err)
 			}
 
@@ -30,6 +30,10 @@ func New() *cobra.Command {
 	cmd.AddCommand(Keygen())
 	cmd.AddCommand(Index())
 	cmd.AddCommand(SignIndex())
+	cmd.AddCommand(Sign())
+	cmd.AddCommand(Lint())
+	cmd.AddCommand(Archs())
+	cmd.AddCommand(Verify())
 	cmd.AddCommand(version.Version())
 	return cmd
 }
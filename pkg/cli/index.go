@@ -15,59 +15,346 @@
 package cli
 
 import (
+	"bufio"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"os"
+	"path/filepath"
+	"sort"
 
+	"chainguard.dev/melange/internal/adb"
+	"chainguard.dev/melange/internal/sign"
 	"github.com/spf13/cobra"
 	apkrepo "gitlab.alpinelinux.org/alpine/go/repository"
 )
 
+type IndexContext struct {
+	IndexFile       string
+	SourceIndexFile string
+	APKFiles        []string
+	Prune           bool
+	Description     string
+	SigningKey      string
+	Passphrase      string
+}
+
+// IndexOption configures the index written by IndexCmd.
+type IndexOption func(*IndexContext) error
+
+// WithIndexFile sets the path the index is written to, APKINDEX.tar.gz by
+// default.
+func WithIndexFile(indexFile string) IndexOption {
+	return func(ic *IndexContext) error {
+		ic.IndexFile = indexFile
+		return nil
+	}
+}
+
+// WithSourceIndexFile sets an existing index the packages are merged
+// into.
+func WithSourceIndexFile(sourceIndexFile string) IndexOption {
+	return func(ic *IndexContext) error {
+		ic.SourceIndexFile = sourceIndexFile
+		return nil
+	}
+}
+
+// WithAPKFiles sets the packages to add to the index.
+func WithAPKFiles(apkFiles []string) IndexOption {
+	return func(ic *IndexContext) error {
+		ic.APKFiles = apkFiles
+		return nil
+	}
+}
+
+// WithPrune sets whether entries for packages which are not next to the
+// index anymore are removed.
+func WithPrune(prune bool) IndexOption {
+	return func(ic *IndexContext) error {
+		ic.Prune = prune
+		return nil
+	}
+}
+
+// WithDescription sets the description of the index, which defaults to
+// the description of the source index.
+func WithDescription(description string) IndexOption {
+	return func(ic *IndexContext) error {
+		ic.Description = description
+		return nil
+	}
+}
+
+// WithIndexSigningKey sets the key the index is signed with, and the
+// passphrase it is encrypted with.
+func WithIndexSigningKey(signingKey, passphrase string) IndexOption {
+	return func(ic *IndexContext) error {
+		ic.SigningKey = signingKey
+		ic.Passphrase = passphrase
+		return nil
+	}
+}
+
+func newIndexContext(opts ...IndexOption) (*IndexContext, error) {
+	ic := IndexContext{
+		IndexFile: "APKINDEX.tar.gz",
+	}
+
+	for _, opt := range opts {
+		if err := opt(&ic); err != nil {
+			return nil, err
+		}
+	}
+
+	return &ic, nil
+}
+
 func Index() *cobra.Command {
 	var apkIndexFilename string
+	var sourceIndexFilename string
+	var prune bool
+	var description string
+	var signingKey string
+	var passphraseEnv string
+
 	cmd := &cobra.Command{
-		Use:     "index",
-		Short:   "Creates a repository index from a list of package files",
-		Long:    `Creates a repository index from a list of package files.`,
-		Example: `  melange index -o APKINDEX.tar.gz *.apk`,
-		Args:    cobra.MinimumNArgs(1),
+		Use:   "index",
+		Short: "Creates a repository index from a list of package files",
+		Long: `Creates a repository index from a list of package files.
+
+With --source, the packages are merged into an existing index instead: entries
+for packages with the same name, version and architecture are replaced, and
+the other entries are kept without parsing their packages again.
+
+With --signing-key, the index is signed before it is written, and the output
+file is only ever replaced by a complete, signed index.`,
+		Example: `  melange index -o APKINDEX.tar.gz *.apk
+  melange index --source APKINDEX.tar.gz -o APKINDEX.tar.gz hello-2.12-r0.apk
+  melange index --signing-key melange.rsa --description "my repository" *.apk`,
+		Args: cobra.ArbitraryArgs,
 		RunE: func(cmd *cobra.Command, args []string) error {
-			return IndexCmd(cmd.Context(), apkIndexFilename, args)
+			passphrase, err := readPassphrase(cmd.InOrStdin(), passphraseEnv, false)
+			if err != nil {
+				return err
+			}
+
+			return IndexCmd(cmd.Context(),
+				WithIndexFile(apkIndexFilename),
+				WithSourceIndexFile(sourceIndexFilename),
+				WithAPKFiles(args),
+				WithPrune(prune),
+				WithDescription(description),
+				WithIndexSigningKey(signingKey, passphrase),
+			)
 		},
 	}
 	cmd.Flags().StringVarP(&apkIndexFilename, "output", "o", "APKINDEX.tar.gz", "Output generated index to FILE")
+	cmd.Flags().StringVarP(&sourceIndexFilename, "source", "s", "", "existing index to merge the packages into")
+	cmd.Flags().BoolVar(&prune, "prune", false, "remove entries for packages which are not next to the output index anymore")
+	cmd.Flags().StringVar(&description, "description", "", "the description of the index, stored in its DESCRIPTION entry (default is the description of the source index)")
+	cmd.Flags().StringVar(&signingKey, "signing-key", "", "the key to sign the index with")
+	cmd.Flags().StringVar(&passphraseEnv, "signing-passphrase-env", "", "name of the environment variable holding the passphrase the signing key is encrypted with")
 	return cmd
 }
 
-func IndexCmd(ctx context.Context, apkIndexFilename string, apkFiles []string) error {
-	packages := []*apkrepo.Package{}
-	for _, apkFile := range apkFiles {
-		log.Printf("processing package %s", apkFile)
-		f, err := os.Open(apkFile)
+// indexKey identifies an entry of an index.
+type indexKey struct {
+	name    string
+	version string
+	arch    string
+}
+
+func packageIndexKey(pkg *apkrepo.Package) indexKey {
+	return indexKey{name: pkg.Name, version: pkg.Version, arch: pkg.Arch}
+}
+
+// IndexCmd writes an index of the packages given with WithAPKFiles,
+// merged into the index given with WithSourceIndexFile, if any.
+func IndexCmd(ctx context.Context, opts ...IndexOption) error {
+	ic, err := newIndexContext(opts...)
+	if err != nil {
+		return err
+	}
+
+	if len(ic.APKFiles) == 0 && ic.SourceIndexFile == "" {
+		return fmt.Errorf("no packages given")
+	}
+
+	entries := map[indexKey]*apkrepo.Package{}
+	description := ""
+
+	if ic.SourceIndexFile != "" {
+		source, err := loadIndex(ic.SourceIndexFile)
 		if err != nil {
-			return fmt.Errorf("failed to open package %s: %w", apkFile, err)
+			return err
+		}
+
+		for _, pkg := range source.Packages {
+			entries[packageIndexKey(pkg)] = pkg
 		}
-		pkg, err := apkrepo.ParsePackage(f)
+		description = source.Description
+
+		log.Printf("loaded %d entries from %s", len(source.Packages), ic.SourceIndexFile)
+	}
+
+	if ic.Description != "" {
+		description = ic.Description
+	}
+
+	for _, apkFile := range ic.APKFiles {
+		log.Printf("processing package %s", apkFile)
+
+		pkg, err := parsePackageFile(apkFile)
 		if err != nil {
-			return fmt.Errorf("failed to parse package %s: %w", apkFile, err)
+			return err
 		}
+
+		key := packageIndexKey(pkg)
+		if _, ok := entries[key]; ok {
+			log.Printf("replacing entry for %s-%s (%s)", pkg.Name, pkg.Version, pkg.Arch)
+		}
+		entries[key] = pkg
+	}
+
+	if ic.Prune {
+		dir := filepath.Dir(ic.IndexFile)
+		for key, pkg := range entries {
+			if _, err := os.Stat(filepath.Join(dir, pkg.Filename())); errors.Is(err, os.ErrNotExist) {
+				log.Printf("pruning entry for %s-%s (%s), %s does not exist", pkg.Name, pkg.Version, pkg.Arch, pkg.Filename())
+				delete(entries, key)
+			}
+		}
+	}
+
+	// Order the entries so that the same set of packages always results
+	// in the same index.
+	packages := make([]*apkrepo.Package, 0, len(entries))
+	for _, pkg := range entries {
 		packages = append(packages, pkg)
 	}
+	sort.Slice(packages, func(i, j int) bool {
+		a, b := packageIndexKey(packages[i]), packageIndexKey(packages[j])
+		if a.name != b.name {
+			return a.name < b.name
+		}
+		if a.version != b.version {
+			return a.version < b.version
+		}
+		return a.arch < b.arch
+	})
+
 	index := &apkrepo.ApkIndex{
-		Packages: packages,
+		Description: description,
+		Packages:    packages,
 	}
-	log.Printf("generating index at %s", apkIndexFilename)
+	log.Printf("generating index with %d entries at %s", len(packages), ic.IndexFile)
 	archive, err := apkrepo.ArchiveFromIndex(index)
 	if err != nil {
 		return err
 	}
-	outFile, err := os.Create(apkIndexFilename)
+
+	indexData, err := io.ReadAll(archive)
+	if err != nil {
+		return fmt.Errorf("unable to generate index: %w", err)
+	}
+
+	if ic.SigningKey != "" {
+		log.Printf("signing index with key %s", ic.SigningKey)
+
+		indexData, err = sign.SignIndex(indexData, ic.SigningKey, ic.Passphrase)
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := writeFileAtomic(ic.IndexFile, indexData, 0644); err != nil {
+		return fmt.Errorf("unable to write index: %w", err)
+	}
+
+	return nil
+}
+
+// writeFileAtomic writes data to a temporary file next to name and
+// renames it to name, so that name is never seen partially written.
+func writeFileAtomic(name string, data []byte, perm os.FileMode) error {
+	return writeFileAtomicFunc(name, perm, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+// writeFileAtomicFunc is like writeFileAtomic, with the contents of the
+// file written by write.
+func writeFileAtomicFunc(name string, perm os.FileMode, write func(w io.Writer) error) error {
+	f, err := os.CreateTemp(filepath.Dir(name), fmt.Sprintf(".%s.*.tmp", filepath.Base(name)))
 	if err != nil {
 		return err
 	}
-	defer outFile.Close()
-	_, err = io.Copy(outFile, archive)
-	return err
+	defer os.Remove(f.Name())
+
+	if err := write(f); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Chmod(perm); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), name)
+}
+
+func parsePackageFile(apkFile string) (*apkrepo.Package, error) {
+	f, err := os.Open(apkFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open package %s: %w", apkFile, err)
+	}
+	defer f.Close()
+
+	// Only packages in the v2 format can be indexed.
+	br := bufio.NewReader(f)
+	if header, err := br.Peek(4); err == nil && adb.IsFile(header) {
+		return nil, fmt.Errorf("package %s is an apk v3 package, which cannot be indexed", apkFile)
+	}
+
+	pkg, err := apkrepo.ParsePackage(br)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse package %s: %w", apkFile, err)
+	}
+
+	return pkg, nil
+}
+
+// loadIndex loads an existing index, or returns an empty one if the
+// index does not exist yet.
+func loadIndex(indexFile string) (*apkrepo.ApkIndex, error) {
+	f, err := os.Open(indexFile)
+	if errors.Is(err, os.ErrNotExist) {
+		log.Printf("source index %s does not exist, creating a new index", indexFile)
+		return &apkrepo.ApkIndex{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open index %s: %w", indexFile, err)
+	}
+	defer f.Close()
+
+	index, err := apkrepo.IndexFromArchive(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse index %s: %w", indexFile, err)
+	}
+
+	return index, nil
 }
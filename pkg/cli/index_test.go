@@ -0,0 +1,370 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha1" // nolint:gosec
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"chainguard.dev/melange/internal/adb"
+	"chainguard.dev/melange/internal/sign"
+	"github.com/stretchr/testify/require"
+	apkrepo "gitlab.alpinelinux.org/alpine/go/repository"
+)
+
+type testPackage struct {
+	name        string
+	version     string
+	arch        string
+	description string
+}
+
+func (p testPackage) String() string {
+	return fmt.Sprintf("%s-%s (%s): %s", p.name, p.version, p.arch, p.description)
+}
+
+// testTarGz appends a gzip compressed tarball of a single file to buf,
+// terminated only if terminate is set, as the sections of an apk are.
+func testTarGz(t *testing.T, buf *bytes.Buffer, terminate bool, name, contents string) {
+	zw := gzip.NewWriter(buf)
+	tw := tar.NewWriter(zw)
+
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(contents))}))
+	_, err := tw.Write([]byte(contents))
+	require.NoError(t, err)
+
+	if terminate {
+		require.NoError(t, tw.Close())
+	} else {
+		require.NoError(t, tw.Flush())
+	}
+	require.NoError(t, zw.Close())
+}
+
+// writeTestPackage writes an unsigned package into the directory of its
+// architecture in the repository at dir, under the file name apk gives
+// it, and returns its path.
+func writeTestPackage(t *testing.T, dir string, p testPackage) string {
+	var buf bytes.Buffer
+	testTarGz(t, &buf, false, ".PKGINFO", fmt.Sprintf("pkgname = %s\npkgver = %s\narch = %s\npkgdesc = %s\nsize = 5\n", p.name, p.version, p.arch, p.description))
+	testTarGz(t, &buf, true, "usr/bin/"+p.name, "hello")
+
+	archDir := filepath.Join(dir, p.arch)
+	require.NoError(t, os.MkdirAll(archDir, 0755))
+
+	path := filepath.Join(archDir, fmt.Sprintf("%s-%s.apk", p.name, p.version))
+	require.NoError(t, os.WriteFile(path, buf.Bytes(), 0644))
+
+	return path
+}
+
+// readTestIndex returns the index at path, and its entries in order.
+func readTestIndex(t *testing.T, path string) (*apkrepo.ApkIndex, []string) {
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+
+	index, err := apkrepo.IndexFromArchive(f)
+	require.NoError(t, err)
+
+	entries := []string{}
+	for _, pkg := range index.Packages {
+		entries = append(entries, testPackage{pkg.Name, pkg.Version, pkg.Arch, pkg.Description}.String())
+	}
+
+	return index, entries
+}
+
+func TestIndexCmd(t *testing.T) {
+	for _, tt := range []struct {
+		description string
+		source      []testPackage
+		remove      []string
+		apks        []testPackage
+		prune       bool
+		want        []testPackage
+	}{{
+		description: "new index",
+		apks: []testPackage{
+			{"hello", "1.0-r0", "x86_64", "hello"},
+			{"bye", "1.0-r0", "x86_64", "bye"},
+		},
+		want: []testPackage{
+			{"bye", "1.0-r0", "x86_64", "bye"},
+			{"hello", "1.0-r0", "x86_64", "hello"},
+		},
+	}, {
+		description: "merge with source",
+		source: []testPackage{
+			{"hello", "1.0-r0", "x86_64", "hello"},
+		},
+		apks: []testPackage{
+			{"bye", "1.0-r0", "x86_64", "bye"},
+		},
+		want: []testPackage{
+			{"bye", "1.0-r0", "x86_64", "bye"},
+			{"hello", "1.0-r0", "x86_64", "hello"},
+		},
+	}, {
+		description: "replace entry with the same name, version and architecture",
+		source: []testPackage{
+			{"hello", "1.0-r0", "aarch64", "old"},
+			{"hello", "1.0-r0", "x86_64", "old"},
+			{"hello", "0.9-r0", "x86_64", "old"},
+		},
+		apks: []testPackage{
+			{"hello", "1.0-r0", "x86_64", "new"},
+		},
+		want: []testPackage{
+			{"hello", "0.9-r0", "x86_64", "old"},
+			{"hello", "1.0-r0", "aarch64", "old"},
+			{"hello", "1.0-r0", "x86_64", "new"},
+		},
+	}, {
+		description: "keep entries of missing packages without pruning",
+		source: []testPackage{
+			{"hello", "1.0-r0", "x86_64", "hello"},
+			{"bye", "1.0-r0", "x86_64", "bye"},
+		},
+		remove: []string{"bye-1.0-r0.apk"},
+		apks: []testPackage{
+			{"world", "1.0-r0", "x86_64", "world"},
+		},
+		want: []testPackage{
+			{"bye", "1.0-r0", "x86_64", "bye"},
+			{"hello", "1.0-r0", "x86_64", "hello"},
+			{"world", "1.0-r0", "x86_64", "world"},
+		},
+	}, {
+		description: "prune entries of missing packages",
+		source: []testPackage{
+			{"hello", "1.0-r0", "x86_64", "hello"},
+			{"bye", "1.0-r0", "x86_64", "bye"},
+		},
+		remove: []string{"bye-1.0-r0.apk"},
+		apks: []testPackage{
+			{"world", "1.0-r0", "x86_64", "world"},
+		},
+		prune: true,
+		want: []testPackage{
+			{"hello", "1.0-r0", "x86_64", "hello"},
+			{"world", "1.0-r0", "x86_64", "world"},
+		},
+	}, {
+		description: "sort by name, version and architecture",
+		apks: []testPackage{
+			{"zlib", "1.2-r0", "x86_64", "zlib"},
+			{"hello", "2.0-r0", "x86_64", "hello"},
+			{"abc", "1.0-r0", "x86_64", "abc"},
+			{"hello", "1.0-r0", "x86_64", "hello"},
+		},
+		want: []testPackage{
+			{"abc", "1.0-r0", "x86_64", "abc"},
+			{"hello", "1.0-r0", "x86_64", "hello"},
+			{"hello", "2.0-r0", "x86_64", "hello"},
+			{"zlib", "1.2-r0", "x86_64", "zlib"},
+		},
+	}} {
+		t.Run(tt.description, func(t *testing.T) {
+			dir := t.TempDir()
+			indexFile := filepath.Join(dir, "x86_64", "APKINDEX.tar.gz")
+			require.NoError(t, os.MkdirAll(filepath.Dir(indexFile), 0755))
+
+			opts := []IndexOption{WithIndexFile(indexFile), WithPrune(tt.prune)}
+
+			if len(tt.source) > 0 {
+				apkFiles := []string{}
+				for _, p := range tt.source {
+					apkFiles = append(apkFiles, writeTestPackage(t, dir, p))
+				}
+				require.NoError(t, IndexCmd(context.Background(), WithIndexFile(indexFile), WithAPKFiles(apkFiles)))
+
+				opts = append(opts, WithSourceIndexFile(indexFile))
+			}
+
+			for _, name := range tt.remove {
+				require.NoError(t, os.Remove(filepath.Join(dir, "x86_64", name)))
+			}
+
+			apkFiles := []string{}
+			for _, p := range tt.apks {
+				apkFiles = append(apkFiles, writeTestPackage(t, dir, p))
+			}
+			opts = append(opts, WithAPKFiles(apkFiles))
+
+			require.NoError(t, IndexCmd(context.Background(), opts...))
+
+			want := []string{}
+			for _, p := range tt.want {
+				want = append(want, p.String())
+			}
+			_, entries := readTestIndex(t, indexFile)
+			require.Equal(t, want, entries)
+		})
+	}
+}
+
+func TestIndexCmdDeterministic(t *testing.T) {
+	dir := t.TempDir()
+	apkFiles := []string{
+		writeTestPackage(t, dir, testPackage{"hello", "1.0-r0", "x86_64", "hello"}),
+		writeTestPackage(t, dir, testPackage{"bye", "1.0-r0", "x86_64", "bye"}),
+		writeTestPackage(t, dir, testPackage{"world", "1.0-r0", "x86_64", "world"}),
+	}
+	reversed := []string{apkFiles[2], apkFiles[1], apkFiles[0]}
+
+	first := filepath.Join(dir, "first.tar.gz")
+	require.NoError(t, IndexCmd(context.Background(), WithIndexFile(first), WithAPKFiles(apkFiles)))
+
+	second := filepath.Join(dir, "second.tar.gz")
+	require.NoError(t, IndexCmd(context.Background(), WithIndexFile(second), WithAPKFiles(reversed)))
+
+	a, err := os.ReadFile(first)
+	require.NoError(t, err)
+	b, err := os.ReadFile(second)
+	require.NoError(t, err)
+	require.Equal(t, a, b)
+}
+
+func TestIndexCmdNoPackages(t *testing.T) {
+	require.ErrorContains(t, IndexCmd(context.Background(), WithIndexFile(filepath.Join(t.TempDir(), "APKINDEX.tar.gz"))), "no packages given")
+}
+
+func TestIndexCmdSigned(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "melange.rsa")
+	require.NoError(t, KeygenCmd(context.Background(), withKeyName(keyFile), withKeyType("rsa"), withBitSize(2048)))
+
+	indexFile := filepath.Join(dir, "x86_64", "APKINDEX.tar.gz")
+	apkFile := writeTestPackage(t, dir, testPackage{"hello", "1.0-r0", "x86_64", "hello"})
+
+	require.NoError(t, IndexCmd(context.Background(),
+		WithIndexFile(indexFile),
+		WithAPKFiles([]string{apkFile}),
+		WithDescription("my repository"),
+		WithIndexSigningKey(keyFile, ""),
+	))
+
+	signed, err := os.ReadFile(indexFile)
+	require.NoError(t, err)
+
+	sigs, data, err := sign.SplitSignatures(signed)
+	require.NoError(t, err)
+	require.Len(t, sigs, 1)
+	require.Equal(t, sign.RSASignatureName(keyFile), sigs[0].Name)
+
+	digest := sha1.Sum(data) // nolint:gosec
+	require.NoError(t, sign.RSAVerifySHA1Digest(digest[:], sigs[0].Data, keyFile+".pub"))
+
+	index, entries := readTestIndex(t, indexFile)
+	require.Equal(t, "my repository", index.Description)
+	require.Equal(t, []string{"hello-1.0-r0 (x86_64): hello"}, entries)
+
+	// The description of the source index is kept when merging.
+	apkFile = writeTestPackage(t, dir, testPackage{"bye", "1.0-r0", "x86_64", "bye"})
+	require.NoError(t, IndexCmd(context.Background(),
+		WithIndexFile(indexFile),
+		WithSourceIndexFile(indexFile),
+		WithAPKFiles([]string{apkFile}),
+	))
+
+	index, _ = readTestIndex(t, indexFile)
+	require.Equal(t, "my repository", index.Description)
+}
+
+func TestIndexCmdFailedWrite(t *testing.T) {
+	dir := t.TempDir()
+	indexFile := filepath.Join(dir, "x86_64", "APKINDEX.tar.gz")
+	apkFile := writeTestPackage(t, dir, testPackage{"hello", "1.0-r0", "x86_64", "hello"})
+
+	require.NoError(t, IndexCmd(context.Background(), WithIndexFile(indexFile), WithAPKFiles([]string{apkFile})))
+	previous, err := os.ReadFile(indexFile)
+	require.NoError(t, err)
+
+	// Signing with a missing key fails before anything is written.
+	apkFile = writeTestPackage(t, dir, testPackage{"bye", "1.0-r0", "x86_64", "bye"})
+	require.Error(t, IndexCmd(context.Background(),
+		WithIndexFile(indexFile),
+		WithSourceIndexFile(indexFile),
+		WithAPKFiles([]string{apkFile}),
+		WithIndexSigningKey(filepath.Join(dir, "missing.rsa"), ""),
+	))
+
+	// A failure while writing leaves the previous index in place.
+	require.ErrorContains(t, writeFileAtomicFunc(indexFile, 0644, func(w io.Writer) error {
+		if _, err := w.Write([]byte("partial")); err != nil {
+			return err
+		}
+		return errors.New("write failed")
+	}), "write failed")
+
+	data, err := os.ReadFile(indexFile)
+	require.NoError(t, err)
+	require.Equal(t, previous, data)
+
+	tmpFiles, err := filepath.Glob(filepath.Join(dir, "x86_64", ".*.tmp"))
+	require.NoError(t, err)
+	require.Empty(t, tmpFiles)
+}
+
+func TestIndexCmdV3(t *testing.T) {
+	dir := t.TempDir()
+
+	var buf bytes.Buffer
+	aw, err := adb.NewWriter(&buf, adb.SchemaPackage, true)
+	require.NoError(t, err)
+	require.NoError(t, aw.Close())
+
+	apkFile := filepath.Join(dir, "hello-1.0-r0.apk")
+	require.NoError(t, os.WriteFile(apkFile, buf.Bytes(), 0644))
+
+	err = IndexCmd(context.Background(), WithIndexFile(filepath.Join(dir, "APKINDEX.tar.gz")), WithAPKFiles([]string{apkFile}))
+	require.ErrorContains(t, err, "is an apk v3 package, which cannot be indexed")
+	require.NoFileExists(t, filepath.Join(dir, "APKINDEX.tar.gz"))
+}
+
+func TestIndexCommand(t *testing.T) {
+	dir := t.TempDir()
+	indexFile := filepath.Join(dir, "x86_64", "APKINDEX.tar.gz")
+	apkFile := writeTestPackage(t, dir, testPackage{"hello", "1.0-r0", "x86_64", "hello"})
+
+	cmd := Index()
+	cmd.SetArgs([]string{"-o", indexFile, "--description", "my repository", apkFile})
+	require.NoError(t, cmd.Execute())
+
+	index, entries := readTestIndex(t, indexFile)
+	require.Equal(t, "my repository", index.Description)
+	require.Equal(t, []string{"hello-1.0-r0 (x86_64): hello"}, entries)
+
+	// Packages are only optional when merging into a source index.
+	cmd = Index()
+	cmd.SetArgs([]string{"-o", indexFile})
+	cmd.SetOut(io.Discard)
+	cmd.SetErr(io.Discard)
+	require.ErrorContains(t, cmd.Execute(), "no packages given")
+
+	cmd = Index()
+	cmd.SetArgs([]string{"-o", indexFile, "--source", indexFile, "--prune"})
+	require.NoError(t, cmd.Execute())
+}
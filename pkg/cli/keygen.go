@@ -15,21 +15,30 @@
 package cli
 
 import (
+	"bufio"
 	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
-	"crypto/x509"
-	"encoding/pem"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"os"
+	"strings"
 
+	"chainguard.dev/melange/internal/sign"
 	"github.com/spf13/cobra"
 )
 
 type KeygenContext struct {
-	KeyName string
-	BitSize int
+	KeyName    string
+	KeyType    string
+	BitSize    int
+	Passphrase string
 }
 
 type KeygenOption func(*KeygenContext) error
@@ -41,6 +50,19 @@ func withKeyName(keyName string) KeygenOption {
 	}
 }
 
+func withKeyType(keyType string) KeygenOption {
+	return func(kc *KeygenContext) error {
+		switch keyType {
+		case "rsa", "ecdsa", "ed25519":
+		default:
+			return fmt.Errorf("unsupported key type %q (supported: rsa, ecdsa, ed25519)", keyType)
+		}
+
+		kc.KeyType = keyType
+		return nil
+	}
+}
+
 func withBitSize(bitSize int) KeygenOption {
 	return func(kc *KeygenContext) error {
 		kc.BitSize = bitSize
@@ -48,9 +70,16 @@ func withBitSize(bitSize int) KeygenOption {
 	}
 }
 
+func withPassphrase(passphrase string) KeygenOption {
+	return func(kc *KeygenContext) error {
+		kc.Passphrase = passphrase
+		return nil
+	}
+}
+
 func newKeygenContext(opts ...KeygenOption) (*KeygenContext, error) {
 	kc := KeygenContext{
-		KeyName: "melange.rsa",
+		KeyType: "rsa",
 		BitSize: 4096,
 	}
 
@@ -60,6 +89,10 @@ func newKeygenContext(opts ...KeygenOption) (*KeygenContext, error) {
 		}
 	}
 
+	if kc.KeyName == "" {
+		kc.KeyName = fmt.Sprintf("melange.%s", kc.KeyType)
+	}
+
 	return &kc, nil
 }
 
@@ -73,18 +106,61 @@ func (kc *KeygenContext) GenerateKeypair() (*rsa.PrivateKey, *rsa.PublicKey, err
 	return privateKey, publicKey, nil
 }
 
+// GenerateKey generates a private key of the configured type.
+func (kc *KeygenContext) GenerateKey() (crypto.Signer, error) {
+	switch kc.KeyType {
+	case "ecdsa":
+		privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, fmt.Errorf("unable to generate ECDSA private key: %w", err)
+		}
+		return privateKey, nil
+	case "ed25519":
+		_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, fmt.Errorf("unable to generate Ed25519 private key: %w", err)
+		}
+		return privateKey, nil
+	}
+
+	privateKey, _, err := kc.GenerateKeypair()
+	if err != nil {
+		return nil, err
+	}
+	return privateKey, nil
+}
+
 func Keygen() *cobra.Command {
 	var keySize int
+	var keyType string
+	var passphraseEnv string
+	var passphraseStdin bool
 
 	cmd := &cobra.Command{
-		Use:     "keygen",
-		Short:   "Generate a key for package signing",
-		Long:    `Generate a key for package signing.`,
-		Example: `  melange keygen [key.rsa]`,
-		Args:    cobra.MinimumNArgs(0),
+		Use:   "keygen",
+		Short: "Generate a key for package signing",
+		Long: `Generate a key for package signing.
+
+The private key is written with 0600 permissions, next to the public key,
+which has a .pub suffix, and the fingerprint of the public key, which has a
+.fingerprint suffix.  The private key can be encrypted with a passphrase read
+from an environment variable or from standard input.
+
+Only RSA keys can currently be used to sign packages and indexes.`,
+		Example: `  melange keygen [key.rsa]
+  MELANGE_PASSPHRASE=... melange keygen --passphrase-env MELANGE_PASSPHRASE key.rsa
+  melange keygen --type ed25519 key.ed25519`,
+		Args: cobra.MinimumNArgs(0),
 		RunE: func(cmd *cobra.Command, args []string) error {
+			passphrase, err := readPassphrase(cmd.InOrStdin(), passphraseEnv, passphraseStdin)
+			if err != nil {
+				return err
+			}
+
 			options := []KeygenOption{
+				withKeyType(keyType),
 				withBitSize(keySize),
+				withPassphrase(passphrase),
 			}
 
 			if len(args) > 0 {
@@ -95,60 +171,119 @@ func Keygen() *cobra.Command {
 		},
 	}
 
-	cmd.Flags().IntVar(&keySize, "key-size", 4096, "the size of the prime to calculate (in bits)")
+	cmd.Flags().IntVar(&keySize, "key-size", 4096, "the size of the prime to calculate (in bits), for RSA keys")
+	cmd.Flags().StringVar(&keyType, "type", "rsa", "the type of key to generate (rsa, ecdsa or ed25519)")
+	cmd.Flags().StringVar(&passphraseEnv, "passphrase-env", "", "name of the environment variable holding the passphrase to encrypt the private key with")
+	cmd.Flags().BoolVar(&passphraseStdin, "passphrase-stdin", false, "read the passphrase to encrypt the private key with from standard input")
 
 	return cmd
 }
 
+// readPassphrase returns the passphrase held by the environment variable
+// named env, or the first line of stdin if fromStdin is set, or an empty
+// passphrase if neither is requested.
+func readPassphrase(stdin io.Reader, env string, fromStdin bool) (string, error) {
+	switch {
+	case env != "" && fromStdin:
+		return "", fmt.Errorf("--passphrase-env and --passphrase-stdin are mutually exclusive")
+	case env != "":
+		passphrase, ok := os.LookupEnv(env)
+		if !ok || passphrase == "" {
+			return "", fmt.Errorf("environment variable %s is not set", env)
+		}
+		return passphrase, nil
+	case fromStdin:
+		line, err := bufio.NewReader(stdin).ReadString('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return "", fmt.Errorf("unable to read passphrase: %w", err)
+		}
+
+		passphrase := strings.TrimRight(line, "\r\n")
+		if passphrase == "" {
+			return "", fmt.Errorf("empty passphrase read from standard input")
+		}
+		return passphrase, nil
+	}
+
+	return "", nil
+}
+
 func KeygenCmd(ctx context.Context, opts ...KeygenOption) error {
 	kc, err := newKeygenContext(opts...)
 	if err != nil {
 		return err
 	}
 
-	log.Printf("generating keypair with a %d bit prime, please wait...", kc.BitSize)
+	if kc.KeyType == "rsa" {
+		log.Printf("generating %s keypair with a %d bit prime, please wait...", kc.KeyType, kc.BitSize)
+	} else {
+		log.Printf("generating %s keypair...", kc.KeyType)
+	}
 
-	privkey, pubkey, err := kc.GenerateKeypair()
+	privkey, err := kc.GenerateKey()
 	if err != nil {
 		return err
 	}
 
-	privateKeyData := x509.MarshalPKCS1PrivateKey(privkey)
-	privateKeyBlock := pem.Block{
-		Type:  "RSA PRIVATE KEY",
-		Bytes: privateKeyData,
-	}
-	privatePem, err := os.Create(kc.KeyName)
+	privatePem, err := sign.EncodePrivateKey(privkey, kc.Passphrase)
 	if err != nil {
-		return fmt.Errorf("unable to open private key for writing: %w", err)
+		return fmt.Errorf("unable to encode private key: %w", err)
 	}
-	defer privatePem.Close()
 
-	if err := pem.Encode(privatePem, &privateKeyBlock); err != nil {
-		return fmt.Errorf("unable to encode private key: %w", err)
+	if err := writeKeyFile(kc.KeyName, privatePem, 0600); err != nil {
+		return fmt.Errorf("unable to write private key: %w", err)
 	}
 
-	log.Printf("wrote private key to %s", privatePem.Name())
+	if kc.Passphrase != "" {
+		log.Printf("wrote private key encrypted with the passphrase to %s", kc.KeyName)
+	} else {
+		log.Printf("wrote private key to %s", kc.KeyName)
+	}
 
-	publicKeyData, err := x509.MarshalPKIXPublicKey(pubkey)
+	publicPem, err := sign.EncodePublicKey(privkey.Public())
 	if err != nil {
 		return fmt.Errorf("unable to calculate public key: %w", err)
 	}
-	publicKeyBlock := pem.Block{
-		Type:  "PUBLIC KEY",
-		Bytes: publicKeyData,
+
+	publicKeyName := fmt.Sprintf("%s.pub", kc.KeyName)
+	if err := writeKeyFile(publicKeyName, publicPem, 0644); err != nil {
+		return fmt.Errorf("unable to write public key: %w", err)
 	}
-	publicPem, err := os.Create(fmt.Sprintf("%s.pub", kc.KeyName))
+
+	log.Printf("wrote public key to %s", publicKeyName)
+
+	fingerprint, err := sign.Fingerprint(privkey.Public())
 	if err != nil {
-		return fmt.Errorf("unable to open public key for writing: %w", err)
+		return fmt.Errorf("unable to calculate key fingerprint: %w", err)
 	}
-	defer publicPem.Close()
 
-	if err := pem.Encode(publicPem, &publicKeyBlock); err != nil {
-		return fmt.Errorf("unable to encode public key: %w", err)
+	fingerprintName := fmt.Sprintf("%s.fingerprint", kc.KeyName)
+	if err := writeKeyFile(fingerprintName, []byte(fingerprint+"\n"), 0644); err != nil {
+		return fmt.Errorf("unable to write key fingerprint: %w", err)
 	}
 
-	log.Printf("wrote public key to %s", publicPem.Name())
+	log.Printf("wrote key fingerprint %s to %s", fingerprint, fingerprintName)
 
 	return nil
 }
+
+// writeKeyFile writes data to name with the given permissions, which
+// are also applied if the file already exists.
+func writeKeyFile(name string, data []byte, perm os.FileMode) error {
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, perm)
+	if err != nil {
+		return err
+	}
+
+	if err := f.Chmod(perm); err != nil {
+		f.Close()
+		return err
+	}
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
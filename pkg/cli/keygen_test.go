@@ -0,0 +1,79 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"chainguard.dev/melange/internal/sign"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeygenCmd(t *testing.T) {
+	for _, tt := range []struct {
+		keyType    string
+		passphrase string
+	}{
+		{"rsa", "secret"},
+		{"ecdsa", ""},
+		{"ed25519", ""},
+	} {
+		t.Run(tt.keyType, func(t *testing.T) {
+			keyName := filepath.Join(t.TempDir(), "melange."+tt.keyType)
+
+			// an existing private key is made private as well
+			require.NoError(t, os.WriteFile(keyName, []byte("old"), 0644))
+
+			require.NoError(t, KeygenCmd(context.Background(),
+				withKeyName(keyName),
+				withKeyType(tt.keyType),
+				withBitSize(1024),
+				withPassphrase(tt.passphrase),
+			))
+
+			fi, err := os.Stat(keyName)
+			require.NoError(t, err)
+			require.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+
+			fi, err = os.Stat(keyName + ".pub")
+			require.NoError(t, err)
+			require.Equal(t, os.FileMode(0644), fi.Mode().Perm())
+
+			data, err := os.ReadFile(keyName + ".pub")
+			require.NoError(t, err)
+			block, _ := pem.Decode(data)
+			require.NotNil(t, block)
+			pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+			require.NoError(t, err)
+
+			fingerprint, err := sign.Fingerprint(pub)
+			require.NoError(t, err)
+			data, err = os.ReadFile(keyName + ".fingerprint")
+			require.NoError(t, err)
+			require.Equal(t, fingerprint+"\n", string(data))
+
+			if tt.keyType == "rsa" {
+				key, err := sign.LoadPrivateKey(keyName, tt.passphrase)
+				require.NoError(t, err)
+				require.True(t, key.PublicKey.Equal(pub))
+			}
+		})
+	}
+}
@@ -0,0 +1,70 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"chainguard.dev/melange/pkg/build"
+	"github.com/spf13/cobra"
+)
+
+func Lint() *cobra.Command {
+	var pipelineDir string
+	var template string
+
+	cmd := &cobra.Command{
+		Use:     "lint",
+		Short:   "Check a YAML configuration file for problems",
+		Long:    `Check a YAML configuration file for problems without building it.`,
+		Example: `  melange lint config.yaml [config.yaml...]`,
+		Args:    cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return LintCmd(cmd.Context(), pipelineDir, template, args)
+		},
+	}
+
+	cmd.Flags().StringVar(&pipelineDir, "pipeline-dir", "/usr/share/melange/pipelines", "directory used to store defined pipelines")
+	cmd.Flags().StringVar(&template, "template", "", "template to apply to melange config (optional)")
+
+	return cmd
+}
+
+func LintCmd(ctx context.Context, pipelineDir, template string, configFiles []string) error {
+	count := 0
+
+	for _, configFile := range configFiles {
+		issues, err := build.LintConfiguration(configFile, template, pipelineDir)
+		if err != nil {
+			return fmt.Errorf("failed to lint %s: %w", configFile, err)
+		}
+
+		for _, issue := range issues {
+			fmt.Println(issue)
+		}
+
+		count += len(issues)
+	}
+
+	if count > 0 {
+		return fmt.Errorf("found %d problem(s)", count)
+	}
+
+	log.Printf("no problems found")
+
+	return nil
+}
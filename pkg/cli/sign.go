@@ -15,146 +15,193 @@
 package cli
 
 import (
-	"archive/tar"
-	"bytes"
-	"compress/gzip"
 	"context"
-	"crypto/sha1" // nolint:gosec
 	"fmt"
 	"io"
 	"log"
 	"os"
-	"path/filepath"
-	"strings"
 
-	"chainguard.dev/apko/pkg/tarball"
 	"chainguard.dev/melange/internal/sign"
-	"github.com/psanford/memfs"
 	"github.com/spf13/cobra"
 )
 
-func SignIndex() *cobra.Command {
+func Sign() *cobra.Command {
 	var signingKey string
+	var passphraseEnv string
+	var replace bool
 
 	cmd := &cobra.Command{
-		Use:     "sign-index",
-		Short:   "Sign an APK index",
-		Long:    `Sign an APK index.`,
-		Example: `  melange sign-index [--signing-key=key.rsa] <APKINDEX.tar.gz>`,
+		Use:   "sign",
+		Short: "Sign already built packages",
+		Long: `Sign already built packages, so that packages built on untrusted hosts can be
+signed on a trusted one.
+
+Each package is rewritten with a signature section prepended, and is only
+replaced once it has been written completely.  Packages which are already
+signed are refused, unless --replace is given, in which case their signatures
+are replaced.`,
+		Example: `  melange sign --signing-key=key.rsa *.apk`,
 		Args:    cobra.MinimumNArgs(1),
 		RunE: func(cmd *cobra.Command, args []string) error {
-			return SignIndexCmd(cmd.Context(), signingKey, args[0])
+			passphrase, err := readPassphrase(cmd.InOrStdin(), passphraseEnv, false)
+			if err != nil {
+				return err
+			}
+
+			return SignCmd(cmd.Context(), signingKey, passphrase, replace, args)
 		},
 	}
 
 	cmd.Flags().StringVar(&signingKey, "signing-key", "melange.rsa", "the signing key to use")
+	cmd.Flags().StringVar(&passphraseEnv, "signing-passphrase-env", "", "name of the environment variable holding the passphrase the signing key is encrypted with")
+	cmd.Flags().BoolVar(&replace, "replace", false, "replace the existing signatures of packages which are already signed")
 
 	return cmd
 }
 
-func indexIsAlreadySigned(indexFile string) bool {
-	index, err := os.Open(indexFile)
-	if err != nil {
-		log.Fatalf("cannot open index %s: %v", indexFile, err)
-	}
-	defer index.Close()
-
-	gzi, err := gzip.NewReader(index)
-	if err != nil {
-		log.Fatalf("cannot open index %s: %v", indexFile, err)
-	}
-	defer gzi.Close()
-
-	tari := tar.NewReader(gzi)
-	for {
-		hdr, err := tari.Next()
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			log.Fatalf("cannot read index %s: %v", indexFile, err)
+func SignCmd(ctx context.Context, signingKey, passphrase string, replace bool, apkFiles []string) error {
+	for _, apkFile := range apkFiles {
+		if err := signPackageFile(apkFile, signingKey, passphrase, replace); err != nil {
+			return fmt.Errorf("unable to sign package %s: %w", apkFile, err)
 		}
 
-		if strings.HasPrefix(hdr.Name, ".SIGN.RSA") {
-			return true
-		}
+		log.Printf("signed package %s with key %s", apkFile, signingKey)
 	}
 
-	return false
+	return nil
 }
 
-func readAndHashIndex(indexFile string) ([]byte, []byte, error) {
-	index, err := os.Open(indexFile)
+func signPackageFile(apkFile, signingKey, passphrase string, replace bool) error {
+	f, err := os.Open(apkFile)
 	if err != nil {
-		return nil, nil, fmt.Errorf("unable to open index for signing: %w", err)
+		return err
 	}
-	defer index.Close()
+	defer f.Close()
 
-	digest := sha1.New() // nolint:gosec
-	hasher := io.TeeReader(index, digest)
-	indexBuf, err := io.ReadAll(hasher)
+	fi, err := f.Stat()
 	if err != nil {
-		return nil, nil, fmt.Errorf("unable to read index: %w", err)
+		return err
 	}
 
-	return indexBuf, digest.Sum(nil), nil
+	return writeFileAtomicFunc(apkFile, fi.Mode().Perm(), func(w io.Writer) error {
+		return sign.SignPackage(f, w, signingKey, passphrase, replace)
+	})
 }
 
-func SignIndexCmd(ctx context.Context, signingKey string, indexFile string) error {
-	if indexIsAlreadySigned(indexFile) {
-		log.Printf("index %s is already signed, doing nothing", indexFile)
-		return nil
+func SignIndex() *cobra.Command {
+	var signingKey string
+	var passphraseEnv string
+	var replace bool
+	var appendSignature bool
+
+	cmd := &cobra.Command{
+		Use:   "sign-index",
+		Short: "Sign an APK index",
+		Long: `Sign an APK index.
+
+An index which is already signed is left alone, unless --replace is given, in
+which case its signatures are replaced by one made with the signing key, or
+--append is given, in which case a signature made with the signing key is
+added to the existing ones, so that both the old and the new keys verify it
+while rotating keys.`,
+		Example: `  melange sign-index [--signing-key=key.rsa] <APKINDEX.tar.gz>
+  melange sign-index --signing-key=new.rsa --append APKINDEX.tar.gz`,
+		Args: cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if replace && appendSignature {
+				return fmt.Errorf("--replace and --append are mutually exclusive")
+			}
+
+			passphrase, err := readPassphrase(cmd.InOrStdin(), passphraseEnv, false)
+			if err != nil {
+				return err
+			}
+
+			mode := SignIndexKeep
+			switch {
+			case replace:
+				mode = SignIndexReplace
+			case appendSignature:
+				mode = SignIndexAppend
+			}
+
+			return SignIndexCmd(cmd.Context(), signingKey, passphrase, mode, args[0])
+		},
 	}
 
-	log.Printf("signing index %s with key %s", indexFile, signingKey)
+	cmd.Flags().StringVar(&signingKey, "signing-key", "melange.rsa", "the signing key to use")
+	cmd.Flags().StringVar(&passphraseEnv, "signing-passphrase-env", "", "name of the environment variable holding the passphrase the signing key is encrypted with")
+	cmd.Flags().BoolVar(&replace, "replace", false, "replace the existing signatures of the index")
+	cmd.Flags().BoolVar(&appendSignature, "append", false, "add a signature to the existing signatures of the index")
 
-	indexData, indexDigest, err := readAndHashIndex(indexFile)
+	return cmd
+}
+
+// SignIndexMode says what to do with the existing signatures of an index.
+type SignIndexMode int
+
+const (
+	// SignIndexKeep leaves an index which is already signed alone.
+	SignIndexKeep SignIndexMode = iota
+
+	// SignIndexReplace replaces the existing signatures.
+	SignIndexReplace
+
+	// SignIndexAppend adds a signature to the existing signatures.
+	SignIndexAppend
+)
+
+func SignIndexCmd(ctx context.Context, signingKey, passphrase string, mode SignIndexMode, indexFile string) error {
+	data, err := os.ReadFile(indexFile)
 	if err != nil {
-		return err
+		return fmt.Errorf("unable to read index: %w", err)
 	}
 
-	sigData, err := sign.RSASignSHA1Digest(indexDigest, signingKey, "")
+	sigs, indexData, err := sign.SplitSignatures(data)
 	if err != nil {
-		return fmt.Errorf("unable to sign index: %w", err)
+		return fmt.Errorf("unable to read index %s: %w", indexFile, err)
 	}
 
-	log.Printf("appending signature to index %s", indexFile)
-
-	sigFS := memfs.New()
-	if err := sigFS.WriteFile(fmt.Sprintf(".SIGN.RSA.%s.pub", filepath.Base(signingKey)), sigData, 0644); err != nil {
-		return fmt.Errorf("unable to append signature: %w", err)
+	if len(sigs) > 0 {
+		switch mode {
+		case SignIndexKeep:
+			log.Printf("index %s is already signed, doing nothing", indexFile)
+			return nil
+		case SignIndexReplace:
+			log.Printf("replacing %d existing signature(s) of index %s", len(sigs), indexFile)
+			sigs = nil
+		case SignIndexAppend:
+			log.Printf("keeping %d existing signature(s) of index %s", len(sigs), indexFile)
+		}
 	}
 
-	// prepare control.tar.gz
-	multitarctx, err := tarball.NewContext(
-		tarball.WithOverrideUIDGID(0, 0),
-		tarball.WithOverrideUname("root"),
-		tarball.WithOverrideGname("root"),
-		tarball.WithSkipClose(true),
-	)
+	log.Printf("signing index %s with key %s", indexFile, signingKey)
+
+	sig, err := sign.IndexSignature(indexData, signingKey, passphrase)
 	if err != nil {
-		return fmt.Errorf("unable to build tarball context: %w", err)
+		return err
 	}
 
-	log.Printf("writing signed index to %s", indexFile)
-
-	var sigBuffer bytes.Buffer
-	if err := multitarctx.WriteArchive(&sigBuffer, sigFS); err != nil {
-		return fmt.Errorf("unable to write signature tarball: %w", err)
+	// A signature made with a key of the same name replaces the
+	// existing one, as apk could only use one of them.
+	kept := []sign.Signature{}
+	for _, s := range sigs {
+		if s.Name == sig.Name {
+			log.Printf("replacing existing signature %s", s.Name)
+			continue
+		}
+		kept = append(kept, s)
 	}
 
-	idx, err := os.Create(indexFile)
+	sigData, err := sign.SignatureSection(append(kept, sig))
 	if err != nil {
-		return fmt.Errorf("unable to open index for writing: %w", err)
+		return err
 	}
-	defer idx.Close()
 
-	if _, err := io.Copy(idx, &sigBuffer); err != nil {
-		return fmt.Errorf("unable to write index signature: %w", err)
-	}
+	log.Printf("writing signed index to %s", indexFile)
 
-	if _, err := idx.Write(indexData); err != nil {
-		return fmt.Errorf("unable to write index data: %w", err)
+	if err := writeFileAtomic(indexFile, append(sigData, indexData...), 0644); err != nil {
+		return fmt.Errorf("unable to write signed index: %w", err)
 	}
 
 	log.Printf("signed index %s with key %s", indexFile, signingKey)
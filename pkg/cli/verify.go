@@ -0,0 +1,123 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"os"
+
+	"chainguard.dev/melange/internal/sign"
+	"github.com/spf13/cobra"
+)
+
+func Verify() *cobra.Command {
+	var keys []string
+	var rootsFile string
+
+	cmd := &cobra.Command{
+		Use:   "verify",
+		Short: "Verify the signatures of packages and indexes",
+		Long: `Verify the signatures of packages and APKINDEX.tar.gz indexes against a set
+of trusted public keys.  For packages, the data section is also checked against
+the datahash recorded in .PKGINFO.
+
+Keyless signatures are verified against the certificate authorities in the
+file given with --roots, such as the Fulcio root certificate.
+
+The result is printed for every file, and the command fails if any file is
+unsigned, not signed with a trusted key or has been tampered with.`,
+		Example: `  melange verify -k melange.rsa.pub *.apk APKINDEX.tar.gz
+  melange verify --roots fulcio.crt.pem *.apk`,
+		Args: cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return VerifyCmd(cmd.Context(), keys, rootsFile, args)
+		},
+	}
+
+	cmd.Flags().StringSliceVarP(&keys, "key", "k", []string{}, "path to a trusted public key, matched with signatures by file name (may be repeated)")
+	cmd.Flags().StringVar(&rootsFile, "roots", "", "path to a PEM file of root certificates trusted to certify keyless signatures")
+
+	return cmd
+}
+
+func VerifyCmd(ctx context.Context, keys []string, rootsFile string, files []string) error {
+	if len(keys) == 0 && rootsFile == "" {
+		return fmt.Errorf("no trusted keys or roots given")
+	}
+
+	var roots *x509.CertPool
+	if rootsFile != "" {
+		data, err := os.ReadFile(rootsFile)
+		if err != nil {
+			return fmt.Errorf("unable to read roots: %w", err)
+		}
+
+		roots = x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(data) {
+			return fmt.Errorf("no certificates found in %s", rootsFile)
+		}
+	}
+
+	failed := 0
+	for _, file := range files {
+		v, err := verifyFile(file, keys, roots)
+		if err != nil {
+			fmt.Printf("FAIL %s: %v\n", file, err)
+			failed++
+			continue
+		}
+
+		if v.Certificate != nil {
+			fmt.Printf("PASS %s (%s signed keylessly for %s)\n", file, v.Kind, certificateIdentity(v.Certificate))
+			continue
+		}
+
+		fmt.Printf("PASS %s (%s signed with %s)\n", file, v.Kind, v.Key)
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("verification failed for %d of %d file(s)", failed, len(files))
+	}
+
+	log.Printf("verified %d file(s)", len(files))
+
+	return nil
+}
+
+func verifyFile(file string, keys []string, roots *x509.CertPool) (*sign.Verification, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return sign.Verify(f, keys, roots)
+}
+
+// certificateIdentity returns the identity a keyless signing certificate
+// was issued for.
+func certificateIdentity(cert *x509.Certificate) string {
+	switch {
+	case len(cert.EmailAddresses) > 0:
+		return cert.EmailAddresses[0]
+	case len(cert.URIs) > 0:
+		return cert.URIs[0].String()
+	default:
+		return cert.Subject.String()
+	}
+}
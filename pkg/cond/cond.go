@@ -0,0 +1,282 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cond evaluates the conditions used in the `if:` field of
+// pipeline steps.
+//
+// A condition compares operands with `==` and `!=`, and combines the
+// results with `&&`, `||`, `!` and parentheses.  An operand is either a
+// variable, written as a substitution such as `${{build.arch}}`, a quoted
+// string, or a bare word such as `aarch64`.  Variables which are not set
+// evaluate to the empty string.  An operand used on its own is true
+// unless it is empty or `false`.
+package cond
+
+import (
+	"fmt"
+	"strings"
+)
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenValue
+	tokenEqual
+	tokenNotEqual
+	tokenAnd
+	tokenOr
+	tokenNot
+	tokenLParen
+	tokenRParen
+)
+
+type token struct {
+	kind  tokenKind
+	value string
+	pos   int
+}
+
+// Evaluate evaluates the condition expr, looking up variables in vars,
+// which is keyed by the full substitution, such as `${{build.arch}}`.
+func Evaluate(expr string, vars map[string]string) (bool, error) {
+	tokens, err := lex(expr, vars)
+	if err != nil {
+		return false, err
+	}
+
+	p := parser{tokens: tokens}
+	result, err := p.parseOr()
+	if err != nil {
+		return false, err
+	}
+
+	if tok := p.peek(); tok.kind != tokenEOF {
+		return false, fmt.Errorf("unexpected %q at position %d", tok.value, tok.pos)
+	}
+
+	return result.truth(), nil
+}
+
+func isWordByte(c byte) bool {
+	switch {
+	case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		return true
+	}
+
+	return strings.IndexByte("_-.+/:", c) >= 0
+}
+
+// lex splits expr into tokens, resolving variables to their values.
+func lex(expr string, vars map[string]string) ([]token, error) {
+	tokens := []token{}
+
+	for i := 0; i < len(expr); {
+		c := expr[i]
+
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case strings.HasPrefix(expr[i:], "${{"):
+			end := strings.Index(expr[i:], "}}")
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated variable at position %d", i)
+			}
+			name := expr[i : i+end+2]
+			tokens = append(tokens, token{kind: tokenValue, value: vars[name], pos: i})
+			i += end + 2
+		case c == '\'' || c == '"':
+			end := strings.IndexByte(expr[i+1:], c)
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated string at position %d", i)
+			}
+			tokens = append(tokens, token{kind: tokenValue, value: expr[i+1 : i+1+end], pos: i})
+			i += end + 2
+		case strings.HasPrefix(expr[i:], "=="):
+			tokens = append(tokens, token{kind: tokenEqual, value: "==", pos: i})
+			i += 2
+		case strings.HasPrefix(expr[i:], "!="):
+			tokens = append(tokens, token{kind: tokenNotEqual, value: "!=", pos: i})
+			i += 2
+		case strings.HasPrefix(expr[i:], "&&"):
+			tokens = append(tokens, token{kind: tokenAnd, value: "&&", pos: i})
+			i += 2
+		case strings.HasPrefix(expr[i:], "||"):
+			tokens = append(tokens, token{kind: tokenOr, value: "||", pos: i})
+			i += 2
+		case c == '!':
+			tokens = append(tokens, token{kind: tokenNot, value: "!", pos: i})
+			i++
+		case c == '(':
+			tokens = append(tokens, token{kind: tokenLParen, value: "(", pos: i})
+			i++
+		case c == ')':
+			tokens = append(tokens, token{kind: tokenRParen, value: ")", pos: i})
+			i++
+		case isWordByte(c):
+			start := i
+			for i < len(expr) && isWordByte(expr[i]) {
+				i++
+			}
+			tokens = append(tokens, token{kind: tokenValue, value: expr[start:i], pos: start})
+		default:
+			return nil, fmt.Errorf("unexpected %q at position %d", c, i)
+		}
+	}
+
+	return append(tokens, token{kind: tokenEOF, value: "end of condition", pos: len(expr)}), nil
+}
+
+// result is the value of a (sub)expression: either a string operand,
+// or the boolean result of an operator.
+type result struct {
+	isBool bool
+	b      bool
+	s      string
+}
+
+func (r result) truth() bool {
+	if r.isBool {
+		return r.b
+	}
+
+	return r.s != "" && r.s != "false"
+}
+
+func boolResult(b bool) result {
+	return result{isBool: true, b: b}
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	tok := p.tokens[p.pos]
+	if tok.kind != tokenEOF {
+		p.pos++
+	}
+	return tok
+}
+
+func (p *parser) parseOr() (result, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return result{}, err
+	}
+
+	for p.peek().kind == tokenOr {
+		p.next()
+
+		right, err := p.parseAnd()
+		if err != nil {
+			return result{}, err
+		}
+
+		left = boolResult(left.truth() || right.truth())
+	}
+
+	return left, nil
+}
+
+func (p *parser) parseAnd() (result, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return result{}, err
+	}
+
+	for p.peek().kind == tokenAnd {
+		p.next()
+
+		right, err := p.parseUnary()
+		if err != nil {
+			return result{}, err
+		}
+
+		left = boolResult(left.truth() && right.truth())
+	}
+
+	return left, nil
+}
+
+func (p *parser) parseUnary() (result, error) {
+	if p.peek().kind == tokenNot {
+		p.next()
+
+		operand, err := p.parseUnary()
+		if err != nil {
+			return result{}, err
+		}
+
+		return boolResult(!operand.truth()), nil
+	}
+
+	return p.parseComparison()
+}
+
+func (p *parser) parseComparison() (result, error) {
+	left, err := p.parseOperand()
+	if err != nil {
+		return result{}, err
+	}
+
+	op := p.peek()
+	if op.kind != tokenEqual && op.kind != tokenNotEqual {
+		return left, nil
+	}
+	p.next()
+
+	right, err := p.parseOperand()
+	if err != nil {
+		return result{}, err
+	}
+
+	if left.isBool || right.isBool {
+		return result{}, fmt.Errorf("cannot compare the result of a condition at position %d", op.pos)
+	}
+
+	equal := left.s == right.s
+	if op.kind == tokenEqual {
+		return boolResult(equal), nil
+	}
+
+	return boolResult(!equal), nil
+}
+
+func (p *parser) parseOperand() (result, error) {
+	tok := p.next()
+
+	switch tok.kind {
+	case tokenValue:
+		return result{s: tok.value}, nil
+	case tokenLParen:
+		inner, err := p.parseOr()
+		if err != nil {
+			return result{}, err
+		}
+
+		if closing := p.next(); closing.kind != tokenRParen {
+			return result{}, fmt.Errorf("expected ) at position %d, found %q", closing.pos, closing.value)
+		}
+
+		return inner, nil
+	}
+
+	return result{}, fmt.Errorf("unexpected %q at position %d", tok.value, tok.pos)
+}
@@ -0,0 +1,67 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cond
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEvaluate(t *testing.T) {
+	vars := map[string]string{
+		"${{build.arch}}":      "aarch64",
+		"${{package.version}}": "2.12",
+		"${{inputs.patch}}":    "fix.patch",
+		"${{inputs.enabled}}":  "false",
+	}
+
+	tests := []struct {
+		expr      string
+		expected  bool
+		shouldErr bool
+	}{
+		{expr: `${{build.arch}} == 'aarch64'`, expected: true},
+		{expr: `${{build.arch}} == aarch64`, expected: true},
+		{expr: `${{build.arch}} != "aarch64"`, expected: false},
+		{expr: `${{build.arch}} == 'x86_64' || ${{build.arch}} == 'aarch64'`, expected: true},
+		{expr: `${{build.arch}} == 'aarch64' && ${{package.version}} == '2.11'`, expected: false},
+		{expr: `!(${{build.arch}} == 'x86_64')`, expected: true},
+		{expr: `${{inputs.patch}}`, expected: true},
+		{expr: `${{inputs.enabled}}`, expected: false},
+		{expr: `${{inputs.unset}}`, expected: false},
+		{expr: `!${{inputs.unset}} && ${{inputs.unset}} == ''`, expected: true},
+		{expr: `true || false && false`, expected: true},
+		{expr: `(true || false) && false`, expected: false},
+		{expr: `${{build.arch}} ==`, shouldErr: true},
+		{expr: `(${{build.arch}} == 'aarch64'`, shouldErr: true},
+		{expr: `'aarch64`, shouldErr: true},
+		{expr: `a == b == c`, shouldErr: true},
+		{expr: `a == (b == c)`, shouldErr: true},
+		{expr: `a = b`, shouldErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.expr, func(t *testing.T) {
+			actual, err := Evaluate(test.expr, vars)
+			if test.shouldErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, test.expected, actual)
+		})
+	}
+}